@@ -0,0 +1,109 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/mutility/coverpkg/internal/coverage"
+	"github.com/mutility/coverpkg/internal/git"
+	"github.com/mutility/diag"
+)
+
+// maxAnnotations limits how many uncovered statements are annotated.
+const maxAnnotations = 50
+
+// changedFiles returns the repository paths of the files git diff reports as
+// changed for args, such as two commits or a base...head range.
+func changedFiles(ctx diag.Context, args ...string) (map[string]bool, error) {
+	out, err := git.Diff(ctx, append([]string{"--name-only"}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	changed := make(map[string]bool)
+	for _, name := range strings.Split(out, "\n") {
+		if name != "" {
+			changed[name] = true
+		}
+	}
+	return changed, nil
+}
+
+// repoPaths maps profile paths, which are import paths, to repository paths
+// through the module path and the working directory.
+type repoPaths struct {
+	prefix string // working directory within the repository
+	mod    string // module path, with a trailing slash
+}
+
+func newRepoPaths(ctx diag.Context) (repoPaths, error) {
+	prefix, err := git.RevParse(ctx, "--show-prefix")
+	if err != nil {
+		return repoPaths{}, err
+	}
+	return repoPaths{strings.TrimSpace(prefix), string(coverage.Module(ctx)) + "/"}, nil
+}
+
+// path returns the repository path of file, or false if it is outside the module.
+func (r repoPaths) path(file string) (string, bool) {
+	if !strings.HasPrefix(file, r.mod) {
+		return "", false
+	}
+	return r.prefix + strings.TrimPrefix(file, r.mod), true
+}
+
+// filterChanged returns the files of fd whose repository paths are changed.
+func filterChanged(fd coverage.FileData, paths repoPaths, changed map[string]bool) coverage.FileData {
+	kept := make(coverage.FileData)
+	for file, c := range fd {
+		if p, ok := paths.path(file); ok && changed[p] {
+			kept[file] = c
+		}
+	}
+	return kept
+}
+
+// annotateUncovered emits warnings for uncovered statements in files changed
+// between base and head.
+func annotateUncovered(gha *GitHubAction, ctx diag.Context, stmts coverage.StatementData, base, head string) {
+	changed, err := changedFiles(ctx, base, head)
+	if err != nil {
+		gha.Warning("listing changed files:", err)
+		return
+	}
+
+	paths, err := newRepoPaths(ctx)
+	if err != nil {
+		gha.Warning("locating module:", err)
+		return
+	}
+
+	n := 0
+	for _, span := range stmts.Uncovered() {
+		file, ok := paths.path(span.File)
+		if !ok || !changed[file] {
+			continue
+		}
+		if n++; n > maxAnnotations {
+			continue
+		}
+		gha.WarningAt(file, span.StartLine, span.StartCol, "statement not covered by tests")
+	}
+	if n > maxAnnotations {
+		gha.Printf("%d more uncovered statements not annotated", n-maxAnnotations)
+	}
+}
+
+// onlyChanged returns base and head restricted to the files changed in rng.
+// If they cannot be listed, it warns and returns base and head unchanged.
+func onlyChanged(gha *GitHubAction, ctx diag.Context, base, head coverage.FileData, rng string) (coverage.FileData, coverage.FileData) {
+	changed, err := changedFiles(ctx, rng)
+	if err != nil {
+		gha.Warning("listing changed files:", err)
+		return base, head
+	}
+	paths, err := newRepoPaths(ctx)
+	if err != nil {
+		gha.Warning("locating module:", err)
+		return base, head
+	}
+	return filterChanged(base, paths, changed), filterChanged(head, paths, changed)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/mutility/diag"
+)
+
+// azureURL is the Azure DevOps Services API root; tests replace it.
+var azureURL = "https://dev.azure.com"
+
+// azureAPIVersion is the REST API version requested of Azure DevOps.
+const azureAPIVersion = "7.0"
+
+// azurethreads wraps the Azure DevOps pull request threads API. Each coverpkg
+// comment is the first comment of its own thread.
+type azurethreads struct {
+	client *http.Client
+	url    string
+	token  string
+}
+
+func newAzureThreads(detail *details) *azurethreads {
+	return &azurethreads{
+		client: http.DefaultClient,
+		url: fmt.Sprintf("%s/%s/%s/_apis/git/repositories/%s/pullRequests/%d/threads",
+			strings.TrimSuffix(azureURL, "/"), url.PathEscape(detail.AzureOrg), url.PathEscape(detail.AzureProject),
+			url.PathEscape(detail.AzureRepo), detail.AzurePR),
+		token: detail.AzureToken,
+	}
+}
+
+type (
+	azureThread struct {
+		ID       int64          `json:"id,omitempty"`
+		Comments []azureComment `json:"comments"`
+		Status   int            `json:"status,omitempty"`
+	}
+	azureComment struct {
+		ID              int64  `json:"id,omitempty"`
+		ParentCommentID int64  `json:"parentCommentId"`
+		Content         string `json:"content"`
+		CommentType     int    `json:"commentType,omitempty"`
+		IsDeleted       bool   `json:"isDeleted,omitempty"`
+	}
+	azureThreadList struct {
+		Value []azureThread `json:"value"`
+	}
+)
+
+const (
+	azureCommentText  = 1 // commentType text
+	azureThreadActive = 1 // thread status active
+)
+
+type errStatus struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Status     string
+}
+
+func (e errStatus) Error() string {
+	return fmt.Sprintf("%s %s: %s", e.Method, e.URL, e.Status)
+}
+
+// do sends a request with an optional JSON body, decoding any JSON response into result.
+func (az *azurethreads) do(ctx diag.Context, method, path string, body, result any) error {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(b)
+	}
+	u := az.url + path + "?api-version=" + azureAPIVersion
+	req, err := http.NewRequestWithContext(ctx, method, u, r)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth("", az.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := az.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errStatus{method, u, resp.StatusCode, resp.Status}
+	}
+	if result != nil {
+		err = json.NewDecoder(resp.Body).Decode(result)
+	}
+	return err
+}
+
+func commentPath(comment *prcomment) string {
+	return "/" + strconv.FormatInt(comment.ID, 10) + "/comments/" + strconv.FormatInt(comment.Sub, 10)
+}
+
+func fromAzureThread(thread *azureThread) *prcomment {
+	if len(thread.Comments) == 0 {
+		return &prcomment{ID: thread.ID}
+	}
+	c := thread.Comments[0]
+	return &prcomment{ID: thread.ID, Sub: c.ID, Body: c.Content}
+}
+
+func (az *azurethreads) delete(ctx diag.Context, comment *prcomment) {
+	err := az.do(ctx, http.MethodDelete, commentPath(comment), nil, nil)
+	if err != nil {
+		diag.Warning(ctx, "deleting comment:", err)
+	}
+}
+
+func (az *azurethreads) post(ctx diag.Context, body string) (*prcomment, error) {
+	thread := &azureThread{}
+	err := az.do(ctx, http.MethodPost, "", azureThread{
+		Comments: []azureComment{{Content: body, CommentType: azureCommentText}},
+		Status:   azureThreadActive,
+	}, thread)
+	if err != nil {
+		diag.Error(ctx, "creating comment:", err)
+	}
+	return fromAzureThread(thread), err
+}
+
+func (az *azurethreads) edit(ctx diag.Context, comment *prcomment, body string) (*prcomment, error) {
+	edited := &azureComment{}
+	err := az.do(ctx, http.MethodPatch, commentPath(comment), azureComment{Content: body}, edited)
+	if err != nil {
+		diag.Error(ctx, "updating comment:", err)
+	}
+	return &prcomment{ID: comment.ID, Sub: edited.ID, Body: edited.Content}, err
+}
+
+func (az *azurethreads) find(ctx diag.Context) *prcomment {
+	var threads azureThreadList
+	if err := az.do(ctx, http.MethodGet, "", nil, &threads); err != nil {
+		diag.Warning(ctx, "reading comments:", err)
+		return nil
+	}
+	for i := range threads.Value {
+		thread := &threads.Value[i]
+		if len(thread.Comments) == 0 || thread.Comments[0].IsDeleted {
+			continue
+		}
+		if strings.Contains(thread.Comments[0].Content, commentTag) {
+			return fromAzureThread(thread)
+		}
+	}
+	return nil
+}
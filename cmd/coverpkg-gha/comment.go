@@ -5,11 +5,15 @@ import (
 	"bytes"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"os"
+	"strconv"
 	"strings"
 	"text/template"
+	"time"
 
 	"github.com/google/go-github/v57/github"
 
@@ -29,15 +33,18 @@ func loadMeta(ctx diag.Context, event *GitHubEvent, name, file string, detail *d
 	}
 
 	u := artifacts.download(ctx, art)
+	if u == nil {
+		return nil
+	}
 	resp, err := http.DefaultClient.Get(u.String())
 	if err != nil {
 		return err
 	}
 
-	artzip, err := io.ReadAll(resp.Body)
+	artzip, err := readArtifact(resp, detail.MaxArtifact)
 	resp.Body.Close()
 	if err != nil {
-		return nil
+		return err
 	}
 
 	z, err := zip.NewReader(bytes.NewReader(artzip), int64(len(artzip)))
@@ -54,6 +61,54 @@ func loadMeta(ctx diag.Context, event *GitHubEvent, name, file string, detail *d
 	return json.NewDecoder(f).Decode(&detail)
 }
 
+// defaultMaxArtifact limits the size of a downloaded artifact zip.
+const defaultMaxArtifact = 50 << 20
+
+type errArtifactSize int64
+
+func (e errArtifactSize) Error() string {
+	return fmt.Sprintf("artifact larger than %d bytes; raise max-artifact-bytes to allow it", int64(e))
+}
+
+// errDownload reports an unsuccessful artifact download with the start of
+// the body returned in its place.
+type errDownload struct {
+	errStatus
+	Body string
+}
+
+func (e errDownload) Error() string {
+	if e.Body == "" {
+		return e.errStatus.Error()
+	}
+	return fmt.Sprintf("%s: %q", e.errStatus.Error(), e.Body)
+}
+
+// downloadSnippet limits how much of an unsuccessful download is reported.
+const downloadSnippet = 200
+
+// readArtifact reads the artifact zip of resp, failing if its status is not
+// 200 OK or it is larger than max bytes.
+func readArtifact(resp *http.Response, max int64) ([]byte, error) {
+	if resp.StatusCode != http.StatusOK {
+		u := *resp.Request.URL
+		u.RawQuery = "" // omit the signature of the download URL
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, downloadSnippet))
+		return nil, errDownload{
+			errStatus{resp.Request.Method, u.String(), resp.StatusCode, resp.Status},
+			strings.TrimSpace(string(body)),
+		}
+	}
+	if resp.ContentLength > max {
+		return nil, errArtifactSize(max)
+	}
+	artzip, err := io.ReadAll(io.LimitReader(resp.Body, max+1))
+	if err == nil && int64(len(artzip)) > max {
+		return nil, errArtifactSize(max)
+	}
+	return artzip, err
+}
+
 type wfartifacts struct {
 	client *github.Client
 	owner  string
@@ -88,44 +143,152 @@ func (a *wfartifacts) download(ctx diag.Context, art *github.Artifact) *url.URL
 	return url
 }
 
+// commenter posts, edits, deletes, and finds comments on a pull request.
+type commenter interface {
+	// find returns the existing coverpkg comment, or nil.
+	find(ctx diag.Context) *prcomment
+	post(ctx diag.Context, body string) (*prcomment, error)
+	edit(ctx diag.Context, comment *prcomment, body string) (*prcomment, error)
+	delete(ctx diag.Context, comment *prcomment)
+}
+
+// prcomment is a comment posted by a commenter.
+type prcomment struct {
+	ID   int64  // comment ID, or thread ID for Azure DevOps
+	Sub  int64  // comment ID within the thread for Azure DevOps
+	Node string // GraphQL node ID for GitHub
+	Body string
+}
+
+// GetID returns the ID of comment, or 0 if comment is nil.
+func (comment *prcomment) GetID() int64 {
+	if comment == nil {
+		return 0
+	}
+	return comment.ID
+}
+
 func doComment(ctx diag.Context, event *GitHubEvent, detail *details) (int64, error) {
 	if detail.PRComment != "replace" && detail.PRComment != "update" && detail.PRComment != "append" {
 		ctx.Debug("skipping pr comment:", detail.PRComment)
 		return 0, nil
 	}
 
-	prcomment := issuecomments{
-		client: github.NewClient(nil).WithAuthToken(detail.APIToken),
-		owner:  event.String(ctx, "repository.owner.login"),
-		repo:   event.String(ctx, "repository.name"),
-		issue:  detail.IssueNumber,
+	var prcomments commenter
+	if detail.AzureOrg != "" {
+		prcomments = newAzureThreads(detail)
+	} else if detail.MinimizeComment {
+		prcomments = newGraphQLComments(ctx, event, detail)
+	} else {
+		prcomments = &issuecomments{
+			client: github.NewClient(nil).WithAuthToken(detail.APIToken),
+			owner:  event.String(ctx, "repository.owner.login"),
+			repo:   event.String(ctx, "repository.name"),
+			issue:  detail.IssueNumber,
+		}
 	}
+	body, err := formatComment(ctx, detail)
+	if err != nil {
+		return 0, err
+	}
+	return postComment(ctx, prcomments, detail.PRComment, body)
+}
 
-	oldComment := prcomment.find(ctx)
+// postComment appends, replaces, or updates the coverpkg comment with body,
+// returning the ID of the posted comment.
+func postComment(ctx diag.Context, prcomments commenter, mode, body string) (int64, error) {
+	var oldComment *prcomment
+	if mode != "append" {
+		oldComment = prcomments.find(ctx)
+	}
 	ctx.Debug("Existing comment ID:", oldComment.GetID())
 
-	body := formatComment(ctx, detail)
 	var err error
-	var comment *github.IssueComment
-	switch cfg.PRComment {
+	var comment *prcomment
+	switch mode {
 	case "replace":
-		comment, err = prcomment.post(ctx, body)
+		comment, err = prcomments.post(ctx, body)
 		if err == nil && oldComment != nil {
-			prcomment.delete(ctx, oldComment)
+			prcomments.delete(ctx, oldComment)
 		}
 	case "append":
-		comment, err = prcomment.post(ctx, body)
+		comment, err = prcomments.post(ctx, body)
 	case "update":
-		comment, err = prcomment.edit(ctx, oldComment, body)
+		if oldComment == nil {
+			comment, err = prcomments.post(ctx, body)
+		} else {
+			comment, err = prcomments.edit(ctx, oldComment, body)
+		}
 	}
 	return comment.GetID(), err
 }
 
 func isForbidden(err error) bool {
 	var erresp *github.ErrorResponse
+	var errstatus errStatus
+	if errors.As(err, &errstatus) {
+		return errstatus.StatusCode == http.StatusForbidden
+	}
 	return errors.As(err, &erresp)
 }
 
+// retryDelay is the first delay between retries of GitHub API calls; it
+// doubles with each retry unless GitHub asks for a specific delay. Calls are
+// not retried once their delays would exceed retryLimit in total.
+var (
+	retryDelay = time.Second
+	retryLimit = 2 * time.Minute
+)
+
+// retry calls do until it succeeds, fails with an error other than a server
+// error or rate limit, or the next delay would exceed retryLimit.
+func retry(ctx diag.Context, what string, do func() (*github.Response, error)) error {
+	delay, waited := retryDelay, time.Duration(0)
+	for {
+		resp, err := do()
+		wait, ok := retryAfter(resp, err, delay)
+		if !ok || waited+wait > retryLimit {
+			return err
+		}
+		ctx.Debug(what, "failed; retrying in", wait, "after", err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+		waited += wait
+		delay *= 2
+	}
+}
+
+// retryAfter reports whether err is worth retrying, and how long to wait
+// first: as long as the Retry-After or X-RateLimit-Reset headers request, or
+// delay otherwise.
+func retryAfter(resp *github.Response, err error, delay time.Duration) (time.Duration, bool) {
+	var ratelimit *github.RateLimitError
+	var abuse *github.AbuseRateLimitError
+	switch {
+	case err == nil:
+		return 0, false
+	case errors.As(err, &abuse):
+		if abuse.RetryAfter != nil {
+			return *abuse.RetryAfter, true
+		}
+		return delay, true
+	case errors.As(err, &ratelimit):
+		if wait := time.Until(ratelimit.Rate.Reset.Time); wait > 0 {
+			return wait, true
+		}
+		return delay, true
+	case resp == nil || resp.StatusCode < 500:
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	return delay, true
+}
+
 type issuecomments struct {
 	client *github.Client
 	owner  string
@@ -133,49 +296,67 @@ type issuecomments struct {
 	issue  int
 }
 
-func (gh *issuecomments) delete(ctx diag.Context, comment *github.IssueComment) {
-	_, err := gh.client.Issues.DeleteComment(
-		ctx, gh.owner, gh.repo, comment.GetID())
+func fromIssueComment(comment *github.IssueComment) *prcomment {
+	if comment == nil {
+		return nil
+	}
+	return &prcomment{ID: comment.GetID(), Node: comment.GetNodeID(), Body: comment.GetBody()}
+}
+
+func (gh *issuecomments) delete(ctx diag.Context, comment *prcomment) {
+	err := retry(ctx, "deleting comment", func() (*github.Response, error) {
+		return gh.client.Issues.DeleteComment(ctx, gh.owner, gh.repo, comment.GetID())
+	})
 	if err != nil {
 		diag.Warning(ctx, "deleting comment:", err)
 	}
 }
 
-func (gh *issuecomments) post(ctx diag.Context, body string) (*github.IssueComment, error) {
-	comment, _, err := gh.client.Issues.CreateComment(
-		ctx, gh.owner, gh.repo, gh.issue, &github.IssueComment{Body: &body})
+func (gh *issuecomments) post(ctx diag.Context, body string) (*prcomment, error) {
+	var comment *github.IssueComment
+	err := retry(ctx, "creating comment", func() (resp *github.Response, err error) {
+		comment, resp, err = gh.client.Issues.CreateComment(
+			ctx, gh.owner, gh.repo, gh.issue, &github.IssueComment{Body: &body})
+		return resp, err
+	})
 	if err != nil {
 		diag.Error(ctx, "creating comment:", err)
 	}
-	return comment, err
+	return fromIssueComment(comment), err
 }
 
-func (gh *issuecomments) edit(ctx diag.Context, comment *github.IssueComment, body string) (*github.IssueComment, error) {
-	comment, _, err := gh.client.Issues.EditComment(
-		ctx, gh.owner, gh.repo, comment.GetID(), &github.IssueComment{Body: &body})
+func (gh *issuecomments) edit(ctx diag.Context, comment *prcomment, body string) (*prcomment, error) {
+	var edited *github.IssueComment
+	err := retry(ctx, "updating comment", func() (resp *github.Response, err error) {
+		edited, resp, err = gh.client.Issues.EditComment(
+			ctx, gh.owner, gh.repo, comment.GetID(), &github.IssueComment{Body: &body})
+		return resp, err
+	})
 	if err != nil {
 		diag.Error(ctx, "updating comment:", err)
 	}
-	return comment, err
+	return fromIssueComment(edited), err
 }
 
-func (gh *issuecomments) find(ctx diag.Context) *github.IssueComment {
-	if cfg.PRComment != "update" && cfg.PRComment != "replace" {
-		return nil
-	}
+func (gh *issuecomments) find(ctx diag.Context) *prcomment {
 	opt := &github.IssueListCommentsOptions{
 		ListOptions: github.ListOptions{PerPage: 20},
 	}
 	for {
-		comments, resp, err := gh.client.Issues.ListComments(
-			ctx, gh.owner, gh.repo, gh.issue, opt)
+		var comments []*github.IssueComment
+		var resp *github.Response
+		err := retry(ctx, "reading comments", func() (_ *github.Response, err error) {
+			comments, resp, err = gh.client.Issues.ListComments(
+				ctx, gh.owner, gh.repo, gh.issue, opt)
+			return resp, err
+		})
 		if err != nil {
 			diag.Warning(ctx, "reading comments:", err)
 			return nil
 		}
 		for _, comment := range comments {
-			if strings.Contains(comment.GetBody(), "<!-- coverpkg-tag -->") {
-				return comment
+			if strings.Contains(comment.GetBody(), commentTag) {
+				return fromIssueComment(comment)
 			}
 		}
 		if opt.Page = resp.NextPage; opt.Page == 0 {
@@ -184,22 +365,54 @@ func (gh *issuecomments) find(ctx diag.Context) *github.IssueComment {
 	}
 }
 
-func formatComment(ctx diag.Context, detail *details) string {
-	t := template.Must(template.New("comment").Parse(commentTemplate))
-	sb := &strings.Builder{}
-	err := t.Execute(sb, detail)
+// formatComment executes the comment template of detail, or the built-in
+// commentTemplate, against detail. It adds commentTag to comments that lack it,
+// so they can be found again.
+func formatComment(ctx diag.Context, detail *details) (string, error) {
+	text := commentTemplate
+	if detail.CommentTemplate != "" {
+		buf, err := os.ReadFile(detail.CommentTemplate)
+		if err != nil {
+			return "", err
+		}
+		text = string(buf)
+	}
+	t, err := template.New("comment").Parse(text)
 	if err != nil {
-		ctx.Error("executing template:", err)
+		return "", fmt.Errorf("parsing template: %w", err)
+	}
+	sb := &strings.Builder{}
+	if err := t.Execute(sb, detail); err != nil {
+		return "", fmt.Errorf("executing template: %w", err)
 	}
-	return sb.String()
+	body := sb.String()
+	if !strings.Contains(body, commentTag) {
+		body = commentTag + "\n" + body
+	}
+	return body, nil
 }
 
+// commentTag marks comments posted by coverpkg.
+const commentTag = "<!-- coverpkg-tag -->"
+
 const commentTemplate = `<!-- coverpkg-tag -->
 Test coverage
 {{- if .FoundBase }} change for **{{ .BaseRef }}** ({{ .BaseSHA }}) to
 {{- else }} of
 {{- end }} **{{ .HeadRef}}** ({{ .HeadSHA }}): **{{ .HeadPct | printf "%5.2f%%" }}**
 {{- if .FoundBase }} ({{ .DeltaPct | printf "%+5.2f%%" }}){{ end }}
+{{- with .Classification }}; {{ . }}{{ end }}
+{{- with .Trend }}
+
+Trend: {{ . }}
+{{- end }}
 
 {{ .MarkdownSummary }}
+{{- with .NewUncovered }}
+
+New uncovered {{ $.GroupBy }}s:
+{{ range . }}
+- {{ . }}
+{{- end }}
+{{ end }}
 `
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/v57/github"
+	"github.com/mutility/diag/testdiag"
+
+	"github.com/mutility/coverpkg/internal/notes"
+)
+
+func TestFormatCommentNewUncovered(t *testing.T) {
+	ctx := testdiag.Context(t)
+	detail := &details{
+		config:       &config{GroupBy: "package", BaseRef: "main", HeadRef: "feature"},
+		FoundBase:    true,
+		NewUncovered: []string{"example.com/mod/a", "example.com/mod/b"},
+	}
+	want := "\n\nNew uncovered packages:\n\n- example.com/mod/a\n- example.com/mod/b\n"
+	if got, err := formatComment(ctx, detail); err != nil || !strings.Contains(got, want) {
+		t.Errorf("comment: got %q, %v, want %q", got, err, want)
+	}
+
+	detail.NewUncovered = nil
+	if got, err := formatComment(ctx, detail); err != nil || strings.Contains(got, "New uncovered") {
+		t.Errorf("comment: got %q, %v, want no new uncovered section", got, err)
+	}
+
+	detail.Classification = "2 improved, 1 regressed"
+	want = "(+0.00%); 2 improved, 1 regressed\n"
+	if got, err := formatComment(ctx, detail); err != nil || !strings.Contains(got, want) {
+		t.Errorf("comment: got %q, %v, want %q", got, err, want)
+	}
+
+	if got, err := formatComment(ctx, detail); err != nil || strings.Contains(got, "Trend") {
+		t.Errorf("comment: got %q, %v, want no trend", got, err)
+	}
+	detail.Trend = formatTrend([]notes.Record{{Percent: 78}, {Percent: 79.04}}, 80)
+	want = "regressed\n\nTrend: 78.0% → 79.0% → 80.0%\n\n"
+	if got, err := formatComment(ctx, detail); err != nil || !strings.Contains(got, want) {
+		t.Errorf("comment: got %q, %v, want %q", got, err, want)
+	}
+}
+
+func TestFormatCommentTemplate(t *testing.T) {
+	ctx := testdiag.Context(t)
+	withTempName(t, func(name string) {
+		if err := os.WriteFile(name, []byte("Coverage of {{ .HeadRef }}: {{ .HeadPct | printf \"%.1f\" }}%\n"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		detail := &details{
+			config:  &config{HeadRef: "feature", CommentTemplate: name},
+			HeadPct: 81.25,
+		}
+		want := "<!-- coverpkg-tag -->\nCoverage of feature: 81.2%\n"
+		if got, err := formatComment(ctx, detail); err != nil || got != want {
+			t.Errorf("comment: got %q, %v, want %q", got, err, want)
+		}
+
+		if err := os.WriteFile(name, []byte("{{ .Missing }}"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := formatComment(ctx, detail); err == nil {
+			t.Error("missing field: got nil, want error")
+		}
+	})
+}
+
+// fakeThreads serves a minimal Azure DevOps pull request threads API.
+type fakeThreads struct {
+	threads []azureThread
+}
+
+func (f *fakeThreads) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if _, token, _ := r.BasicAuth(); token != "token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	const base = "/org/proj/_apis/git/repositories/repo/pullRequests/7/threads"
+	if r.URL.Query().Get("api-version") == "" || !strings.HasPrefix(r.URL.Path, base) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	// paths beyond base are /{thread}/comments/{comment}
+	var thread int64
+	if rest := strings.TrimPrefix(r.URL.Path, base); rest != "" {
+		thread, _ = strconv.ParseInt(strings.Split(rest, "/")[1], 10, 64)
+	}
+	find := func() *azureThread {
+		for i := range f.threads {
+			if f.threads[i].ID == thread {
+				return &f.threads[i]
+			}
+		}
+		return nil
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		json.NewEncoder(w).Encode(azureThreadList{Value: f.threads})
+	case http.MethodPost:
+		var t azureThread
+		json.NewDecoder(r.Body).Decode(&t)
+		t.ID = int64(len(f.threads) + 1)
+		t.Comments[0].ID = 1
+		f.threads = append(f.threads, t)
+		json.NewEncoder(w).Encode(t)
+	case http.MethodPatch:
+		var c azureComment
+		json.NewDecoder(r.Body).Decode(&c)
+		t := find()
+		t.Comments[0].Content = c.Content
+		json.NewEncoder(w).Encode(t.Comments[0])
+	case http.MethodDelete:
+		find().Comments[0].IsDeleted = true
+	}
+}
+
+func TestAzureComment(t *testing.T) {
+	fake := &fakeThreads{threads: []azureThread{{ID: 1, Comments: []azureComment{{ID: 1, Content: "unrelated"}}}}}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	defer func(u string) { azureURL = u }(azureURL)
+	azureURL = srv.URL
+
+	ctx := testdiag.Context(t)
+	detail := &details{
+		config: &config{
+			AzureOrg:     "org",
+			AzureProject: "proj",
+			AzureRepo:    "repo",
+			AzurePR:      7,
+			AzureToken:   "token",
+			HeadRef:      "feature",
+		},
+		HeadSHA: "abc123",
+		HeadPct: 50,
+	}
+
+	for _, mode := range []string{"append", "update", "replace"} {
+		detail.PRComment = mode
+		if _, err := doComment(ctx, nil, detail); err != nil {
+			t.Fatal(mode, err)
+		}
+	}
+
+	var live []azureThread
+	for _, th := range fake.threads {
+		if !th.Comments[0].IsDeleted {
+			live = append(live, th)
+		}
+	}
+	if len(live) != 2 || live[0].ID != 1 || live[1].ID != 3 {
+		t.Fatalf("threads: got %+v, want ids 1 and 3", live)
+	}
+	if want := "Test coverage of **feature** (abc123): **50.00%**"; !strings.Contains(live[1].Comments[0].Content, want) {
+		t.Errorf("body: got %q, want %q", live[1].Comments[0].Content, want)
+	}
+}
+
+// fakeGraphQL serves the GitHub GraphQL queries and mutations of graphqlcomments.
+type fakeGraphQL struct {
+	comments []graphqlComment
+}
+
+func (f *fakeGraphQL) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "bearer token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	var req struct {
+		Query     string
+		Variables map[string]any
+	}
+	json.NewDecoder(r.Body).Decode(&req)
+	find := func() *graphqlComment {
+		for i := range f.comments {
+			if f.comments[i].ID == req.Variables["id"] {
+				return &f.comments[i]
+			}
+		}
+		return nil
+	}
+
+	var data any
+	switch {
+	case strings.Contains(req.Query, "addComment"):
+		c := graphqlComment{ID: "C" + strconv.Itoa(len(f.comments)+1), DatabaseID: int64(len(f.comments) + 1), Body: req.Variables["body"].(string)}
+		f.comments = append(f.comments, c)
+		data = map[string]any{"addComment": map[string]any{"commentEdge": map[string]any{"node": c}}}
+	case strings.Contains(req.Query, "updateIssueComment"):
+		c := find()
+		c.Body = req.Variables["body"].(string)
+		data = map[string]any{"updateIssueComment": map[string]any{"issueComment": c}}
+	case strings.Contains(req.Query, "minimizeComment"):
+		find().IsMinimized = true
+		data = map[string]any{"minimizeComment": map[string]any{"minimizedComment": map[string]any{"isMinimized": true}}}
+	default:
+		data = map[string]any{"repository": map[string]any{"pullRequest": map[string]any{
+			"id":       "PR7",
+			"comments": map[string]any{"nodes": f.comments, "pageInfo": map[string]any{"hasPreviousPage": false}},
+		}}}
+	}
+	json.NewEncoder(w).Encode(map[string]any{"data": data})
+}
+
+func TestGraphQLComment(t *testing.T) {
+	fake := &fakeGraphQL{comments: []graphqlComment{{ID: "C1", DatabaseID: 1, Body: "unrelated"}}}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	ctx := testdiag.Context(t)
+	gq := &graphqlcomments{client: srv.Client(), url: srv.URL, token: "token", issue: 7}
+	// append leaves the previous comment expanded, and update edits the newest
+	for _, mode := range []string{"replace", "replace", "append", "update"} {
+		if _, err := postComment(ctx, gq, mode, commentTag+"\n"+mode); err != nil {
+			t.Fatal(mode, err)
+		}
+	}
+
+	var live []string
+	for _, c := range fake.comments {
+		if !c.IsMinimized {
+			live = append(live, c.ID+":"+c.Body)
+		}
+	}
+	if want := []string{"C1:unrelated", "C3:" + commentTag + "\nreplace", "C4:" + commentTag + "\nupdate"}; strings.Join(live, ",") != strings.Join(want, ",") {
+		t.Errorf("comments: got %q, want %q", live, want)
+	}
+}
+
+func TestIssueCommentRetry(t *testing.T) {
+	defer func(delay, limit time.Duration) { retryDelay, retryLimit = delay, limit }(retryDelay, retryLimit)
+	retryDelay, retryLimit = time.Millisecond, 10*time.Millisecond
+
+	var calls int
+	statuses := []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusCreated}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := http.StatusInternalServerError
+		if calls < len(statuses) {
+			status = statuses[calls]
+		}
+		calls++
+		if status == http.StatusServiceUnavailable {
+			w.Header().Set("Retry-After", "0")
+		}
+		w.WriteHeader(status)
+		w.Write([]byte(`{"id": 5, "body": "posted"}`))
+	}))
+	defer srv.Close()
+
+	client := github.NewClient(srv.Client())
+	client.BaseURL, _ = url.Parse(srv.URL + "/")
+	gh := &issuecomments{client: client, owner: "o", repo: "r", issue: 1}
+
+	ctx := testdiag.Context(t)
+	if comment, err := gh.post(ctx, "body"); err != nil || comment.GetID() != 5 || calls != 3 {
+		t.Errorf("post: got %v, %v after %d calls, want comment 5 after 3 calls", comment, err, calls)
+	}
+
+	// delays of 1, 2, and 4ms fit the limit; 8ms more would not
+	calls = len(statuses)
+	if _, err := gh.edit(ctx, &prcomment{ID: 5}, "body"); err == nil || calls-len(statuses) != 4 {
+		t.Errorf("edit: got %v after %d calls, want error after 4 calls", err, calls-len(statuses))
+	}
+}
+
+func TestReadArtifact(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/missing":
+			http.NotFound(w, r)
+		case "/partial":
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write([]byte("0123"))
+		case "/chunked":
+			w.(http.Flusher).Flush() // omit the content length
+			w.Write([]byte("0123456789"))
+		default:
+			w.Write([]byte("0123456789"))
+		}
+	}))
+	defer srv.Close()
+
+	for _, tt := range []struct {
+		path string
+		max  int64
+		want string
+	}{
+		{"/ok", 10, ""},
+		{"/ok", 9, "artifact larger than 9 bytes; raise max-artifact-bytes to allow it"},
+		{"/chunked", 9, "artifact larger than 9 bytes; raise max-artifact-bytes to allow it"},
+		{"/missing?sig=secret", 10, "GET " + srv.URL + "/missing: 404 Not Found: \"404 page not found\""},
+		{"/partial", 10, "GET " + srv.URL + "/partial: 206 Partial Content: \"0123\""},
+	} {
+		resp, err := http.Get(srv.URL + tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := readArtifact(resp, tt.max)
+		resp.Body.Close()
+		if tt.want == "" && (err != nil || string(b) != "0123456789") {
+			t.Errorf("%s: got %q, %v", tt.path, b, err)
+		} else if tt.want != "" && (err == nil || err.Error() != tt.want) {
+			t.Errorf("%s: got %v, want %s", tt.path, err, tt.want)
+		}
+	}
+}
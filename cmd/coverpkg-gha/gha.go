@@ -120,6 +120,20 @@ func (gha *GitHubAction) SetOutput(name, value string) {
 	}
 }
 
+// AddStepSummary appends markdown to the summary page of the run. It does
+// nothing outside of a step that provides GITHUB_STEP_SUMMARY.
+func (gha *GitHubAction) AddStepSummary(markdown string) {
+	_, err := appendFilef(cfg.SetStepSummary, "%s\n", markdown)
+	switch err {
+	case nil:
+		return
+	case errEmptyPath:
+		gha.Debug("GITHUB_STEP_SUMMARY not available")
+	default:
+		gha.Error(err)
+	}
+}
+
 // SetEnv sets an environment variable for future actions.
 func (gha *GitHubAction) SetEnv(name, value string) {
 	format := "%s=%s\n"
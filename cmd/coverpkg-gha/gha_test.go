@@ -213,6 +213,25 @@ func TestSetPath(t *testing.T) {
 	w.Want(t, "::error::GITHUB_PATH not available\n")
 }
 
+func TestAddStepSummary(t *testing.T) {
+	withTempName(t, func(summary string) {
+		withCfg(func() {
+			cfg.SetStepSummary = summary
+			w := &output{}
+			gha := &GitHubAction{w}
+
+			gha.AddStepSummary("| a | b |\n|--|--|\n")
+			w.Want(t, "")
+			wantFileContent(t, summary, "| a | b |\n|--|--|\n\n")
+		})
+	})
+
+	w := &output{}
+	gha := &GitHubAction{w}
+	gha.AddStepSummary("# Coverage")
+	w.Want(t, "::debug::GITHUB_STEP_SUMMARY not available\n")
+}
+
 func withCfg(fn func()) {
 	defer func(old config) { cfg = old }(cfg)
 	fn()
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/mutility/diag"
+)
+
+// defaultGraphQLURL is used when GITHUB_GRAPHQL_URL is not set.
+const defaultGraphQLURL = "https://api.github.com/graphql"
+
+type errGraphQL string
+
+func (e errGraphQL) Error() string {
+	return "graphql: " + string(e)
+}
+
+// graphqlcomments wraps the GitHub GraphQL API, which GitHub Enterprise
+// Server also provides. It minimizes old comments as outdated instead of
+// deleting them.
+type graphqlcomments struct {
+	client  *http.Client
+	url     string
+	token   string
+	owner   string
+	repo    string
+	issue   int
+	subject string // node ID of the pull request, once known
+}
+
+func newGraphQLComments(ctx diag.Context, event *GitHubEvent, detail *details) *graphqlcomments {
+	u := detail.GraphQLURL
+	if u == "" {
+		u = defaultGraphQLURL
+	}
+	return &graphqlcomments{
+		client: http.DefaultClient,
+		url:    u,
+		token:  detail.APIToken,
+		owner:  event.String(ctx, "repository.owner.login"),
+		repo:   event.String(ctx, "repository.name"),
+		issue:  detail.IssueNumber,
+	}
+}
+
+type graphqlComment struct {
+	ID          string `json:"id"`
+	DatabaseID  int64  `json:"databaseId"`
+	Body        string `json:"body"`
+	IsMinimized bool   `json:"isMinimized"`
+}
+
+func fromGraphQLComment(comment *graphqlComment) *prcomment {
+	if comment == nil || comment.ID == "" {
+		return nil
+	}
+	return &prcomment{ID: comment.DatabaseID, Node: comment.ID, Body: comment.Body}
+}
+
+// do sends query with vars, decoding its data into result.
+func (gq *graphqlcomments) do(ctx diag.Context, query string, vars map[string]any, result any) error {
+	b, err := json.Marshal(map[string]any{"query": query, "variables": vars})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, gq.url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "bearer "+gq.token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := gq.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errStatus{http.MethodPost, gq.url, resp.StatusCode, resp.Status}
+	}
+
+	var reply struct {
+		Data   json.RawMessage
+		Errors []struct{ Message string }
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		return err
+	}
+	if len(reply.Errors) > 0 {
+		msgs := make([]string, len(reply.Errors))
+		for i, e := range reply.Errors {
+			msgs[i] = e.Message
+		}
+		return errGraphQL(strings.Join(msgs, "; "))
+	}
+	return json.Unmarshal(reply.Data, result)
+}
+
+const graphqlFindComments = `query($owner: String!, $repo: String!, $issue: Int!, $before: String) {
+  repository(owner: $owner, name: $repo) {
+    pullRequest(number: $issue) {
+      id
+      comments(last: 50, before: $before) {
+        nodes { id databaseId body isMinimized }
+        pageInfo { hasPreviousPage startCursor }
+      }
+    }
+  }
+}`
+
+// find returns the newest coverpkg comment that is not minimized, or nil.
+func (gq *graphqlcomments) find(ctx diag.Context) *prcomment {
+	vars := map[string]any{"owner": gq.owner, "repo": gq.repo, "issue": gq.issue, "before": nil}
+	for {
+		var data struct {
+			Repository struct {
+				PullRequest struct {
+					ID       string
+					Comments struct {
+						Nodes    []graphqlComment
+						PageInfo struct {
+							HasPreviousPage bool
+							StartCursor     string
+						}
+					}
+				}
+			}
+		}
+		if err := gq.do(ctx, graphqlFindComments, vars, &data); err != nil {
+			diag.Warning(ctx, "reading comments:", err)
+			return nil
+		}
+		pr := data.Repository.PullRequest
+		gq.subject = pr.ID
+		for i := len(pr.Comments.Nodes) - 1; i >= 0; i-- {
+			comment := &pr.Comments.Nodes[i]
+			if !comment.IsMinimized && strings.Contains(comment.Body, commentTag) {
+				return fromGraphQLComment(comment)
+			}
+		}
+		if !pr.Comments.PageInfo.HasPreviousPage {
+			return nil
+		}
+		vars["before"] = pr.Comments.PageInfo.StartCursor
+	}
+}
+
+const graphqlAddComment = `mutation($subject: ID!, $body: String!) {
+  addComment(input: {subjectId: $subject, body: $body}) {
+    commentEdge { node { id databaseId body } }
+  }
+}`
+
+func (gq *graphqlcomments) post(ctx diag.Context, body string) (*prcomment, error) {
+	if gq.subject == "" {
+		gq.find(ctx)
+	}
+	var data struct {
+		AddComment struct {
+			CommentEdge struct{ Node graphqlComment }
+		}
+	}
+	err := gq.do(ctx, graphqlAddComment, map[string]any{"subject": gq.subject, "body": body}, &data)
+	if err != nil {
+		diag.Error(ctx, "creating comment:", err)
+	}
+	return fromGraphQLComment(&data.AddComment.CommentEdge.Node), err
+}
+
+const graphqlUpdateComment = `mutation($id: ID!, $body: String!) {
+  updateIssueComment(input: {id: $id, body: $body}) {
+    issueComment { id databaseId body }
+  }
+}`
+
+func (gq *graphqlcomments) edit(ctx diag.Context, comment *prcomment, body string) (*prcomment, error) {
+	var data struct {
+		UpdateIssueComment struct{ IssueComment graphqlComment }
+	}
+	err := gq.do(ctx, graphqlUpdateComment, map[string]any{"id": comment.Node, "body": body}, &data)
+	if err != nil {
+		diag.Error(ctx, "updating comment:", err)
+	}
+	return fromGraphQLComment(&data.UpdateIssueComment.IssueComment), err
+}
+
+const graphqlMinimizeComment = `mutation($id: ID!) {
+  minimizeComment(input: {subjectId: $id, classifier: OUTDATED}) {
+    minimizedComment { isMinimized }
+  }
+}`
+
+// delete minimizes comment as outdated.
+func (gq *graphqlcomments) delete(ctx diag.Context, comment *prcomment) {
+	var data struct{}
+	if err := gq.do(ctx, graphqlMinimizeComment, map[string]any{"id": comment.Node}, &data); err != nil {
+		diag.Warning(ctx, "minimizing comment:", err)
+	}
+}
@@ -8,6 +8,8 @@ import (
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/urfave/cli/v2"
 
@@ -22,12 +24,27 @@ func (e errInvalidGroupBy) Error() string {
 	return fmt.Sprintf("group-by value '%s'; must be file, package, root, or module", string(e))
 }
 
+type errInvalidMergeStrategy string
+
+func (e errInvalidMergeStrategy) Error() string {
+	return fmt.Sprintf("merge strategy value '%s'; must be manual, ours, theirs, union, or cat_sort_uniq", string(e))
+}
+
 type errInvalidComment string
 
 func (e errInvalidComment) Error() string {
 	return fmt.Sprintf("comment value '%s'; must be none, append, replace, or update", string(e))
 }
 
+type errMaxDrop struct {
+	MaxDrop float64
+	Paths   []string // offending paths, each with its change
+}
+
+func (e errMaxDrop) Error() string {
+	return fmt.Sprintf("coverage dropped more than %.2f%% in %s", e.MaxDrop, strings.Join(e.Paths, ", "))
+}
+
 type errString string
 
 func (e errString) Error() string { return string(e) }
@@ -72,21 +89,53 @@ type config struct {
 	SetOutput string `json:"-"`
 	// File that receives path additions to be set for future actions
 	SetPath string `json:"-"`
+	// File that receives markdown to show on the summary page of the run
+	SetStepSummary string `json:"-"`
 
 	// URL for information on this run. Not set directly by github actions.
 	RunURL string `json:"-"`
 	// API token for making calls to APIURL or GraphQLURL. Not set directly by github actions.
 	APIToken string `json:"-"`
 
-	Excludes       cli.StringSlice // Package path tokens to exclude; e.g. "gen" will exclude .../gen/...
-	Packages       cli.StringSlice // Packages to report on
-	GroupBy        string          // file, package, root, or module
-	Remote         string          // Remote that provides and/or receives coverage details
-	NoPushCoverage bool            // Persist coverage details, unless true
-	NoPullCoverage bool            // Retrieve coverage details, unless true
-	CoverageRef    string          // Namespace for coverpkg notes
-	PRComment      string          // "", update, replace, or append
-	ArtifactPath   string          // Directory for artifacts; generate if unspecified.
+	Excludes        cli.StringSlice // Package path tokens to exclude; e.g. "gen" will exclude .../gen/...
+	ExcludeFile     string          `json:"-"` // File of further Excludes, one per line
+	Includes        cli.StringSlice // File path regexps to include; e.g. "/api/v[0-9]+/" will include only .../api/v1/...
+	SkipGenerated   bool            // Skip files marked as generated code
+	NoTestFiles     bool            // Skip statements in _test.go files
+	AllowEmpty      bool            // Report empty coverage instead of failing when no statements match
+	BuildTags       cli.StringSlice // Build tags for go test; files they exclude are skipped
+	Packages        cli.StringSlice // Packages to report on
+	GroupBy         string          // file, package, root, or module
+	Remote          string          // Remote that provides and/or receives coverage details
+	NoPushCoverage  bool            // Persist coverage details, unless true
+	NoPullCoverage  bool            // Retrieve coverage details, unless true
+	DryRun          bool            // Print what would be stored instead of storing it
+	Strict          bool            // Fail instead of warning when notes, coverage history, or base coverage can't be used
+	CoverageRef     string          // Namespace for coverpkg notes
+	CompressNotes   bool            // Store gzip-compressed notes
+	MergeStrategy   string          // git notes merge strategy for retrying a rejected push
+	ConfigureNotes  bool            // Configure git to merge the notes ref with MergeStrategy, and keep its notes on rewritten commits
+	GitTimeout      time.Duration   // Limit on each fetch or push of notes, if positive
+	PRComment       string          // "", update, replace, or append
+	CommentTemplate string          `json:"-"` // File with a text/template for the PR comment; built-in if empty
+	MinimizeComment bool            `json:"-"` // Minimize old PR comments through GraphQL instead of deleting them
+	MaxArtifact     int64           `json:"-"` // Largest artifact zip downloaded by workflow_run, in bytes
+	Annotate        bool            // Annotate uncovered statements in changed files
+	ChangedOnly     bool            // Summarize only paths whose coverage changed
+	Detailed        bool            // Expand each path of the markdown summary into its files
+	ChangedFiles    bool            // Measure only files changed by the pull request
+	ArtifactPath    string          // Directory for artifacts; generate if unspecified.
+	BaseProfile     string          // Base coverprofile to use when notes have no base coverage
+	MaxDrop         float64         // Largest drop in percentage points allowed for any path, if set
+	Trend           int             // Number of coverage history points to show in the PR comment, if positive
+	Min             cli.StringSlice // Minimum coverage percentages, overall or as path=percentage
+
+	// Azure DevOps pull request to comment on instead of GitHub, if AzureOrg is set.
+	AzureOrg     string
+	AzureProject string
+	AzureRepo    string
+	AzurePR      int
+	AzureToken   string `json:"-"`
 }
 
 func (cfg config) GitHubContext(c *cli.Context) (*GitHubAction, diag.Context) {
@@ -95,9 +144,11 @@ func (cfg config) GitHubContext(c *cli.Context) (*GitHubAction, diag.Context) {
 }
 
 var cfg = config{
-	GroupBy:     "package",
-	Remote:      "origin",
-	CoverageRef: "coverpkg",
+	GroupBy:       "package",
+	Remote:        "origin",
+	CoverageRef:   "coverpkg",
+	MergeStrategy: "ours",
+	MaxArtifact:   defaultMaxArtifact,
 }
 
 type details struct {
@@ -109,8 +160,11 @@ type details struct {
 	HeadPct         float64
 	BasePct         float64
 	DeltaPct        float64
+	Classification  string // Counts of changed paths, such as "2 improved, 1 regressed"
+	Trend           string // Recent history and head coverage, such as "78.0% → 79.0% → 80.0%"
 	FoundBase       bool
 	IssueNumber     int
+	NewUncovered    []string
 }
 
 func main() {
@@ -118,7 +172,7 @@ func main() {
 		return &cli.BoolFlag{Name: name, EnvVars: env, Usage: usage, Destination: dest}
 	}
 	stringVar := func(dest *string, name, usage string, env ...string) *cli.StringFlag {
-		return &cli.StringFlag{Name: name, EnvVars: env, Usage: usage, Destination: dest, DefaultText: *dest}
+		return &cli.StringFlag{Name: name, EnvVars: env, Usage: usage, Destination: dest, Value: *dest}
 	}
 	stringSliceVar := func(dest *cli.StringSlice, name, usage string, env ...string) *cli.StringSliceFlag {
 		return &cli.StringSliceFlag{Name: name, EnvVars: env, Usage: usage, Destination: dest}
@@ -181,15 +235,24 @@ retrieved.`,
 			stringVar(&cfg.Ref, "ref", "specify the triggering branch or tag name", "GITHUB_REF"),
 			stringVar(&cfg.ServerURL, "server-url", "specify the server, used to form run-url", "GITHUB_SERVER_URL"),
 			stringVar(&cfg.APIURL, "api-url", "specify the api endpoint, used for making comments", "GITHUB_API_URL"),
-			hide(stringVar(&cfg.GraphQLURL, "graphql-url", "specify the graphql endpoint, could be used for making comments", "GITHUB_GRAPHQL_URL")),
+			hide(stringVar(&cfg.GraphQLURL, "graphql-url", "specify the graphql endpoint, used for minimizing comments", "GITHUB_GRAPHQL_URL")),
 			defaultText(stringVar(&cfg.RunURL, "run-url", "specify url to view this run"), "calculated"),
 
 			pathVar(&cfg.SetEnv, "env", "specify env file", "GITHUB_ENV"),
 			pathVar(&cfg.SetOutput, "outputs", "specify outputs file", "GITHUB_OUTPUT"),
 			pathVar(&cfg.SetPath, "path", "specify path file"),
+			pathVar(&cfg.SetStepSummary, "step-summary", "specify step summary file", "GITHUB_STEP_SUMMARY"),
 
 			stringVar(&cfg.GroupBy, "group-by", "specify grouping level: file, package, root, or module", "INPUT_GROUPBY"),
 			stringSliceVar(&cfg.Excludes, "exclude", "list package path names to exclude", "INPUT_EXCLUDES"),
+			pathVar(&cfg.ExcludeFile, "exclude-file", "specify a file listing package path names to exclude, one per line", "INPUT_EXCLUDEFILE"),
+			stringSliceVar(&cfg.Includes, "include", "list file path regexps to include", "INPUT_INCLUDES"),
+			boolVar(&cfg.SkipGenerated, "skip-generated", "skip files marked as generated code", "INPUT_SKIPGENERATED"),
+			boolVar(&cfg.NoTestFiles, "no-test-files", "skip statements in _test.go files", "INPUT_NOTESTFILES"),
+			boolVar(&cfg.AllowEmpty, "allow-empty", "report empty coverage instead of failing when no statements match", "INPUT_ALLOWEMPTY"),
+			boolVar(&cfg.Strict, "strict", "fail instead of warning when notes or coverage history can't be fetched or pushed, or base coverage loaded", "INPUT_STRICT"),
+			&cli.DurationFlag{Name: "git-timeout", Usage: "specify the time each fetch or push of notes may take", EnvVars: []string{"INPUT_GITTIMEOUT"}, Destination: &cfg.GitTimeout},
+			stringSliceVar(&cfg.BuildTags, "tags", "list build tags for go test, skipping files they exclude", "INPUT_TAGS"),
 			defaultText(stringSliceVar(&cfg.Packages, "package", "list packages to report on", "INPUT_PACKAGES"), "all root level"),
 
 			pathVar(&cfg.ArtifactPath, "artifacts", "specify artifact output directory"),
@@ -203,6 +266,11 @@ retrieved.`,
 			default:
 				return errInvalidGroupBy(cfg.GroupBy)
 			}
+			excludes, err := coverage.AppendExcludeFile(cfg.Excludes.Value(), cfg.ExcludeFile)
+			if err != nil {
+				return err
+			}
+			cfg.Excludes = *cli.NewStringSlice(excludes...)
 
 			if c.IsSet("run-url") || !c.IsSet("server-url") || !c.IsSet("repository") || !c.IsSet("run-id") {
 				return nil
@@ -258,10 +326,16 @@ retrieved.`,
 					"  * Git can push to origin\n\n" +
 					"Provides the following outputs:\n\n" +
 					"  * pushed-coverage=true, if pushed\n" +
-					"  * summary=<coverage>, if calculated",
+					"  * summary=<coverage>, if calculated\n" +
+					"  * artifacts=<directory>, if --artifacts received badge.svg",
 				Flags: []cli.Flag{
 					boolVar(&cfg.NoPullCoverage, "coverpkg-nopull", "skip pulling coverage", "INPUT_NOPULL"),
 					boolVar(&cfg.NoPushCoverage, "coverpkg-nopush", "skip pushing coverage", "INPUT_NOPUSH"),
+					boolVar(&cfg.DryRun, "dry-run", "print the report and note instead of storing and pushing coverage", "INPUT_DRYRUN"),
+					boolVar(&cfg.CompressNotes, "coverpkg-compress", "compress stored coverage notes", "INPUT_COMPRESS"),
+					stringSliceVar(&cfg.Min, "min", "fail unless coverage meets a percentage, overall or as path=percentage", "INPUT_MIN"),
+					stringVar(&cfg.MergeStrategy, "coverpkg-merge-strategy", "specify the notes merge strategy used to retry a rejected push", "INPUT_MERGESTRATEGY"),
+					boolVar(&cfg.ConfigureNotes, "configure-notes", "configure git to merge the notes ref with the merge strategy, and to copy notes to rewritten commits", "INPUT_CONFIGURENOTES"),
 					stringVar(&cfg.Remote, "coverpkg-remote", "specify an alternate remote name", "INPUT_REMOTE"),
 					stringVar(&cfg.CoverageRef, "coverpkg-ref", "specify an alternate notes ref name", "INPUT_COVERPKGREF"),
 				},
@@ -282,6 +356,21 @@ retrieved.`,
 					stringVar(&cfg.Remote, "coverpkg-remote", "specify an alternate remote name", "INPUT_REMOTE"),
 					stringVar(&cfg.CoverageRef, "coverpkg-ref", "specify an alternate notes ref name", "INPUT_COVERPKGREF"),
 					stringVar(&cfg.PRComment, "coverpkg-comment", "specify commenting: update, replace, or append", "INPUT_COMMENT"),
+					pathVar(&cfg.CommentTemplate, "comment-template", "specify a text/template file for the comment", "INPUT_COMMENTTEMPLATE"),
+					boolVar(&cfg.MinimizeComment, "minimize-comments", "minimize old comments as outdated instead of deleting them, using the graphql endpoint", "INPUT_MINIMIZE"),
+					boolVar(&cfg.Annotate, "annotate-uncovered", "annotate uncovered statements in changed files", "INPUT_ANNOTATE"),
+					boolVar(&cfg.ChangedOnly, "changed-only", "summarize only paths whose coverage changed, and a count of the rest", "INPUT_CHANGEDONLY"),
+					boolVar(&cfg.ChangedFiles, "changed-files-only", "measure only the files changed by the pull request", "INPUT_CHANGEDFILESONLY"),
+					boolVar(&cfg.Detailed, "detailed", "expand each path of the markdown summary into a collapsible table of its files", "INPUT_DETAILED"),
+					pathVar(&cfg.BaseProfile, "base-coverprofile", "specify a base coverprofile to use if notes lack base coverage", "INPUT_BASECOVERPROFILE"),
+					stringVar(&cfg.AzureOrg, "azure-org", "specify an Azure DevOps organization to comment on its pull request instead", "INPUT_AZUREORG"),
+					stringVar(&cfg.AzureProject, "azure-project", "specify the Azure DevOps project", "INPUT_AZUREPROJECT"),
+					stringVar(&cfg.AzureRepo, "azure-repo", "specify the Azure DevOps repository name or ID", "INPUT_AZUREREPO"),
+					&cli.IntFlag{Name: "azure-pr", Usage: "specify the Azure DevOps pull request ID", EnvVars: []string{"INPUT_AZUREPR"}, Destination: &cfg.AzurePR},
+					stringVar(&cfg.AzureToken, "azure-token", "specify the token used for commenting on Azure DevOps pull requests", "INPUT_AZURETOKEN"),
+					stringSliceVar(&cfg.Min, "min", "fail unless coverage meets a percentage, overall or as path=percentage", "INPUT_MIN"),
+					&cli.IntFlag{Name: "trend", Usage: "show this many points of the coverage history pushed by push runs in the comment", EnvVars: []string{"INPUT_TREND"}, Destination: &cfg.Trend},
+					&cli.Float64Flag{Name: "max-drop", Usage: "fail if coverage of any path drops by more than this many percentage points", EnvVars: []string{"INPUT_MAXDROP"}, Destination: &cfg.MaxDrop},
 				},
 			},
 			{
@@ -293,6 +382,9 @@ retrieved.`,
 				Flags: []cli.Flag{
 					stringVar(&cfg.APIToken, "api-token", "specify the token used for commenting on pull requests", "INPUT_TOKEN"),
 					stringVar(&cfg.PRComment, "coverpkg-comment", "specify commenting: update, replace, or append", "INPUT_COMMENT"),
+					pathVar(&cfg.CommentTemplate, "comment-template", "specify a text/template file for the comment", "INPUT_COMMENTTEMPLATE"),
+					boolVar(&cfg.MinimizeComment, "minimize-comments", "minimize old comments as outdated instead of deleting them, using the graphql endpoint", "INPUT_MINIMIZE"),
+					&cli.Int64Flag{Name: "max-artifact-bytes", Usage: "specify the largest coverpkg artifact to download", EnvVars: []string{"INPUT_MAXARTIFACTBYTES"}, Destination: &cfg.MaxArtifact, Value: defaultMaxArtifact},
 				},
 			},
 		},
@@ -325,23 +417,44 @@ func groupBy(ctx diag.Context, by string, filecov coverage.FileData) (interface
 	case "root":
 		return coverage.ByRoot(ctx, filecov), nil
 	case "module":
-		return coverage.ByModule(ctx, filecov), nil
+		return coverage.ByResolvedModule(ctx, filecov), nil
 	default:
 		return nil, errInvalidGroupBy(by)
 	}
 }
 
+// pushRetries limits how often a rejected notes push is merged and retried.
+const pushRetries = 3
+
 // runPush will generate coverage for the current
 func runPush(c *cli.Context) error {
-	gha, ctx := cfg.GitHubContext(c)
-	filecov, err := coverage.CollectFiles(ctx, &coverage.TestOptions{
-		Excludes: cfg.Excludes.Value(),
-		Packages: cfg.Packages.Value(),
-	})
+	switch cfg.MergeStrategy {
+	case "manual", "ours", "theirs", "union", "cat_sort_uniq":
+	default:
+		return errInvalidMergeStrategy(cfg.MergeStrategy)
+	}
+
+	mins, err := coverage.ParseMinimums(cfg.Min.Value())
 	if err != nil {
 		return err
 	}
 
+	gha, ctx := cfg.GitHubContext(c)
+	options := &coverage.TestOptions{
+		Excludes:      cfg.Excludes.Value(),
+		Includes:      cfg.Includes.Value(),
+		SkipGenerated: cfg.SkipGenerated,
+		NoTestFiles:   cfg.NoTestFiles,
+		AllowEmpty:    cfg.AllowEmpty,
+		BuildTags:     cfg.BuildTags.Value(),
+		Packages:      cfg.Packages.Value(),
+	}
+	filecov, err := coverage.CollectFiles(ctx, options)
+	if err != nil {
+		return testsFailed(gha, err)
+	}
+	note := coverage.Note{Mode: options.Mode(), Files: filecov}
+
 	cov, err := groupBy(ctx, cfg.GroupBy, filecov)
 	if err != nil {
 		return err
@@ -349,20 +462,55 @@ func runPush(c *cli.Context) error {
 
 	gha.SetOutput("summary-txt", coverage.Report(cov))
 	gha.SetOutput("summary-md", coverage.ReportMD(cov))
+	gha.AddStepSummary(coverage.ReportMD(cov))
+
+	if cfg.ArtifactPath != "" {
+		err = writeBadge(filepath.Join(cfg.ArtifactPath, "badge.svg"), coverage.Percent(cov))
+		if err != nil {
+			if err := warn(gha, "writing badge:", err); err != nil {
+				return err
+			}
+		} else {
+			gha.SetOutput("artifacts", cfg.ArtifactPath)
+		}
+	}
+
+	// Unmet minimums fail the step after coverage is stored.
+	minErr := checkMin(gha, ctx, cov, filecov, mins)
+
+	if cfg.DryRun {
+		js, err := json.Marshal(note)
+		if err != nil {
+			return err
+		}
+		gha.Group("coverage report", func(diag.Interface) { gha.Print(coverage.Report(cov)) })
+		gha.Group("coverage note", func(diag.Interface) { gha.Print(string(js)) })
+		return minErr
+	}
 
 	if cfg.NoPushCoverage {
-		return nil
+		return minErr
 	}
 
 	ref := notes.RemoteRef{
-		Remote: cfg.Remote,
-		Ref:    cfg.CoverageRef,
+		Remote:   cfg.Remote,
+		Ref:      cfg.CoverageRef,
+		Compress: cfg.CompressNotes,
+		Timeout:  cfg.GitTimeout,
+	}
+
+	if cfg.ConfigureNotes {
+		if err := notes.ConfigureMergeDriver(ctx, ref, cfg.MergeStrategy); err != nil {
+			return err
+		}
 	}
 
 	if !cfg.NoPullCoverage {
 		err = notes.Fetch(ctx, ref)
 		if err != nil {
-			gha.Warning("fetching notes:", err)
+			if err := warn(gha, "fetching notes:", err); err != nil {
+				return err
+			}
 		}
 	}
 
@@ -370,21 +518,103 @@ func runPush(c *cli.Context) error {
 	if err != nil {
 		return err
 	}
-	err = notes.Store(ctx, ref, filecov)
+	err = notes.Store(ctx, ref, note)
 	if err != nil {
 		return err
 	}
 
-	err = notes.Push(ctx, ref)
+	err = notes.PushWithRetry(ctx, ref, cfg.MergeStrategy, pushRetries)
 	if err != nil {
-		gha.Warning("pushing notes:", err)
+		if err := warn(gha, "pushing notes:", err); err != nil {
+			return err
+		}
 	} else {
 		gha.SetOutput("pushed-coverage", "true")
 	}
 
+	if err := pushHistory(gha, ctx, ref, coverage.Percent(filecov)); err != nil {
+		return err
+	}
+
+	return minErr
+}
+
+// pushHistory appends pct to the coverage history of ref, which pull
+// requests show with --trend, and pushes it.
+func pushHistory(gha *GitHubAction, ctx diag.Context, ref notes.RemoteRef, pct float64) error {
+	hist := ref.History()
+	if !cfg.NoPullCoverage {
+		if err := notes.Fetch(ctx, hist); err != nil {
+			if err := warn(gha, "fetching coverage history:", err); err != nil {
+				return err
+			}
+		}
+	}
+	if err := notes.Append(ctx, ref, notes.Record{Percent: pct}); err != nil {
+		return warn(gha, "appending coverage history:", err)
+	}
+	// history notes are lines of records, so concurrent appends are combined
+	if err := notes.PushWithRetry(ctx, hist, "cat_sort_uniq", pushRetries); err != nil {
+		return warn(gha, "pushing coverage history:", err)
+	}
 	return nil
 }
 
+// warn reports err as a warning after what, or returns it as an error if
+// cfg.Strict is set.
+func warn(gha *GitHubAction, what string, err error) error {
+	if cfg.Strict {
+		return fmt.Errorf("%s %w", what, err)
+	}
+	gha.Warning(what, err)
+	return nil
+}
+
+func writeBadge(name string, pct float64) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	err = coverage.WriteBadge(f, pct, "coverage", nil)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// loadTrend returns the last cfg.Trend points of the coverage history of ref,
+// followed by head, or "" if there is no history. Failures are warnings
+// unless cfg.Strict is set.
+func loadTrend(gha *GitHubAction, ctx diag.Context, ref notes.RemoteRef, head float64) (string, error) {
+	hist := ref.History()
+	if !cfg.NoPullCoverage {
+		if err := notes.Fetch(ctx, hist); err != nil {
+			if err := warn(gha, "fetching coverage history:", err); err != nil {
+				return "", err
+			}
+		}
+	}
+	recs, err := notes.History(ctx, ref, cfg.Trend)
+	if err != nil {
+		return "", warn(gha, "loading coverage history:", err)
+	}
+	if len(recs) == 0 {
+		return "", nil
+	}
+	return formatTrend(recs, head), nil
+}
+
+// formatTrend lists the percentages of recs and head, such as
+// "78.0% → 79.0% → 80.0%".
+func formatTrend(recs []notes.Record, head float64) string {
+	points := make([]string, 0, len(recs)+1)
+	for _, rec := range recs {
+		points = append(points, fmt.Sprintf("%.1f%%", rec.Percent))
+	}
+	points = append(points, fmt.Sprintf("%.1f%%", head))
+	return strings.Join(points, " → ")
+}
+
 func runPR(c *cli.Context) error {
 	switch cfg.PRComment {
 	case "", "none", "append", "replace", "update":
@@ -392,16 +622,24 @@ func runPR(c *cli.Context) error {
 		return errInvalidComment(cfg.PRComment)
 	}
 
+	mins, err := coverage.ParseMinimums(cfg.Min.Value())
+	if err != nil {
+		return err
+	}
+
 	gha, ctx := cfg.GitHubContext(c)
 	ref := notes.RemoteRef{
-		Remote: cfg.Remote,
-		Ref:    cfg.CoverageRef,
+		Remote:  cfg.Remote,
+		Ref:     cfg.CoverageRef,
+		Timeout: cfg.GitTimeout,
 	}
 
 	if !cfg.NoPullCoverage {
 		err := notes.Fetch(ctx, ref)
 		if err != nil {
-			gha.Warning("fetching notes:", err)
+			if err := warn(gha, "fetching notes:", err); err != nil {
+				return err
+			}
 		}
 	}
 
@@ -412,21 +650,47 @@ func runPR(c *cli.Context) error {
 	detail.HeadSHA = event.String(gha, "pull_request.head.sha")
 	detail.IssueNumber = event.Int(ctx, "pull_request.number")
 
-	var basefilecov coverage.FileData
-	err := notes.Load(ctx, ref, detail.BaseSHA, &basefilecov)
+	options := &coverage.TestOptions{
+		Excludes:      cfg.Excludes.Value(),
+		Includes:      cfg.Includes.Value(),
+		SkipGenerated: cfg.SkipGenerated,
+		NoTestFiles:   cfg.NoTestFiles,
+		AllowEmpty:    cfg.AllowEmpty,
+		BuildTags:     cfg.BuildTags.Value(),
+		Packages:      cfg.Packages.Value(),
+	}
+
+	var basenote coverage.Note
+	err = notes.Load(ctx, ref, detail.BaseSHA, &basenote)
+	basefilecov := basenote.Files
+	if err == nil {
+		coverage.CheckModes(ctx, basenote.Mode, options.Mode())
+	} else if cfg.BaseProfile != "" {
+		gha.Debug("loading base coverage:", err)
+		var stmts coverage.StatementData
+		stmts, err = coverage.LoadProfile(ctx, cfg.BaseProfile, options)
+		if err != nil {
+			err = fmt.Errorf("loading base coverprofile: %w", err)
+		} else {
+			basefilecov = coverage.ByFiles(ctx, stmts)
+		}
+	}
 	if err != nil {
-		gha.Warning("loading base coverage:", err)
+		if err := warn(gha, "loading base coverage:", err); err != nil {
+			return err
+		}
 	} else {
 		detail.FoundBase = true
 		gha.SetOutput("found-base", "true")
 	}
 
-	headfilecov, err := coverage.CollectFiles(ctx, &coverage.TestOptions{
-		Excludes: cfg.Excludes.Value(),
-		Packages: cfg.Packages.Value(),
-	})
+	headstmts, err := coverage.CollectStatements(ctx, options)
 	if err != nil {
-		return err
+		return testsFailed(gha, err)
+	}
+	headfilecov := coverage.ByFiles(ctx, headstmts)
+	if cfg.ChangedFiles {
+		basefilecov, headfilecov = onlyChanged(gha, ctx, basefilecov, headfilecov, detail.BaseSHA+"..."+detail.HeadSHA)
 	}
 
 	basecov, err := groupBy(ctx, cfg.GroupBy, basefilecov)
@@ -437,23 +701,52 @@ func runPR(c *cli.Context) error {
 	if err != nil {
 		return err
 	}
-	diff := coverage.Diff(gha, basecov, headcov)
+	diff, err := coverage.Diff(gha, basecov, headcov)
+	if err != nil {
+		return err
+	}
 	detail.BasePct = coverage.Percent(basecov)
 	detail.HeadPct = coverage.Percent(headcov)
 	detail.DeltaPct = detail.HeadPct - detail.BasePct
+	if detail.FoundBase {
+		detail.NewUncovered = coverage.NewUncovered(diff)
+		detail.Classification = coverage.Classification(coverage.ClassifyDelta(diff))
+	}
+	if cfg.Trend > 0 {
+		detail.Trend, err = loadTrend(gha, ctx, ref, detail.HeadPct)
+		if err != nil {
+			return err
+		}
+	}
 
 	arts := cfg.ArtifactPath
 	if arts == "" {
 		arts, _ = os.MkdirTemp(os.TempDir(), "coverpkg")
 	}
 
-	detail.TextSummary = coverage.Report(diff)
+	txt := &strings.Builder{}
+	if err := coverage.WriteReport(txt, diff, coverage.ReportOptions{ChangedOnly: cfg.ChangedOnly}); err != nil {
+		return err
+	}
+	detail.TextSummary = txt.String()
 	diag.Group(gha, "Coverage summary", func(gha diag.Interface) {
 		diag.Print(gha, detail.TextSummary)
 	})
 	gha.SetOutput("summary-txt", detail.TextSummary)
-	detail.MarkdownSummary = coverage.ReportMD(diff)
+	mdopts := coverage.ReportOptions{ChangedOnly: cfg.ChangedOnly}
+	if cfg.Detailed {
+		mdopts.Files, err = coverage.Diff(gha, basefilecov, headfilecov)
+		if err != nil {
+			return err
+		}
+	}
+	md := &strings.Builder{}
+	if err := coverage.WriteReportMD(md, diff, mdopts); err != nil {
+		return err
+	}
+	detail.MarkdownSummary = md.String()
 	gha.SetOutput("summary-md", detail.MarkdownSummary)
+	gha.AddStepSummary(detail.MarkdownSummary)
 	if arts != "" {
 		err = os.WriteFile(filepath.Join(arts, "summary.txt"), []byte(detail.TextSummary), 0o644)
 		if err == nil {
@@ -471,6 +764,10 @@ func runPR(c *cli.Context) error {
 		}
 	}
 
+	if cfg.Annotate {
+		annotateUncovered(gha, ctx, headstmts, detail.BaseSHA, detail.HeadSHA)
+	}
+
 	id, err := doComment(ctx, event, &detail)
 	if id != 0 {
 		gha.SetOutput("comment-id", strconv.FormatInt(id, 10))
@@ -480,9 +777,48 @@ func runPR(c *cli.Context) error {
 		gha.SetOutput("comment-failed", "403")
 		err = nil
 	}
+	if err == nil && c.IsSet("max-drop") {
+		err = checkMaxDrop(diff, cfg.MaxDrop)
+	}
+	if minErr := checkMin(gha, ctx, headcov, headfilecov, mins); err == nil {
+		err = minErr
+	}
+	return err
+}
+
+// testsFailed sets the tests-failed output to build or test if err reports a
+// failed test run, and returns err.
+func testsFailed(gha *GitHubAction, err error) error {
+	var terr *coverage.TestRunError
+	if errors.As(err, &terr) {
+		if terr.BuildFailed() {
+			gha.SetOutput("tests-failed", "build")
+		} else {
+			gha.SetOutput("tests-failed", "test")
+		}
+	}
 	return err
 }
 
+// checkMaxDrop returns errMaxDrop if coverage of any path with base coverage
+// dropped by more than maxDrop percentage points.
+func checkMaxDrop(delta coverage.ChangeDetailer, maxDrop float64) error {
+	var paths []string
+	for _, p := range delta.Paths() {
+		base := delta.BaseDetail(p)
+		if base.Total == 0 {
+			continue
+		}
+		if change := delta.Detail(p).Percent() - base.Percent(); change < -maxDrop {
+			paths = append(paths, fmt.Sprintf("%s (%+.2f%%)", p, change))
+		}
+	}
+	if len(paths) > 0 {
+		return errMaxDrop{MaxDrop: maxDrop, Paths: paths}
+	}
+	return nil
+}
+
 func runArtifactComment(c *cli.Context) error {
 	switch cfg.PRComment {
 	case "", "none", "append", "replace", "update":
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/mutility/diag/testdiag"
+
+	"github.com/mutility/coverpkg/internal/coverage"
+	"github.com/mutility/coverpkg/internal/notes"
+	"github.com/mutility/coverpkg/internal/testgit"
+)
+
+func TestCheckMaxDrop(t *testing.T) {
+	ctx := testdiag.Context(t)
+	base := coverage.PackageData{PathData: coverage.PathData{
+		"a": {Count: 10, Covered: 8},
+		"b": {Count: 10, Covered: 8},
+		"c": {Count: 10, Covered: 8},
+	}}
+	head := coverage.PackageData{PathData: coverage.PathData{
+		"a": {Count: 10, Covered: 7},
+		"b": {Count: 10, Covered: 4},
+		"c": {Count: 10, Covered: 9},
+		"d": {Count: 10, Covered: 0},
+	}}
+	delta, err := coverage.Diff(ctx, base, head)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := checkMaxDrop(delta, 40); err != nil {
+		t.Errorf("max drop 40: got %v, want nil", err)
+	}
+	err = checkMaxDrop(delta, 5)
+	want := "coverage dropped more than 5.00% in a (-10.00%), b (-40.00%)"
+	if err == nil || err.Error() != want {
+		t.Errorf("max drop 5: got %v, want %s", err, want)
+	}
+}
+
+func TestPathFile(t *testing.T) {
+	files := coverage.FileData{
+		"m/a/x/x.go": {Count: 1},
+		"m/a/a.go":   {Count: 1},
+		"m/b.go":     {Count: 1},
+	}
+	tests := map[string]string{
+		"m/a":     "m/a/a.go",
+		"m/a/x":   "m/a/x/x.go",
+		"m":       "m/b.go",
+		"m/b.go":  "m/b.go",
+		"m/c":     "",
+		"m/a/x/x": "",
+	}
+	for p, want := range tests {
+		if got := pathFile(files, p); got != want {
+			t.Errorf("pathFile(%s) = %q, want %q", p, got, want)
+		}
+	}
+}
+
+func TestCheckMin(t *testing.T) {
+	ctx := testdiag.Context(t)
+	cov := coverage.PackageData{PathData: coverage.PathData{
+		"m/a": {Count: 10, Covered: 5},
+		"m/b": {Count: 10, Covered: 9},
+	}}
+	withTempName(t, func(outs string) {
+		withCfg(func() {
+			cfg.SetOutput = outs
+			w := &output{}
+			gha := &GitHubAction{w}
+
+			mins := []coverage.Minimum{{Percent: 75}, {Path: "m/a", Percent: 50}, {Path: "m/b", Percent: 95}}
+			err := checkMin(gha, ctx, cov, nil, mins)
+			if err != errMinimums(2) {
+				t.Errorf("got %v, want %v", err, errMinimums(2))
+			}
+			w.Want(t, "::error::package coverage 70.00%25 is below minimum 75.00%25\n"+
+				"::error::package m/b coverage 90.00%25 is below minimum 95.00%25\n")
+			wantFileContent(t, outs, `below-threshold=[{"path":"<all>","percent":70},{"path":"m/b","percent":90}]`+"\n"+
+				"coverage-failed=true\n")
+		})
+	})
+}
+
+func TestFilterChanged(t *testing.T) {
+	fd := coverage.FileData{
+		"example.com/m/a.go":     {Count: 2, Covered: 1},
+		"example.com/m/sub/b.go": {Count: 3, Covered: 3},
+		"example.com/m/c.go":     {Count: 4, Covered: 0},
+		"example.com/other/d.go": {Count: 5, Covered: 5},
+	}
+	paths := repoPaths{prefix: "mod/", mod: "example.com/m/"}
+	changed := map[string]bool{"mod/a.go": true, "mod/sub/b.go": true, "other/d.go": true}
+
+	got := filterChanged(fd, paths, changed)
+	if len(got) != 2 {
+		t.Errorf("filterChanged kept %v, want a.go and sub/b.go", got.Paths())
+	}
+	for _, file := range []string{"example.com/m/a.go", "example.com/m/sub/b.go"} {
+		if got[file] != fd[file] {
+			t.Errorf("filterChanged[%s] = %v, want %v", file, got[file], fd[file])
+		}
+	}
+}
+
+func TestWarnStrict(t *testing.T) {
+	w := &output{}
+	gha := &GitHubAction{w}
+	defer func(old config) { cfg = old }(cfg)
+	failed := errors.New("failed")
+
+	if err := warn(gha, "fetching notes:", failed); err != nil {
+		t.Errorf("lenient: got %v, want nil", err)
+	}
+	w.Want(t, "::warning::fetching notes: failed\n")
+
+	cfg.Strict = true
+	err := warn(gha, "fetching notes:", failed)
+	if !errors.Is(err, failed) || err.Error() != "fetching notes: failed" {
+		t.Errorf("strict: got %v, want fetching notes: failed", err)
+	}
+	w.Want(t, "")
+}
+
+func TestPushHistory(t *testing.T) {
+	repo := testgit.New(t)
+	ctx := testdiag.Context(t)
+	gha := &GitHubAction{io.Discard}
+	ref := notes.RemoteRef{Remote: "origin", Ref: "coverpkg"}
+
+	defer func(old config) { cfg = old }(cfg)
+	for _, pct := range []float64{70, 80} {
+		repo.Git("commit", "-q", "--allow-empty", "-m", "next")
+		if err := pushHistory(gha, ctx, ref, pct); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the pushed history is what pull requests fetch for --trend
+	repo.Git("update-ref", "-d", "refs/notes/coverpkg-history")
+	if got, err := loadTrend(gha, ctx, ref, 90); err != nil || got != "70.0% → 80.0% → 90.0%" {
+		t.Errorf("trend: got %q, %v", got, err)
+	}
+
+	// strict fails the run when the history can't be fetched
+	cfg.Strict = true
+	ref.Remote = "nowhere"
+	if _, err := loadTrend(gha, ctx, ref, 90); err == nil || !strings.HasPrefix(err.Error(), "fetching coverage history:") {
+		t.Errorf("strict trend: got %v, want fetching coverage history error", err)
+	}
+}
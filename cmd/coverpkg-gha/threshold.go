@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/mutility/coverpkg/internal/coverage"
+	"github.com/mutility/diag"
+)
+
+type errMinimums int
+
+func (e errMinimums) Error() string {
+	return fmt.Sprintf("%d coverage minimums not met", int(e))
+}
+
+// belowThreshold is an entry of the below-threshold output. Path is "<all>"
+// for the total.
+type belowThreshold struct {
+	Path    string  `json:"path"`
+	Percent float64 `json:"percent"`
+}
+
+// checkMin reports each unmet minimum as an error, annotating a file of the
+// failing path when it can find one in files. Unless mins is empty, it lists
+// the unmet minimums in the below-threshold output, and sets the
+// coverage-failed output if there are any.
+func checkMin(gha *GitHubAction, ctx diag.Context, cov interface {
+	coverage.EachPather
+	coverage.PathDetailer
+}, files coverage.FileData, mins []coverage.Minimum,
+) error {
+	if len(mins) == 0 {
+		return nil
+	}
+	paths, perr := newRepoPaths(ctx)
+	if perr != nil {
+		diag.Debug(ctx, "locating module:", perr)
+	}
+	below := []belowThreshold{}
+	for _, err := range coverage.CheckMinimums(cov, mins) {
+		if err.Path == "" {
+			below = append(below, belowThreshold{"<all>", err.Actual})
+			gha.Error(err)
+			continue
+		}
+		below = append(below, belowThreshold{err.Path, err.Actual})
+		if file, ok := paths.path(pathFile(files, err.Path)); perr == nil && ok {
+			gha.ErrorAt(file, 0, 0, err)
+		} else {
+			gha.Error(err)
+		}
+	}
+	var js strings.Builder
+	enc := json.NewEncoder(&js)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(below); err == nil {
+		gha.SetOutput("below-threshold", strings.TrimSuffix(js.String(), "\n"))
+	}
+	if len(below) > 0 {
+		gha.SetOutput("coverage-failed", "true")
+		return errMinimums(len(below))
+	}
+	return nil
+}
+
+// pathFile returns a file of files that is, or is in, p. It prefers a file
+// directly in p over one in a package below it.
+func pathFile(files coverage.FileData, p string) string {
+	below := ""
+	for _, f := range files.Paths() {
+		if f == p || path.Dir(f) == p {
+			return f
+		}
+		if below == "" && strings.HasPrefix(f, p+"/") {
+			below = f
+		}
+	}
+	return below
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/mutility/diag"
+)
+
+func doComment(ctx diag.Context, detail *details) error {
+	if detail.MRComment != "replace" && detail.MRComment != "update" && detail.MRComment != "append" {
+		diag.Debug(ctx, "skipping mr comment:", detail.MRComment)
+		return nil
+	}
+
+	mrcomment := mrnotes{
+		client: http.DefaultClient,
+		url: fmt.Sprintf("%s/projects/%s/merge_requests/%d/notes",
+			strings.TrimSuffix(detail.APIURL, "/"), url.PathEscape(detail.ProjectPath), detail.MergeRequestIID),
+		token: detail.APIToken,
+	}
+
+	var oldNote *mrnote
+	if detail.MRComment != "append" {
+		oldNote = mrcomment.find(ctx)
+	}
+
+	body, err := formatComment(ctx, detail)
+	if err != nil {
+		return err
+	}
+	switch detail.MRComment {
+	case "replace":
+		_, err = mrcomment.post(ctx, body)
+		if err == nil && oldNote != nil {
+			mrcomment.delete(ctx, oldNote)
+		}
+	case "append":
+		_, err = mrcomment.post(ctx, body)
+	case "update":
+		if oldNote == nil {
+			_, err = mrcomment.post(ctx, body)
+		} else {
+			_, err = mrcomment.edit(ctx, oldNote, body)
+		}
+	}
+	return err
+}
+
+// mrnotes wraps the GitLab merge request notes API.
+type mrnotes struct {
+	client *http.Client
+	url    string
+	token  string
+}
+
+type mrnote struct {
+	ID   int64  `json:"id"`
+	Body string `json:"body"`
+}
+
+type errStatus struct {
+	Method string
+	URL    string
+	Status string
+}
+
+func (e errStatus) Error() string {
+	return fmt.Sprintf("%s %s: %s", e.Method, e.URL, e.Status)
+}
+
+// do sends a request with an optional JSON body, decoding any JSON response into result.
+func (gl *mrnotes) do(ctx diag.Context, method, url string, body, result any) (*http.Response, error) {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, r)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("PRIVATE-TOKEN", gl.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := gl.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp, errStatus{method, url, resp.Status}
+	}
+	if result != nil {
+		err = json.NewDecoder(resp.Body).Decode(result)
+	}
+	return resp, err
+}
+
+func (gl *mrnotes) delete(ctx diag.Context, note *mrnote) {
+	_, err := gl.do(ctx, http.MethodDelete, gl.url+"/"+strconv.FormatInt(note.ID, 10), nil, nil)
+	if err != nil {
+		diag.Warning(ctx, "deleting comment:", err)
+	}
+}
+
+func (gl *mrnotes) post(ctx diag.Context, body string) (*mrnote, error) {
+	note := &mrnote{}
+	_, err := gl.do(ctx, http.MethodPost, gl.url, mrnote{Body: body}, note)
+	if err != nil {
+		diag.Error(ctx, "creating comment:", err)
+	}
+	return note, err
+}
+
+func (gl *mrnotes) edit(ctx diag.Context, note *mrnote, body string) (*mrnote, error) {
+	edited := &mrnote{}
+	_, err := gl.do(ctx, http.MethodPut, gl.url+"/"+strconv.FormatInt(note.ID, 10), mrnote{Body: body}, edited)
+	if err != nil {
+		diag.Error(ctx, "updating comment:", err)
+	}
+	return edited, err
+}
+
+func (gl *mrnotes) find(ctx diag.Context) *mrnote {
+	page := "1"
+	for page != "" {
+		var notes []*mrnote
+		resp, err := gl.do(ctx, http.MethodGet, gl.url+"?per_page=20&page="+page, nil, &notes)
+		if err != nil {
+			diag.Warning(ctx, "reading comments:", err)
+			return nil
+		}
+		for _, note := range notes {
+			if strings.Contains(note.Body, commentTag) {
+				return note
+			}
+		}
+		page = resp.Header.Get("X-Next-Page")
+	}
+	return nil
+}
+
+// formatComment executes the comment template of detail, or the built-in
+// commentTemplate, against detail. It adds commentTag to comments that lack it,
+// so they can be found again.
+func formatComment(ctx diag.Context, detail *details) (string, error) {
+	text := commentTemplate
+	if detail.CommentTemplate != "" {
+		buf, err := os.ReadFile(detail.CommentTemplate)
+		if err != nil {
+			return "", err
+		}
+		text = string(buf)
+	}
+	t, err := template.New("comment").Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("parsing template: %w", err)
+	}
+	sb := &strings.Builder{}
+	if err := t.Execute(sb, detail); err != nil {
+		return "", fmt.Errorf("executing template: %w", err)
+	}
+	body := sb.String()
+	if !strings.Contains(body, commentTag) {
+		body = commentTag + "\n" + body
+	}
+	return body, nil
+}
+
+// commentTag marks comments posted by coverpkg.
+const commentTag = "<!-- coverpkg-tag -->"
+
+const commentTemplate = `<!-- coverpkg-tag -->
+Test coverage
+{{- if .FoundBase }} change for **{{ .BaseRef }}** ({{ .BaseSHA }}) to
+{{- else }} of
+{{- end }} **{{ .HeadRef }}** ({{ .HeadSHA }}): **{{ .HeadPct | printf "%5.2f%%" }}**
+{{- if .FoundBase }} ({{ .DeltaPct | printf "%+5.2f%%" }}){{ end }}
+{{- with .Classification }}; {{ . }}{{ end }}
+
+{{ .MarkdownSummary }}
+`
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/mutility/diag/testdiag"
+)
+
+// fakeNotes serves a minimal GitLab merge request notes API.
+type fakeNotes struct {
+	notes  []mrnote
+	nextID int64
+}
+
+func (f *fakeNotes) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("PRIVATE-TOKEN") != "token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	const base = "/api/v4/projects/group%2Fproject/merge_requests/7/notes"
+	if r.URL.RawPath != base && !strings.HasPrefix(r.URL.RawPath, base+"/") {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	var note mrnote
+	id, _ := strconv.ParseInt(path.Base(r.URL.Path), 10, 64)
+	switch r.Method {
+	case http.MethodGet:
+		json.NewEncoder(w).Encode(f.notes)
+	case http.MethodPost:
+		json.NewDecoder(r.Body).Decode(&note)
+		f.nextID++
+		note.ID = f.nextID
+		f.notes = append(f.notes, note)
+		json.NewEncoder(w).Encode(note)
+	case http.MethodPut:
+		json.NewDecoder(r.Body).Decode(&note)
+		for i := range f.notes {
+			if f.notes[i].ID == id {
+				f.notes[i].Body = note.Body
+				json.NewEncoder(w).Encode(f.notes[i])
+			}
+		}
+	case http.MethodDelete:
+		for i := range f.notes {
+			if f.notes[i].ID == id {
+				f.notes = append(f.notes[:i], f.notes[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+func TestComment(t *testing.T) {
+	fake := &fakeNotes{notes: []mrnote{{ID: 100, Body: "unrelated"}}}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	ctx := testdiag.Context(t)
+	detail := &details{
+		config: &config{
+			APIURL:          srv.URL + "/api/v4",
+			APIToken:        "token",
+			ProjectPath:     "group/project",
+			MergeRequestIID: 7,
+			HeadRef:         "feature",
+		},
+		HeadSHA: "abc123",
+		HeadPct: 50,
+	}
+
+	for _, mode := range []string{"append", "update", "replace"} {
+		detail.MRComment = mode
+		if err := doComment(ctx, detail); err != nil {
+			t.Fatal(mode, err)
+		}
+	}
+
+	if len(fake.notes) != 2 || fake.notes[0].ID != 100 || fake.notes[1].ID != 2 {
+		t.Fatalf("notes: got %+v, want ids 100 and 2", fake.notes)
+	}
+	if want := "Test coverage of **feature** (abc123): **50.00%**"; !strings.Contains(fake.notes[1].Body, want) {
+		t.Errorf("body: got %q, want %q", fake.notes[1].Body, want)
+	}
+
+	detail.APIToken = "wrong"
+	if err := doComment(ctx, detail); err == nil {
+		t.Error("wrong token: got nil error")
+	}
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/mutility/coverpkg/internal/coverage"
+	"github.com/mutility/coverpkg/internal/notes"
+	"github.com/mutility/diag"
+)
+
+type errInvalidGroupBy string
+
+func (e errInvalidGroupBy) Error() string {
+	return fmt.Sprintf("group-by value '%s'; must be file, package, root, or module", string(e))
+}
+
+type errInvalidMergeStrategy string
+
+func (e errInvalidMergeStrategy) Error() string {
+	return fmt.Sprintf("merge strategy value '%s'; must be manual, ours, theirs, union, or cat_sort_uniq", string(e))
+}
+
+type errInvalidComment string
+
+func (e errInvalidComment) Error() string {
+	return fmt.Sprintf("comment value '%s'; must be none, append, replace, or update", string(e))
+}
+
+type config struct {
+	// The commit revision the project is built for.
+	SHA string
+	// The project namespace with project name, for example group/project.
+	ProjectPath string
+	// The GitLab API v4 root URL, for example https://gitlab.com/api/v4.
+	APIURL string
+	// The URL for the pipeline details.
+	PipelineURL string
+	// The project-level internal ID of the merge request.
+	MergeRequestIID int
+	// The base SHA of the merge request diff.
+	BaseSHA string
+	// The source branch name of the merge request.
+	HeadRef string
+	// The target branch name of the merge request.
+	BaseRef string
+
+	// API token for commenting on merge requests. Not set directly by GitLab CI.
+	APIToken string
+
+	Excludes        cli.StringSlice // Package path tokens to exclude; e.g. "gen" will exclude .../gen/...
+	ExcludeFile     string          // File of further Excludes, one per line
+	Includes        cli.StringSlice // File path regexps to include; e.g. "/api/v[0-9]+/" will include only .../api/v1/...
+	SkipGenerated   bool            // Skip files marked as generated code
+	NoTestFiles     bool            // Skip statements in _test.go files
+	AllowEmpty      bool            // Report empty coverage instead of failing when no statements match
+	BuildTags       cli.StringSlice // Build tags for go test; files they exclude are skipped
+	Packages        cli.StringSlice // Packages to report on
+	GroupBy         string          // file, package, root, or module
+	Remote          string          // Remote that provides and/or receives coverage details
+	NoPushCoverage  bool            // Persist coverage details, unless true
+	NoPullCoverage  bool            // Retrieve coverage details, unless true
+	CoverageRef     string          // Namespace for coverpkg notes
+	CompressNotes   bool            // Store gzip-compressed notes
+	MergeStrategy   string          // git notes merge strategy for retrying a rejected push
+	ConfigureNotes  bool            // Configure git to merge the notes ref with MergeStrategy, and keep its notes on rewritten commits
+	GitTimeout      time.Duration   // Limit on each fetch or push of notes, if positive
+	MRComment       string          // "", update, replace, or append
+	CommentTemplate string          // File with a text/template for the MR comment; built-in if empty
+	ChangedOnly     bool            // Summarize only paths whose coverage changed
+}
+
+func (cfg config) Context(c *cli.Context) diag.Context {
+	return diag.WithContext(context.Background(), diag.NewWriter(c.App.Writer))
+}
+
+var cfg = config{
+	GroupBy:       "package",
+	Remote:        "origin",
+	CoverageRef:   "coverpkg",
+	MergeStrategy: "ours",
+}
+
+type details struct {
+	*config
+	HeadSHA         string
+	MarkdownSummary string
+	HeadPct         float64
+	BasePct         float64
+	DeltaPct        float64
+	Classification  string // Counts of changed paths, such as "2 improved, 1 regressed"
+	FoundBase       bool
+}
+
+func main() {
+	boolVar := func(dest *bool, name, usage string, env ...string) *cli.BoolFlag {
+		return &cli.BoolFlag{Name: name, EnvVars: env, Usage: usage, Destination: dest}
+	}
+	intVar := func(dest *int, name, usage string, env ...string) *cli.IntFlag {
+		return &cli.IntFlag{Name: name, EnvVars: env, Usage: usage, Destination: dest}
+	}
+	stringVar := func(dest *string, name, usage string, env ...string) *cli.StringFlag {
+		return &cli.StringFlag{Name: name, EnvVars: env, Usage: usage, Destination: dest, Value: *dest}
+	}
+	stringSliceVar := func(dest *cli.StringSlice, name, usage string, env ...string) *cli.StringSliceFlag {
+		return &cli.StringSliceFlag{Name: name, EnvVars: env, Usage: usage, Destination: dest}
+	}
+	req := func(f cli.Flag) cli.Flag {
+		switch f := f.(type) {
+		case *cli.IntFlag:
+			f.Required = true
+		case *cli.StringFlag:
+			f.Required = true
+		default:
+			panic(f)
+		}
+		return f
+	}
+	defaultText := func(f cli.Flag, text string) cli.Flag {
+		switch f := f.(type) {
+		case *cli.StringSliceFlag:
+			f.DefaultText = text
+		default:
+			panic(f)
+		}
+		return f
+	}
+	app := &cli.App{
+		Name:     "coverpkg-gitlab",
+		HelpName: "coverpkg-gitlab",
+		Usage:    "calculate cross-package code coverage in a GitLab CI pipeline",
+
+		Description: `Invoke in a GitLab CI job as
+  coverpkg-gitlab $CI_PIPELINE_SOURCE
+to automatically handle push or merge_request_event pipelines.
+
+coverpkg-gitlab will calculate coverage for pushed changes or merge requests.
+For merge requests, the change in coverage will be shown if the base coverage
+can be retrieved.`,
+
+		// reflects https://docs.gitlab.com/ee/ci/variables/predefined_variables.html
+		Flags: []cli.Flag{
+			stringVar(&cfg.SHA, "sha", "specify the triggering sha", "CI_COMMIT_SHA"),
+			stringVar(&cfg.ProjectPath, "project-path", "specify the group/project", "CI_PROJECT_PATH"),
+			stringVar(&cfg.APIURL, "api-url", "specify the api endpoint, used for making comments", "CI_API_V4_URL"),
+			stringVar(&cfg.PipelineURL, "pipeline-url", "specify url to view this pipeline", "CI_PIPELINE_URL"),
+
+			stringVar(&cfg.GroupBy, "group-by", "specify grouping level: file, package, root, or module", "COVERPKG_GROUPBY"),
+			stringSliceVar(&cfg.Excludes, "exclude", "list package path names to exclude", "COVERPKG_EXCLUDES"),
+			stringVar(&cfg.ExcludeFile, "exclude-file", "specify a file listing package path names to exclude, one per line", "COVERPKG_EXCLUDE_FILE"),
+			stringSliceVar(&cfg.Includes, "include", "list file path regexps to include", "COVERPKG_INCLUDES"),
+			boolVar(&cfg.SkipGenerated, "skip-generated", "skip files marked as generated code", "COVERPKG_SKIP_GENERATED"),
+			boolVar(&cfg.NoTestFiles, "no-test-files", "skip statements in _test.go files", "COVERPKG_NO_TEST_FILES"),
+			boolVar(&cfg.AllowEmpty, "allow-empty", "report empty coverage instead of failing when no statements match", "COVERPKG_ALLOW_EMPTY"),
+			&cli.DurationFlag{Name: "git-timeout", Usage: "specify the time each fetch or push of notes may take", EnvVars: []string{"COVERPKG_GITTIMEOUT"}, Destination: &cfg.GitTimeout},
+			stringSliceVar(&cfg.BuildTags, "tags", "list build tags for go test, skipping files they exclude", "COVERPKG_TAGS"),
+			defaultText(stringSliceVar(&cfg.Packages, "package", "list packages to report on", "COVERPKG_PACKAGES"), "all root level"),
+			boolVar(&cfg.NoPullCoverage, "coverpkg-nopull", "skip pulling coverage", "COVERPKG_NOPULL"),
+			stringVar(&cfg.Remote, "coverpkg-remote", "specify an alternate remote name", "COVERPKG_REMOTE"),
+			stringVar(&cfg.CoverageRef, "coverpkg-ref", "specify an alternate notes ref name", "COVERPKG_REF"),
+			boolVar(&cfg.CompressNotes, "coverpkg-compress", "compress stored coverage notes", "COVERPKG_COMPRESS"),
+		},
+
+		Before: func(c *cli.Context) error {
+			switch cfg.GroupBy {
+			case "file", "package", "root", "module":
+			default:
+				return errInvalidGroupBy(cfg.GroupBy)
+			}
+			excludes, err := coverage.AppendExcludeFile(cfg.Excludes.Value(), cfg.ExcludeFile)
+			cfg.Excludes = *cli.NewStringSlice(excludes...)
+			return err
+		},
+
+		Commands: []*cli.Command{
+			{
+				Name: "schedule",
+				Aliases: []string{
+					"api",
+					"chat",
+					"external",
+					"external_pull_request_event",
+					"parent_pipeline",
+					"pipeline",
+					"trigger",
+					"webide",
+				},
+				Usage: "Does nothing; exits without an error for unsupported pipeline sources.",
+				Action: func(c *cli.Context) error {
+					diag.Debug(cfg.Context(c), "Unsupported pipeline source")
+					return nil
+				},
+			},
+			{
+				Name:    "push",
+				Aliases: []string{"web"},
+				Action:  runPush,
+				Usage:   "calculate and save code coverage for the head commit",
+				Description: "Calculates, saves, and pushes code coverage information for the head commit.\n" +
+					"Requires the following:\n\n" +
+					"  * The desired commit has been checked out\n" +
+					"  * Git is configured for commits\n" +
+					"  * Git can push to the remote",
+				Flags: []cli.Flag{
+					boolVar(&cfg.NoPushCoverage, "coverpkg-nopush", "skip pushing coverage", "COVERPKG_NOPUSH"),
+					stringVar(&cfg.MergeStrategy, "coverpkg-merge-strategy", "specify the notes merge strategy used to retry a rejected push", "COVERPKG_MERGESTRATEGY"),
+					boolVar(&cfg.ConfigureNotes, "configure-notes", "configure git to merge the notes ref with the merge strategy, and to copy notes to rewritten commits", "COVERPKG_CONFIGURENOTES"),
+				},
+			},
+			{
+				Name:    "merge_request_event",
+				Aliases: []string{"merge_request"},
+				Action:  runMR,
+				Usage:   "calculate and display code coverage (and change) for the head commit",
+
+				Flags: []cli.Flag{
+					stringVar(&cfg.APIToken, "api-token", "specify the token used for commenting on merge requests", "COVERPKG_TOKEN"),
+					req(intVar(&cfg.MergeRequestIID, "mr-iid", "specify the merge request iid", "CI_MERGE_REQUEST_IID")),
+					req(stringVar(&cfg.BaseSHA, "base-sha", "specify the base sha of the merge request", "CI_MERGE_REQUEST_DIFF_BASE_SHA")),
+					stringVar(&cfg.HeadRef, "head-ref", "specify the source branch name of a merge request", "CI_MERGE_REQUEST_SOURCE_BRANCH_NAME"),
+					stringVar(&cfg.BaseRef, "base-ref", "specify the target branch name of a merge request", "CI_MERGE_REQUEST_TARGET_BRANCH_NAME"),
+					stringVar(&cfg.MRComment, "coverpkg-comment", "specify commenting: update, replace, or append", "COVERPKG_COMMENT"),
+					stringVar(&cfg.CommentTemplate, "comment-template", "specify a text/template file for the comment", "COVERPKG_COMMENTTEMPLATE"),
+					boolVar(&cfg.ChangedOnly, "changed-only", "summarize only paths whose coverage changed, and a count of the rest", "COVERPKG_CHANGED_ONLY"),
+				},
+			},
+		},
+	}
+
+	err := app.Run(os.Args)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+func groupBy(ctx diag.Context, by string, filecov coverage.FileData) (interface {
+	coverage.EachPather
+	coverage.PathDetailer
+}, error,
+) {
+	switch by {
+	case "file":
+		return filecov, nil
+	case "package":
+		return coverage.ByPackage(ctx, filecov), nil
+	case "root":
+		return coverage.ByRoot(ctx, filecov), nil
+	case "module":
+		return coverage.ByResolvedModule(ctx, filecov), nil
+	default:
+		return nil, errInvalidGroupBy(by)
+	}
+}
+
+// pushRetries limits how often a rejected notes push is merged and retried.
+const pushRetries = 3
+
+// runPush will generate and store coverage for the current commit
+func runPush(c *cli.Context) error {
+	switch cfg.MergeStrategy {
+	case "manual", "ours", "theirs", "union", "cat_sort_uniq":
+	default:
+		return errInvalidMergeStrategy(cfg.MergeStrategy)
+	}
+
+	ctx := cfg.Context(c)
+	options := &coverage.TestOptions{
+		Excludes:      cfg.Excludes.Value(),
+		Includes:      cfg.Includes.Value(),
+		SkipGenerated: cfg.SkipGenerated,
+		NoTestFiles:   cfg.NoTestFiles,
+		AllowEmpty:    cfg.AllowEmpty,
+		BuildTags:     cfg.BuildTags.Value(),
+		Packages:      cfg.Packages.Value(),
+	}
+	filecov, err := coverage.CollectFiles(ctx, options)
+	if err != nil {
+		return err
+	}
+
+	cov, err := groupBy(ctx, cfg.GroupBy, filecov)
+	if err != nil {
+		return err
+	}
+	fmt.Fprint(c.App.Writer, coverage.Report(cov))
+
+	if cfg.NoPushCoverage {
+		return nil
+	}
+
+	ref := notes.RemoteRef{
+		Remote:   cfg.Remote,
+		Ref:      cfg.CoverageRef,
+		Compress: cfg.CompressNotes,
+		Timeout:  cfg.GitTimeout,
+	}
+
+	if cfg.ConfigureNotes {
+		if err := notes.ConfigureMergeDriver(ctx, ref, cfg.MergeStrategy); err != nil {
+			return err
+		}
+	}
+
+	if !cfg.NoPullCoverage {
+		err = notes.Fetch(ctx, ref)
+		if err != nil {
+			diag.Warning(ctx, "fetching notes:", err)
+		}
+	}
+
+	err = notes.EnsureUser(ctx)
+	if err != nil {
+		return err
+	}
+	err = notes.Store(ctx, ref, coverage.Note{Mode: options.Mode(), Files: filecov})
+	if err != nil {
+		return err
+	}
+
+	err = notes.PushWithRetry(ctx, ref, cfg.MergeStrategy, pushRetries)
+	if err != nil {
+		diag.Warning(ctx, "pushing notes:", err)
+	}
+	return nil
+}
+
+// runMR will generate coverage for the current commit and compare it to the base
+func runMR(c *cli.Context) error {
+	switch cfg.MRComment {
+	case "", "none", "append", "replace", "update":
+	default:
+		return errInvalidComment(cfg.MRComment)
+	}
+
+	ctx := cfg.Context(c)
+	ref := notes.RemoteRef{
+		Remote:  cfg.Remote,
+		Ref:     cfg.CoverageRef,
+		Timeout: cfg.GitTimeout,
+	}
+
+	if !cfg.NoPullCoverage {
+		err := notes.Fetch(ctx, ref)
+		if err != nil {
+			diag.Warning(ctx, "fetching notes:", err)
+		}
+	}
+
+	detail := details{config: &cfg, HeadSHA: cfg.SHA}
+
+	options := &coverage.TestOptions{
+		Excludes:      cfg.Excludes.Value(),
+		Includes:      cfg.Includes.Value(),
+		SkipGenerated: cfg.SkipGenerated,
+		NoTestFiles:   cfg.NoTestFiles,
+		AllowEmpty:    cfg.AllowEmpty,
+		BuildTags:     cfg.BuildTags.Value(),
+		Packages:      cfg.Packages.Value(),
+	}
+
+	var basenote coverage.Note
+	err := notes.Load(ctx, ref, cfg.BaseSHA, &basenote)
+	basefilecov := basenote.Files
+	if err != nil {
+		diag.Warning(ctx, "loading base coverage:", err)
+	} else {
+		detail.FoundBase = true
+		coverage.CheckModes(ctx, basenote.Mode, options.Mode())
+	}
+
+	headfilecov, err := coverage.CollectFiles(ctx, options)
+	if err != nil {
+		return err
+	}
+
+	basecov, err := groupBy(ctx, cfg.GroupBy, basefilecov)
+	if err != nil && len(basefilecov) > 0 {
+		return err
+	}
+	headcov, err := groupBy(ctx, cfg.GroupBy, headfilecov)
+	if err != nil {
+		return err
+	}
+	diff, err := coverage.Diff(ctx, basecov, headcov)
+	if err != nil {
+		return err
+	}
+	detail.BasePct = coverage.Percent(basecov)
+	detail.HeadPct = coverage.Percent(headcov)
+	detail.DeltaPct = detail.HeadPct - detail.BasePct
+	if detail.FoundBase {
+		detail.Classification = coverage.Classification(coverage.ClassifyDelta(diff))
+	}
+
+	opts := coverage.ReportOptions{ChangedOnly: cfg.ChangedOnly}
+	if err := coverage.WriteReport(c.App.Writer, diff, opts); err != nil {
+		return err
+	}
+	md := &strings.Builder{}
+	if err := coverage.WriteReportMD(md, diff, opts); err != nil {
+		return err
+	}
+	detail.MarkdownSummary = md.String()
+
+	return doComment(ctx, &detail)
+}
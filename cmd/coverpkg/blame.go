@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/mutility/coverpkg/internal/coverage"
+	"github.com/mutility/coverpkg/internal/git"
+	"github.com/mutility/diag"
+)
+
+// blameAuthors maps each line of file to the author who last changed it.
+func blameAuthors(ctx diag.Context, file string) (map[int]string, error) {
+	out, err := git.Blame(ctx, file, "--line-porcelain")
+	if err != nil {
+		return nil, err
+	}
+	return parseBlame(out), nil
+}
+
+// parseBlame reads the output of git blame --line-porcelain, in which each
+// line begins with a header of its commit, original line, and final line,
+// followed by fields including its author, and ends with its tab-prefixed
+// content.
+func parseBlame(out string) map[int]string {
+	authors := make(map[int]string)
+	line := 0
+	scan := bufio.NewScanner(strings.NewReader(out))
+	for scan.Scan() {
+		text := scan.Text()
+		switch {
+		case strings.HasPrefix(text, "\t"):
+			line = 0
+		case line == 0:
+			if f := strings.Fields(text); len(f) >= 3 {
+				line, _ = strconv.Atoi(f[2])
+			}
+		case strings.HasPrefix(text, "author "):
+			authors[line] = strings.TrimPrefix(text, "author ")
+		}
+	}
+	return authors
+}
+
+// writeAuthors writes a table of authors and their uncovered statements.
+func writeAuthors(w io.Writer, authors []coverage.AuthorCount) error {
+	width := len("Author")
+	total := 0
+	for _, a := range authors {
+		if n := len(a.Author); n > width {
+			width = n
+		}
+		total += a.Uncovered
+	}
+	if _, err := fmt.Fprintf(w, "%-*s  %s\n", width, "Author", "Uncovered"); err != nil {
+		return err
+	}
+	for _, a := range authors {
+		if _, err := fmt.Fprintf(w, "%-*s  %9d\n", width, a.Author, a.Uncovered); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "%-*s  %9d\n", width, "<all>", total)
+	return err
+}
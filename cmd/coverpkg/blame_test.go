@@ -0,0 +1,103 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// blameTwo is git blame --line-porcelain of a file committed by Ann, then
+// changed by Bob Lee, who replaced its second line with two and added a fifth.
+const blameTwo = `498a5a58fe6a80f471a072ed5ffd30a758830790 1 1 1
+author Ann
+author-mail <ann@example.com>
+author-time 1577836800
+author-tz +0000
+committer Ann
+committer-mail <ann@example.com>
+committer-time 1577836800
+committer-tz +0000
+summary one
+boundary
+filename f.go
+	a
+30b6155ac8e4e29df462e171cd9fae0976b3f3e3 2 2 2
+author Bob Lee
+author-mail <bob@example.com>
+author-time 1577923200
+author-tz +0000
+committer Bob
+committer-mail <bob@example.com>
+committer-time 1577923200
+committer-tz +0000
+summary two
+previous 498a5a58fe6a80f471a072ed5ffd30a758830790 f.go
+filename f.go
+	B
+30b6155ac8e4e29df462e171cd9fae0976b3f3e3 3 3
+author Bob Lee
+author-mail <bob@example.com>
+author-time 1577923200
+author-tz +0000
+committer Bob
+committer-mail <bob@example.com>
+committer-time 1577923200
+committer-tz +0000
+summary two
+previous 498a5a58fe6a80f471a072ed5ffd30a758830790 f.go
+filename f.go
+	author Mallory
+498a5a58fe6a80f471a072ed5ffd30a758830790 3 4 1
+author Ann
+author-mail <ann@example.com>
+author-time 1577836800
+author-tz +0000
+committer Ann
+committer-mail <ann@example.com>
+committer-time 1577836800
+committer-tz +0000
+summary one
+boundary
+filename f.go
+	c
+30b6155ac8e4e29df462e171cd9fae0976b3f3e3 5 5 1
+author Bob Lee
+author-mail <bob@example.com>
+author-time 1577923200
+author-tz +0000
+committer Bob
+committer-mail <bob@example.com>
+committer-time 1577923200
+committer-tz +0000
+summary two
+previous 498a5a58fe6a80f471a072ed5ffd30a758830790 f.go
+filename f.go
+	d
+`
+
+func TestParseBlame(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		out  string
+		want map[int]string
+	}{
+		{"empty", "", map[int]string{}},
+		{
+			"single",
+			"498a5a58fe6a80f471a072ed5ffd30a758830790 1 1 1\nauthor Ann\nfilename f.go\n\ta\n",
+			map[int]string{1: "Ann"},
+		},
+		{
+			// Bob Lee's commit repeats for lines 2 and 3, which it groups,
+			// and Ann's line 3 moved to line 4; content is never a field
+			"two authors", blameTwo,
+			map[int]string{1: "Ann", 2: "Bob Lee", 3: "Bob Lee", 4: "Ann", 5: "Bob Lee"},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if diff := cmp.Diff(tt.want, parseBlame(tt.out)); diff != "" {
+				t.Errorf("authors (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v3"
+
+	"github.com/mutility/coverpkg/internal/coverage"
+)
+
+// configFileName is searched for in the working directory and its parents.
+const configFileName = ".coverpkg.yml"
+
+// fileConfig holds settings from a config file. Flags and their environment
+// variables override these.
+type fileConfig struct {
+	Excludes []string `yaml:"excludes"`
+	Packages []string `yaml:"packages"`
+	GroupBy  string   `yaml:"group-by"`
+	Format   string   `yaml:"format"`
+	Min      []string `yaml:"min"`
+
+	// Targets maps paths at the chosen grouping to their minimum coverage
+	// percentage; the "default" key applies to paths not listed.
+	Targets map[string]float64 `yaml:"targets"`
+
+	// RootTargets maps root prefixes to the minimum coverage percentage of
+	// the roots they own, whatever the chosen grouping.
+	RootTargets map[string]float64 `yaml:"root-targets"`
+}
+
+var fileCfg fileConfig
+
+// findConfigFile returns the path of the nearest config file in dir or its
+// parents, or "" if there is none.
+func findConfigFile(dir string) (string, error) {
+	for {
+		path := filepath.Join(dir, configFileName)
+		_, err := os.Stat(path)
+		if err == nil {
+			return path, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return "", err
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", nil
+		}
+		dir = parent
+	}
+}
+
+// loadConfigFile reads the nearest config file into fileCfg, and applies its
+// global settings that were not set by flags.
+func loadConfigFile(c *cli.Context) error {
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	path, err := findConfigFile(wd)
+	if err != nil {
+		return err
+	}
+	if path != "" {
+		buf, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if err := yaml.Unmarshal(buf, &fileCfg); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+
+		if len(fileCfg.Excludes) > 0 && !c.IsSet("exclude") {
+			cfg.Excludes = *cli.NewStringSlice(fileCfg.Excludes...)
+		}
+		if len(fileCfg.Packages) > 0 && !c.IsSet("package") {
+			cfg.Packages = *cli.NewStringSlice(fileCfg.Packages...)
+		}
+	}
+
+	excludes, err := coverage.AppendExcludeFile(cfg.Excludes.Value(), cfg.ExcludeFile)
+	cfg.Excludes = *cli.NewStringSlice(excludes...)
+	return err
+}
+
+// applyConfigFile applies the command settings of fileCfg that were not set
+// by flags.
+func applyConfigFile(c *cli.Context) {
+	if fileCfg.GroupBy != "" && !c.IsSet("g") {
+		cfg.GroupBy = fileCfg.GroupBy
+	}
+	if fileCfg.Format != "" && !c.IsSet("f") {
+		cfg.Format = fileCfg.Format
+	}
+	if len(fileCfg.Min) > 0 && (c.Command.Name == "calc" || c.Command.Name == "check") && !c.IsSet("min") {
+		cfg.Min = *cli.NewStringSlice(fileCfg.Min...)
+	}
+}
@@ -1,13 +1,23 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
 
 	"github.com/urfave/cli/v2"
 
 	"github.com/mutility/coverpkg/internal/coverage"
+	"github.com/mutility/coverpkg/internal/git"
 	"github.com/mutility/coverpkg/internal/notes"
 	"github.com/mutility/diag"
 )
@@ -15,28 +25,133 @@ import (
 type config struct {
 	// BaseRef lists a base committish for comparisons.
 	BaseRef string
+
+	// BaseBranch lists a branch whose merge-base with the head is the base
+	// committish, if BaseRef is not set.
+	BaseBranch string
+
+	// HeadRef lists a head committish whose stored coverage is compared
+	// instead of running tests.
+	HeadRef string
 	// BaseProfile lists a base coverprofile for comparisons.
 	BaseProfile string
 
 	// StoreCoverage controls if the calculation will be persisted in git.
 	StoreCoverage bool
 
+	// At is a commit for calc to check out while it runs, if set.
+	At string
+
+	// Since is a commit for diff to check out and test for base coverage, if set.
+	Since string
+
+	// DetectRenames lists removed and new paths of a diff that look renamed
+	DetectRenames bool
+
+	// CompressNotes gzips stored coverage.
+	CompressNotes bool
+
 	// List of package path tokens to exclude; e.g. "gen" will exclude .../gen/...
 	Excludes cli.StringSlice
 
+	// File of further Excludes, one per line; # starts a comment
+	ExcludeFile string
+
+	// List of file path globs to exclude; e.g. "**/mocks/*" will exclude .../mocks/a.go
+	ExcludeGlobs cli.StringSlice
+
+	// List of file path regexps to include; e.g. "/api/v[0-9]+/" will include only .../api/v1/...
+	Includes cli.StringSlice
+
+	// SkipGenerated skips files with a "Code generated ... DO NOT EDIT." comment
+	SkipGenerated bool
+
+	// NoTestFiles skips statements in _test.go files
+	NoTestFiles bool
+
+	// AllowEmpty reports empty coverage instead of failing when filters leave no statements
+	AllowEmpty bool
+
+	// ShowUntested adds uncovered files of packages missing from the profile, such as those without tests
+	ShowUntested bool
+
+	// List of build tags; files they exclude are skipped
+	BuildTags cli.StringSlice
+
 	// List of packages to report on
 	Packages cli.StringSlice
 
+	// List of packages to measure coverage of, if not Packages
+	CoverPkgs cli.StringSlice
+
+	// Workspace tests every module of the go.work workspace
+	Workspace bool
+
+	// Jobs tests each root package separately, this many at a time, if more than 1
+	Jobs int
+
+	// TestRunner replaces go test, e.g. "gotestsum --"
+	TestRunner string
+
+	// List of extra go test flags; e.g. "-tags=integration"
+	TestFlags cli.StringSlice
+
+	// TestTimeout limits how long go test may run, if positive.
+	TestTimeout time.Duration
+
+	// List of minimum coverage percentages; e.g. "80" or "some/pkg=80"
+	Min cli.StringSlice
+
+	// FailOnDecrease controls if diff fails when coverage drops by more than DecreaseTolerance.
+	FailOnDecrease    bool
+	DecreaseTolerance float64
+
+	// StrictExit makes diff exit with exitRegressed on a decrease, and exitError on other errors.
+	StrictExit bool
+
 	Debug        bool
-	GroupBy      string // aggregation level, "file", "package", "root" or "module"
-	Format       string // format of output, "ascii" or "markdown"
-	CoverageRef  string // Namespace for coverpkg notes
-	CoverProfile string // name of stored profile data
+	GroupBy      string  // aggregation level, "function", "file", "package", "root" or "module"
+	Format       string  // format of output, "ascii", "markdown", "lcov", "cobertura", "sarif", "json", "csv", "tsv", or "summary"
+	Sort         string  // order of rows, "name", "coverage", "delta", or "statements"
+	Color        string  // colorize ascii output, "auto", "always", or "never"
+	Relative     bool    // trim the module prefix from ascii and markdown paths
+	TotalOnly    bool    // show only the total row of ascii and markdown reports
+	NoTotal      bool    // omit the total row of ascii and markdown reports
+	ChangedOnly  bool    // show only changed rows of ascii and markdown diff reports
+	Detailed     bool    // expand each row of markdown reports into its files
+	SARIFMin     float64 // report uncovered statements in sarif output of files below this percentage
+	Uncovered    bool    // list uncovered line ranges instead of a report
+	Below        float64 // list only paths below this coverage percentage
+	Limit        int     // list at most this many paths, if positive
+	CoverageRef  string  // Namespace for coverpkg notes
+	CoverProfile string  // name of stored profile data
+	KeepProfile  string  // name to keep the profile of calc and diff test runs as, if set
+	CoverMode    string  // go test -covermode, "set", "count", "atomic", or empty for default
+	Output       string  // name of output file, or stdout if empty
+	Template     string  // name of a text/template file to format reports with instead of Format
+	Open         bool    // open the output in the default browser
+	BadgeLabel   string  // label for badge
+	TrendCount   int     // number of history points to show
+	KeepDays     int     // age in days of the newest commits whose notes prune removes
+	DryRun       bool    // list what would be removed instead of removing it
+
+	// List of profiles to merge for display
+	CoverProfiles cli.StringSlice
+
+	// List of badge color bands as percent:color, and their parsed form
+	Bands      cli.StringSlice
+	BadgeBands []coverage.BadgeBand
 }
 
 var cfg = config{
 	GroupBy:     "package",
 	Format:      "ascii",
+	Sort:        "name",
+	Color:       "auto",
+	BadgeLabel:  "coverage",
+	Below:       100,
+	TrendCount:  10,
+	KeepDays:    90,
 	CoverageRef: "coverpkg",
 }
 
@@ -53,35 +168,240 @@ func (cfg config) Context(c *cli.Context) diag.Context {
 type errInvalidGroupBy string
 
 func (e errInvalidGroupBy) Error() string {
-	return fmt.Sprintf("group-by value '%s'; must be file, package, root, or module", string(e))
+	return fmt.Sprintf("group-by value '%s'; must be function, file, package, root, or module", string(e))
 }
 
 type errInvalidFormat string
 
 func (e errInvalidFormat) Error() string {
-	return fmt.Sprintf("format value '%s'; must be ascii or markdown", string(e))
+	return fmt.Sprintf("format value '%s'; must be ascii, markdown, lcov, cobertura, sarif, json, csv, tsv, or summary", string(e))
+}
+
+type errInvalidProfile int
+
+func (e errInvalidProfile) Error() string {
+	return fmt.Sprintf("%d malformed coverprofile lines", int(e))
+}
+
+type errUnsupportedFormat string
+
+func (e errUnsupportedFormat) Error() string {
+	return fmt.Sprintf("format value '%s'; not supported by this command", string(e))
+}
+
+type errDirty string
+
+func (e errDirty) Error() string {
+	return fmt.Sprintf("cannot check out '%s'; workspace is dirty", string(e))
+}
+
+type errTargets []coverage.Violation
+
+func (e errTargets) Error() string {
+	return fmt.Sprintf("%d paths below their coverage targets", len(e))
+}
+
+type errNoMinimums string
+
+func (e errNoMinimums) Error() string {
+	return fmt.Sprintf("%s has nothing to check; set --min, or targets in the config file", string(e))
+}
+
+type errDecrease struct {
+	Grouping  coverage.Grouping
+	Base      float64
+	Head      float64
+	Tolerance float64
+	Paths     []string // paths whose coverage decreased
+}
+
+func (e errDecrease) Error() string {
+	msg := fmt.Sprintf("%s coverage decreased %.2f%% from %.2f%% to %.2f%%; tolerance %.2f%%",
+		strings.ToLower(e.Grouping.String()), e.Base-e.Head, e.Base, e.Head, e.Tolerance)
+	if len(e.Paths) > 0 {
+		msg += "; decreased in " + strings.Join(e.Paths, ", ")
+	}
+	return msg
+}
+
+// Exit codes of diff --strict-exit.
+const (
+	exitRegressed = 1 // coverage decreased by more than the tolerance
+	exitError     = 2 // coverpkg failed
+)
+
+// errExit carries the exit code of an error.
+type errExit struct {
+	Err  error
+	Code int
+}
+
+func (e errExit) Error() string { return e.Err.Error() }
+func (e errExit) Unwrap() error { return e.Err }
+
+// exitCode returns the code to exit with after err, using the codes of
+// --strict-exit if strict.
+func exitCode(err error, strict bool) int {
+	var exit errExit
+	if errors.As(err, &exit) {
+		return exit.Code
+	}
+	if strict {
+		return exitError
+	}
+	return 1
+}
+
+// strictExit reports whether args or the environment set --strict-exit. It
+// is decided before args are parsed, so errors parsing them, such as an
+// invalid flag before --strict-exit, exit with exitError too.
+func strictExit(args []string) bool {
+	strict, _ := strconv.ParseBool(os.Getenv("COVERPKG_STRICT_EXIT"))
+	for _, arg := range args {
+		if arg == "--" {
+			break
+		}
+		name, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if !strings.HasPrefix(arg, "-") || name != "strict-exit" {
+			continue
+		}
+		strict = true
+		if hasValue {
+			strict, _ = strconv.ParseBool(value)
+		}
+	}
+	return strict
+}
+
+// decreased returns the paths of delta whose coverage decreased.
+func decreased(delta coverage.ChangeDetailer) []string {
+	var paths []string
+	for _, p := range delta.Paths() {
+		if bd := delta.BaseDetail(p); bd.Total > 0 && delta.Detail(p).Percent() < bd.Percent() {
+			paths = append(paths, p)
+		}
+	}
+	return paths
+}
+
+// checkMin returns the first of mins that cov doesn't meet.
+func checkMin(cov interface {
+	coverage.EachPather
+	coverage.PathDetailer
+}, mins []coverage.Minimum,
+) error {
+	if below := coverage.CheckMinimums(cov, mins); len(below) > 0 {
+		return below[0]
+	}
+	return nil
+}
+
+type errInvalidColor string
+
+func (e errInvalidColor) Error() string {
+	return fmt.Sprintf("color value '%s'; must be auto, always, or never", string(e))
+}
+
+type errInvalidSort string
+
+func (e errInvalidSort) Error() string {
+	return fmt.Sprintf("sort value '%s'; must be name, coverage, delta, or statements", string(e))
+}
+
+type errInvalidCoverMode string
+
+func (e errInvalidCoverMode) Error() string {
+	return fmt.Sprintf("covermode value '%s'; must be set, count, or atomic", string(e))
+}
+
+func validateCoverMode(c *cli.Context) error {
+	switch cfg.CoverMode {
+	case "", "set", "count", "atomic":
+		return nil
+	}
+	return errInvalidCoverMode(cfg.CoverMode)
+}
+
+func validateBands(c *cli.Context) error {
+	cfg.BadgeBands = nil
+	for _, s := range cfg.Bands.Value() {
+		band, err := coverage.ParseBadgeBand(s)
+		if err != nil {
+			return err
+		}
+		cfg.BadgeBands = append(cfg.BadgeBands, band)
+	}
+	return nil
 }
 
-func validateGF(*cli.Context) error {
+func validateGF(c *cli.Context) error {
+	applyConfigFile(c)
 	switch cfg.GroupBy {
-	case "file", "package", "root", "module":
+	case "function", "file", "package", "root", "module":
 	default:
 		return errInvalidGroupBy(cfg.GroupBy)
 	}
 	switch cfg.Format {
-	case "md", "markdown", "txt", "ascii":
+	case "md", "markdown", "txt", "ascii", "lcov", "cobertura", "sarif", "json", "csv", "tsv", "summary":
 	default:
 		return errInvalidFormat(cfg.Format)
 	}
+	switch cfg.Sort {
+	case "name", "coverage", "statements":
+	case "delta":
+		if c.Command.Name != "diff" {
+			return coverage.ErrNoChange
+		}
+	default:
+		return errInvalidSort(cfg.Sort)
+	}
+	switch cfg.Color {
+	case "auto", "always", "never":
+	default:
+		return errInvalidColor(cfg.Color)
+	}
 	return nil
 }
 
+// testContext limits ctx to the configured test timeout.
+func testContext(ctx diag.Context) (diag.Context, context.CancelFunc) {
+	if cfg.TestTimeout <= 0 {
+		return ctx, func() {}
+	}
+	tctx, cancel := context.WithTimeout(ctx, cfg.TestTimeout)
+	return diag.WithContext(tctx, ctx), cancel
+}
+
+// useColor reports if ascii output to stdout should be colorized.
+func useColor() bool {
+	switch cfg.Color {
+	case "always":
+		return true
+	case "auto":
+		st, err := os.Stdout.Stat()
+		return err == nil && st.Mode()&os.ModeCharDevice != 0
+	}
+	return false
+}
+
 func main() {
+	err := newApp().Run(os.Args)
+	if errors.Is(err, coverage.ErrNoPackages) {
+		err = fmt.Errorf("%w; check --package, --include, --exclude, and --exclude-glob, or pass --allow-empty", err)
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(exitCode(err, strictExit(os.Args[1:])))
+	}
+}
+
+// newApp returns the coverpkg app, with its flags bound to cfg.
+func newApp() *cli.App {
 	boolVar := func(dest *bool, name, usage string, env ...string) *cli.BoolFlag {
 		return &cli.BoolFlag{Name: name, EnvVars: env, Usage: usage, Destination: dest}
 	}
 	stringVar := func(dest *string, name, usage string, env ...string) *cli.StringFlag {
-		return &cli.StringFlag{Name: name, EnvVars: env, Usage: usage, Destination: dest, DefaultText: *dest}
+		return &cli.StringFlag{Name: name, EnvVars: env, Usage: usage, Destination: dest, Value: *dest}
 	}
 	stringSliceVar := func(dest *cli.StringSlice, name, usage string, env ...string) *cli.StringSliceFlag {
 		return &cli.StringSliceFlag{Name: name, EnvVars: env, Usage: usage, Destination: dest}
@@ -103,18 +423,53 @@ func main() {
 
 	groupBy := &cli.StringFlag{
 		Name:        "g",
-		Usage:       "specify grouping: file, package, root, or module",
+		Usage:       "specify grouping: function, file, package, root, or module",
 		EnvVars:     []string{"COVERPKG_BY"},
 		Destination: &cfg.GroupBy,
 		Value:       "package",
 	}
 	formatAs := &cli.StringFlag{
 		Name:        "f",
-		Usage:       "specify format: <ascii> art or <markdown>",
+		Usage:       "specify format: <ascii> art, <markdown>, <lcov>, <cobertura>, <sarif>, <json>, <csv>, <tsv>, or one-line <summary>",
 		EnvVars:     []string{"COVERPKG_FMT"},
 		Destination: &cfg.Format,
 		Value:       "ascii",
 	}
+	sortBy := &cli.StringFlag{
+		Name:        "sort",
+		Usage:       "specify row order: name, coverage, delta, or statements",
+		EnvVars:     []string{"COVERPKG_SORT"},
+		Destination: &cfg.Sort,
+		Value:       "name",
+	}
+	relative := boolVar(&cfg.Relative, "relative", "trim the module prefix from ascii and markdown paths", "COVERPKG_RELATIVE")
+	totalOnly := boolVar(&cfg.TotalOnly, "total-only", "show only the total row of ascii and markdown reports", "COVERPKG_TOTAL_ONLY")
+	noTotal := boolVar(&cfg.NoTotal, "no-total", "omit the total row of ascii and markdown reports", "COVERPKG_NO_TOTAL")
+	showUntested := boolVar(&cfg.ShowUntested, "show-untested", "report packages without tests as uncovered, counting their statements", "COVERPKG_SHOW_UNTESTED")
+	keepProfile := pathVar(&cfg.KeepProfile, "keep-profile", "specify a file to keep the coverprofile of the test run in", "COVERPKG_KEEP_PROFILE")
+	tmpl := pathVar(&cfg.Template, "template", "specify a text/template file to format the report with, instead of format", "COVERPKG_TEMPLATE")
+	detailed := boolVar(&cfg.Detailed, "detailed", "expand each row of markdown reports into a collapsible table of its files", "COVERPKG_DETAILED")
+	sarifMin := &cli.Float64Flag{
+		Name:        "sarif-threshold",
+		Usage:       "specify the file coverage percentage below which sarif output reports uncovered statements",
+		EnvVars:     []string{"COVERPKG_SARIF_THRESHOLD"},
+		Destination: &cfg.SARIFMin,
+		Value:       100,
+	}
+	output := &cli.PathFlag{
+		Name:        "output",
+		Aliases:     []string{"o"},
+		Usage:       "specify output file",
+		DefaultText: "stdout",
+		Destination: &cfg.Output,
+	}
+	colorize := &cli.StringFlag{
+		Name:        "color",
+		Usage:       "specify ascii coloring: auto, always, or never",
+		EnvVars:     []string{"COVERPKG_COLOR"},
+		Destination: &cfg.Color,
+		Value:       "auto",
+	}
 	coverProfile := &cli.PathFlag{
 		Name:        "coverprofile",
 		Aliases:     []string{"p"},
@@ -129,11 +484,25 @@ func main() {
 		Usage:    "calculate cross-package code coverage",
 
 		Description: ``,
+		Before:      loadConfigFile,
 
 		// reflects https://docs.github.com/en/actions/reference/environment-variables
 		Flags: []cli.Flag{
 			stringSliceVar(&cfg.Excludes, "exclude", "list package path names to exclude", "INPUT_EXCLUDES"),
+			pathVar(&cfg.ExcludeFile, "exclude-file", "specify a file listing package path names to exclude, one per line", "COVERPKG_EXCLUDE_FILE"),
+			stringSliceVar(&cfg.ExcludeGlobs, "exclude-glob", "list file path globs to exclude, where ** matches any number of directories", "COVERPKG_EXCLUDE_GLOB"),
+			stringSliceVar(&cfg.Includes, "include", "list file path regexps to include", "INPUT_INCLUDES"),
+			boolVar(&cfg.SkipGenerated, "skip-generated", "skip files marked as generated code", "COVERPKG_SKIP_GENERATED"),
+			boolVar(&cfg.NoTestFiles, "no-test-files", "skip statements in _test.go files", "COVERPKG_NO_TEST_FILES"),
+			boolVar(&cfg.AllowEmpty, "allow-empty", "report empty coverage instead of failing when no statements match", "COVERPKG_ALLOW_EMPTY"),
+			stringSliceVar(&cfg.BuildTags, "tags", "list build tags for go test, skipping files they exclude", "COVERPKG_TAGS"),
 			defaultText(stringSliceVar(&cfg.Packages, "package", "list packages to report on", "INPUT_EXCLUDES"), "all root level"),
+			stringSliceVar(&cfg.CoverPkgs, "coverpkg", "list packages to measure coverage of, if not those tested", "COVERPKG_COVERPKG"),
+			boolVar(&cfg.Workspace, "workspace", "test every module of the go.work workspace", "COVERPKG_WORKSPACE"),
+			&cli.IntFlag{Name: "jobs", Usage: "specify how many root packages to test at a time, testing all together if 1; not with --workspace", Value: 1, EnvVars: []string{"COVERPKG_JOBS"}, Destination: &cfg.Jobs},
+			stringVar(&cfg.TestRunner, "test-runner", "specify a command to run instead of go test, such as 'gotestsum --'", "COVERPKG_TEST_RUNNER"),
+			stringSliceVar(&cfg.TestFlags, "test-flag", "list extra go test flags, passed before the packages", "COVERPKG_TEST_FLAGS"),
+			&cli.DurationFlag{Name: "test-timeout", Usage: "specify the time go test may run before it is killed", EnvVars: []string{"COVERPKG_TEST_TIMEOUT"}, Destination: &cfg.TestTimeout},
 			boolVar(&cfg.Debug, "debug", "enable debug messages", "COVERPKG_DEBUG"),
 		},
 
@@ -147,7 +516,20 @@ func main() {
 				Flags: []cli.Flag{
 					groupBy,
 					formatAs,
+					sortBy,
+					colorize,
+					relative,
+					totalOnly,
+					noTotal,
+					detailed,
+					sarifMin,
+					tmpl,
+					showUntested,
+					keepProfile,
 					boolVar(&cfg.StoreCoverage, "store", "store coverage info to git, useful to enable diff"),
+					stringVar(&cfg.At, "at", "specify a commit to check out while calculating, restoring the checkout after"),
+					boolVar(&cfg.CompressNotes, "compress", "compress stored coverage info", "COVERPKG_COMPRESS"),
+					stringSliceVar(&cfg.Min, "min", "fail unless coverage meets a percentage, overall or as path=percentage", "COVERPKG_MIN"),
 					stringVar(&cfg.CoverageRef, "coverpkg-ref", "specify an alternate notes ref name", "INPUT_COVERPKGREF"),
 				},
 			},
@@ -160,8 +542,25 @@ func main() {
 				Flags: []cli.Flag{
 					groupBy,
 					formatAs,
+					sortBy,
+					colorize,
+					relative,
+					totalOnly,
+					noTotal,
+					detailed,
+					tmpl,
+					boolVar(&cfg.ChangedOnly, "changed-only", "show only rows whose coverage changed, and a count of the rest", "COVERPKG_CHANGED_ONLY"),
+					showUntested,
+					keepProfile,
 					stringVar(&cfg.BaseRef, "base-ref", "specify the base branch or commit hash"),
-					pathVar(&cfg.BaseProfile, "base-coverprofile", "specify the base coverprofile"),
+					stringVar(&cfg.Since, "since", "specify a commit to check out and test for base coverage, instead of loading notes"),
+					boolVar(&cfg.DetectRenames, "detect-renames", "list removed and new paths with as many statements as likely renames", "COVERPKG_DETECT_RENAMES"),
+					stringVar(&cfg.BaseBranch, "base-branch", "specify a branch whose merge-base with the head is the base, unless base-ref is set"),
+					stringVar(&cfg.HeadRef, "head-ref", "specify a head branch or commit hash to load instead of running tests"),
+					pathVar(&cfg.BaseProfile, "base-coverprofile", "specify the base coverprofile or baseline file"),
+					boolVar(&cfg.FailOnDecrease, "fail-on-decrease", "fail if coverage decreases", "COVERPKG_FAIL_ON_DECREASE"),
+					&cli.Float64Flag{Name: "decrease-tolerance", Usage: "specify the percentage decrease ignored by fail-on-decrease and strict-exit", Destination: &cfg.DecreaseTolerance},
+					boolVar(&cfg.StrictExit, "strict-exit", "exit 1 if coverage decreases, 2 on other errors, and 0 otherwise", "COVERPKG_STRICT_EXIT"),
 
 					stringVar(&cfg.CoverageRef, "coverpkg-ref", "specify an alternate notes ref name", "INPUT_COVERPKGREF"),
 				},
@@ -170,161 +569,894 @@ func main() {
 				Name:   "test",
 				Action: runCover,
 				Usage:  "Run tests, capturing profile",
+				Before: validateCoverMode,
+
+				Flags: []cli.Flag{
+					coverProfile,
+					stringVar(&cfg.CoverMode, "covermode", "specify go test -covermode: set, count, or atomic", "COVERPKG_COVERMODE"),
+				},
+			},
+			{
+				Name:   "html",
+				Action: runHTML,
+				Usage:  "Write an HTML report of a profile, highlighting uncovered lines",
+
+				Flags: []cli.Flag{
+					coverProfile,
+					output,
+					boolVar(&cfg.Open, "open", "open the report in the default browser, writing a temporary file unless output is set"),
+				},
+			},
+			{
+				Name:   "blame",
+				Action: runBlame,
+				Usage:  "Count the uncovered statements of a profile by the author of their lines",
+
+				Flags: []cli.Flag{
+					coverProfile,
+					output,
+				},
+			},
+			{
+				Name:   "badge",
+				Action: runBadge,
+				Usage:  "Write an SVG badge showing total coverage of a profile",
+				Before: validateBands,
 
 				Flags: []cli.Flag{
 					coverProfile,
+					output,
+					stringVar(&cfg.BadgeLabel, "label", "specify the badge label"),
+					defaultText(stringSliceVar(&cfg.Bands, "band", "list colors for coverage below a percentage, as percent:color", "COVERPKG_BADGE_BANDS"), "50:red, 70:orange, 80:yellow, 100:green"),
+				},
+			},
+			{
+				Name:   "baseline",
+				Action: runBaseline,
+				Usage:  "Write file coverage of a profile as a JSON baseline for diff --base-coverprofile",
+
+				Flags: []cli.Flag{
+					coverProfile,
+					output,
 				},
 			},
 			{
 				Name:   "show",
 				Action: runShow,
-				Usage:  "Display existing profile",
+				Usage:  "Display existing profiles, merged",
 				Before: validateGF,
 
 				Flags: []cli.Flag{
 					groupBy,
 					formatAs,
-					coverProfile,
+					sortBy,
+					colorize,
+					relative,
+					totalOnly,
+					noTotal,
+					detailed,
+					sarifMin,
+					tmpl,
+					boolVar(&cfg.Uncovered, "uncovered", "list the uncovered line ranges of each file instead of a report"),
+					&cli.StringSliceFlag{
+						Name:        "coverprofile",
+						Aliases:     []string{"p"},
+						Usage:       "specify coverprofile files",
+						Required:    true,
+						Destination: &cfg.CoverProfiles,
+					},
+				},
+			},
+			{
+				Name:   "worst",
+				Action: runWorst,
+				Usage:  "Display the paths of existing profiles below a coverage percentage, lowest first",
+				Before: validateGF,
+
+				Flags: []cli.Flag{
+					groupBy,
+					formatAs,
+					colorize,
+					relative,
+					&cli.Float64Flag{Name: "below", Usage: "specify the coverage percentage to list paths below", Value: cfg.Below, EnvVars: []string{"COVERPKG_BELOW"}, Destination: &cfg.Below},
+					&cli.IntFlag{Name: "limit", Usage: "specify the most paths to list, or 0 for all", EnvVars: []string{"COVERPKG_LIMIT"}, Destination: &cfg.Limit},
+					&cli.StringSliceFlag{
+						Name:        "coverprofile",
+						Aliases:     []string{"p"},
+						Usage:       "specify coverprofile files",
+						Required:    true,
+						Destination: &cfg.CoverProfiles,
+					},
+				},
+			},
+			{
+				Name:   "check",
+				Action: runCheck,
+				Usage:  "Fail quietly unless existing profiles meet minimum coverage",
+				Before: validateGF,
+
+				Flags: []cli.Flag{
+					groupBy,
+					stringSliceVar(&cfg.Min, "min", "fail unless coverage meets a percentage, overall or as path=percentage", "COVERPKG_MIN"),
+					&cli.StringSliceFlag{
+						Name:        "coverprofile",
+						Aliases:     []string{"p"},
+						Usage:       "specify coverprofile files",
+						Required:    true,
+						Destination: &cfg.CoverProfiles,
+					},
+				},
+			},
+			{
+				Name:   "validate",
+				Action: runValidate,
+				Usage:  "Report malformed lines of existing profiles",
+
+				Flags: []cli.Flag{
+					&cli.StringSliceFlag{
+						Name:        "coverprofile",
+						Aliases:     []string{"p"},
+						Usage:       "specify coverprofile files",
+						Required:    true,
+						Destination: &cfg.CoverProfiles,
+					},
+				},
+			},
+			{
+				Name:   "trend",
+				Action: runTrend,
+				Usage:  "Display the history of total coverage stored by calc --store",
+
+				Flags: []cli.Flag{
+					&cli.IntFlag{Name: "n", Usage: "specify the number of points to show, or 0 for all", Value: cfg.TrendCount, Destination: &cfg.TrendCount},
+					stringVar(&cfg.CoverageRef, "coverpkg-ref", "specify an alternate notes ref name", "INPUT_COVERPKGREF"),
+				},
+			},
+			{
+				Name:  "notes",
+				Usage: "Maintain the coverage notes stored by calc --store",
+
+				Subcommands: []*cli.Command{
+					{
+						Name:   "prune",
+						Action: runPrune,
+						Usage:  "Remove the coverage notes of commits older than keep-days; push the notes ref to share the result",
+
+						Flags: []cli.Flag{
+							&cli.IntFlag{Name: "keep-days", Usage: "specify how many days of notes to keep", Value: cfg.KeepDays, EnvVars: []string{"COVERPKG_KEEP_DAYS"}, Destination: &cfg.KeepDays},
+							boolVar(&cfg.DryRun, "dry-run", "list the commits whose notes would be removed without removing them"),
+							stringVar(&cfg.CoverageRef, "coverpkg-ref", "specify an alternate notes ref name", "INPUT_COVERPKGREF"),
+						},
+					},
 				},
 			},
 		},
 	}
 
-	err := app.Run(os.Args)
+	return app
+}
+
+// checkoutAt checks out commit at, returning a func that checks out the
+// original branch, or commit if detached, again. It refuses to run in a dirty
+// workspace, as checking out could carry changes along or fail partway.
+func checkoutAt(ctx diag.Context, at string) (func(), error) {
+	if git.IsDirty(ctx) {
+		return nil, errDirty(at)
+	}
+	commit, err := git.RevParse(ctx, at+"^{commit}")
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		return nil, fmt.Errorf("resolving %s: %w", at, err)
 	}
+	orig, err := git.CurrentBranch(ctx)
+	if err != nil {
+		orig, err = git.RevParse(ctx, "HEAD")
+		if err != nil {
+			return nil, err
+		}
+	}
+	orig = strings.TrimSpace(orig)
+
+	if _, err := git.Checkout(ctx, strings.TrimSpace(commit)); err != nil {
+		return nil, fmt.Errorf("checking out %s: %w", at, err)
+	}
+	diag.Debug(ctx, "checked out", at, "from", orig)
+	return func() {
+		if _, err := git.Checkout(ctx, orig); err != nil {
+			diag.Error(ctx, "restoring checkout of", orig+":", err)
+		}
+	}, nil
+}
+
+// profileOptions returns the options that filter an existing coverprofile.
+func profileOptions() *coverage.TestOptions {
+	return &coverage.TestOptions{
+		Excludes:      cfg.Excludes.Value(),
+		ExcludeGlobs:  cfg.ExcludeGlobs.Value(),
+		Includes:      cfg.Includes.Value(),
+		SkipGenerated: cfg.SkipGenerated,
+		NoTestFiles:   cfg.NoTestFiles,
+		AllowEmpty:    cfg.AllowEmpty,
+		BuildTags:     cfg.BuildTags.Value(),
+		Packages:      cfg.Packages.Value(),
+	}
+}
+
+// testOptions returns the options that run the tests and filter their
+// coverage, keeping the profile if requested.
+func testOptions() *coverage.TestOptions {
+	options := profileOptions()
+	options.CoverProfile = cfg.KeepProfile
+	options.TestRunner = strings.Fields(cfg.TestRunner)
+	options.Flags = cfg.TestFlags.Value()
+	options.CoverPkgs = cfg.CoverPkgs.Value()
+	options.Workspace = cfg.Workspace
+	options.Jobs = cfg.Jobs
+	return options
+}
+
+// collectAt collects the file coverage of commit at, checking it out and
+// restoring the original checkout after, even if the tests fail. Its profile
+// is temporary, leaving options.CoverProfile to the head. With --show-untested
+// it adds the untested packages of that commit, not of the checkout.
+func collectAt(ctx diag.Context, at string, options coverage.TestOptions) (coverage.FileData, error) {
+	restore, err := checkoutAt(ctx, at)
+	if err != nil {
+		return nil, err
+	}
+	defer restore()
+
+	options.CoverProfile = ""
+	tctx, cancel := testContext(ctx)
+	defer cancel()
+	filecov, err := coverage.CollectFiles(tctx, &options)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.ShowUntested {
+		if err := coverage.AddUntested(ctx, filecov, &options); err != nil {
+			return nil, err
+		}
+	}
+	return filecov, nil
 }
 
 // runCalc will generate coverage for the current
 func runCalc(c *cli.Context) error {
 	ctx := cfg.Context(c)
 
-	filecov, err := coverage.CollectFiles(ctx, &coverage.TestOptions{
-		Excludes: cfg.Excludes.Value(),
-		Packages: cfg.Packages.Value(),
-	})
+	mins, err := coverage.ParseMinimums(cfg.Min.Value())
 	if err != nil {
 		return err
 	}
 
-	var cov coverage.PathDetailer
-	switch cfg.GroupBy {
-	case "file":
-		cov = filecov
-	case "package":
-		cov = coverage.ByPackage(ctx, filecov)
-	case "root":
-		cov = coverage.ByRoot(ctx, filecov)
-	case "module":
-		cov = coverage.ByModule(ctx, filecov)
+	if cfg.At != "" {
+		restore, err := checkoutAt(ctx, cfg.At)
+		if err != nil {
+			return err
+		}
+		defer restore()
 	}
 
-	switch cfg.Format {
-	case "markdown":
-		fmt.Print(coverage.ReportMD(cov))
-	default:
-		fmt.Print(coverage.Report(cov))
+	tctx, cancel := testContext(ctx)
+	defer cancel()
+	options := testOptions()
+	stmts, err := coverage.CollectStatements(tctx, options)
+	if err != nil {
+		return err
+	}
+	filecov := coverage.ByFiles(ctx, stmts)
+	if cfg.ShowUntested {
+		if err := coverage.AddUntested(ctx, filecov, options); err != nil {
+			return err
+		}
+	}
+
+	var src groupable = filecov
+	if cfg.GroupBy == "function" {
+		src = stmts
+	}
+	cov, err := group(ctx, cfg.GroupBy, src)
+	if err != nil {
+		return err
+	}
+
+	if err := writeReport(ctx, reportOptions(ctx), cov, stmts, nil); err != nil {
+		return err
 	}
 
 	if cfg.StoreCoverage {
-		ref := notes.RemoteRef{Ref: cfg.CoverageRef}
-		return notes.Store(ctx, ref, filecov)
+		ref := notes.RemoteRef{Ref: cfg.CoverageRef, Compress: cfg.CompressNotes}
+		if err := notes.Store(ctx, ref, coverage.Note{Mode: options.Mode(), Files: filecov}); err != nil {
+			return err
+		}
+		if err := notes.Append(ctx, ref, notes.Record{Percent: coverage.Percent(filecov)}); err != nil {
+			return err
+		}
 	}
 
+	if err := checkMin(cov, mins); err != nil {
+		return err
+	}
+	return checkTargets(ctx, c.App.ErrWriter, cov, filecov)
+}
+
+// checkTargets checks cov against the targets of the config file, and the
+// files of filecov against its root targets, printing each path below.
+func checkTargets(ctx diag.Context, w io.Writer, cov coverage.PathDetailer, filecov coverage.FileData) error {
+	vs := coverage.CheckTargets(cov, fileCfg.Targets)
+	if len(fileCfg.RootTargets) > 0 {
+		vs = append(vs, coverage.CheckRootTargets(coverage.ByRoot(ctx, filecov), fileCfg.RootTargets)...)
+	}
+	if len(vs) > 0 {
+		for _, v := range vs {
+			fmt.Fprintf(w, "%s: %.2f%% is below target %.2f%%\n", v.Path, v.Actual, v.Target)
+		}
+		return errTargets(vs)
+	}
+	return nil
+}
+
+// runTrend shows the last points of stored coverage history
+func runTrend(c *cli.Context) error {
+	ctx := cfg.Context(c)
+	recs, err := notes.History(ctx, notes.RemoteRef{Ref: cfg.CoverageRef}, cfg.TrendCount)
+	if err != nil {
+		return err
+	}
+	for i, rec := range recs {
+		commit := rec.Commit
+		if len(commit) > 12 {
+			commit = commit[:12]
+		}
+		if i == 0 {
+			fmt.Printf("%s  %s  %6.2f%%\n", rec.Time.Format(time.RFC3339), commit, rec.Percent)
+		} else {
+			fmt.Printf("%s  %s  %6.2f%%  %+7.2f%%\n", rec.Time.Format(time.RFC3339), commit, rec.Percent, rec.Percent-recs[i-1].Percent)
+		}
+	}
+	return nil
+}
+
+// runPrune removes coverage notes of commits older than cfg.KeepDays
+func runPrune(c *cli.Context) error {
+	ctx := cfg.Context(c)
+	cutoff := time.Now().AddDate(0, 0, -cfg.KeepDays)
+	commits, err := notes.Prune(ctx, notes.RemoteRef{Ref: cfg.CoverageRef}, cutoff, cfg.DryRun)
+	if err != nil {
+		return err
+	}
+	verb := "removed"
+	if cfg.DryRun {
+		verb = "would remove"
+	}
+	for _, commit := range commits {
+		fmt.Fprintln(c.App.Writer, verb, commit)
+	}
+	fmt.Fprintf(c.App.Writer, "%s %d notes older than %s\n", verb, len(commits), cutoff.Format("2006-01-02"))
 	return nil
 }
 
 // runCover will capture and save a coverprofile
 func runCover(c *cli.Context) error {
-	ctx := cfg.Context(c)
-	_, err := coverage.CollectFiles(ctx, &coverage.TestOptions{
-		CoverProfile: cfg.CoverProfile,
-		Excludes:     cfg.Excludes.Value(),
-		Packages:     cfg.Packages.Value(),
-		Stdout:       c.App.Writer,
-		Stderr:       c.App.ErrWriter,
-	})
+	ctx, cancel := testContext(cfg.Context(c))
+	defer cancel()
+	options := testOptions()
+	options.CoverProfile = cfg.CoverProfile
+	options.CoverMode = cfg.CoverMode
+	options.Stdout = c.App.Writer
+	options.Stderr = c.App.ErrWriter
+	_, err := coverage.CollectFiles(ctx, options)
 	return err
 }
 
+// runValidate will report each malformed line of existing profiles
+func runValidate(c *cli.Context) error {
+	ctx := cfg.Context(c)
+
+	invalid := 0
+	for _, name := range cfg.CoverProfiles.Value() {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		errs, err := coverage.ValidateProfile(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		for _, e := range errs {
+			diag.ErrorAt(ctx, name, e.Line, 0, e.Reason+":", strconv.Quote(e.Text))
+		}
+		invalid += len(errs)
+	}
+	if invalid > 0 {
+		return errInvalidProfile(invalid)
+	}
+	return nil
+}
+
+// runCheck will check existing profiles against minimums, printing nothing
+func runCheck(c *cli.Context) error {
+	ctx := cfg.Context(c)
+
+	mins, err := coverage.ParseMinimums(cfg.Min.Value())
+	if err != nil {
+		return err
+	}
+	if len(mins) == 0 && len(fileCfg.Targets) == 0 && len(fileCfg.RootTargets) == 0 {
+		return errNoMinimums(c.Command.Name)
+	}
+
+	stmts, err := coverage.MergeProfiles(ctx, cfg.CoverProfiles.Value(), profileOptions())
+	if err != nil {
+		return err
+	}
+
+	cov, err := group(ctx, cfg.GroupBy, stmts)
+	if err != nil {
+		return err
+	}
+
+	if err := checkMin(cov, mins); err != nil {
+		return err
+	}
+	return checkTargets(ctx, c.App.ErrWriter, cov, coverage.ByFiles(ctx, stmts))
+}
+
+// writeUncovered lists the uncovered line ranges of stmts as file:line or
+// file:start-end, trimming the module prefix if requested.
+func writeUncovered(ctx diag.Context, w io.Writer, stmts coverage.StatementData) {
+	prefix := ""
+	if cfg.Relative {
+		if mod := coverage.Module(ctx); mod != "" {
+			prefix = string(mod) + "/"
+		}
+	}
+	for _, sp := range stmts.UncoveredLines() {
+		file := strings.TrimPrefix(sp.File, prefix)
+		if sp.StartLine == sp.EndLine {
+			fmt.Fprintf(w, "%s:%d\n", file, sp.StartLine)
+		} else {
+			fmt.Fprintf(w, "%s:%d-%d\n", file, sp.StartLine, sp.EndLine)
+		}
+	}
+}
+
 // runShow will show coverage for a coverprofile profile
 func runShow(c *cli.Context) error {
 	ctx := cfg.Context(c)
 
-	stmts, err := coverage.LoadProfile(ctx, cfg.CoverProfile, &coverage.TestOptions{
-		Excludes: cfg.Excludes.Value(),
-		Packages: cfg.Packages.Value(),
-	})
+	stmts, err := coverage.MergeProfiles(ctx, cfg.CoverProfiles.Value(), profileOptions())
 	if err != nil {
 		return err
 	}
 
-	var cov coverage.PathDetailer
-	switch cfg.GroupBy {
-	case "file":
-		cov = coverage.ByFiles(ctx, stmts)
-	case "package":
-		cov = coverage.ByPackage(ctx, stmts)
-	case "root":
-		cov = coverage.ByRoot(ctx, stmts)
-	case "module":
-		cov = coverage.ByModule(ctx, stmts)
+	if cfg.Uncovered {
+		writeUncovered(ctx, c.App.Writer, stmts)
+		return nil
 	}
 
-	switch cfg.Format {
-	case "markdown":
-		fmt.Print(coverage.ReportMD(cov))
-	default:
-		fmt.Print(coverage.Report(cov))
+	cov, err := group(ctx, cfg.GroupBy, stmts)
+	if err != nil {
+		return err
+	}
+
+	if err := writeReport(ctx, reportOptions(ctx), cov, stmts, nil); err != nil {
+		return err
 	}
 
 	if cfg.StoreCoverage {
-		ref := notes.RemoteRef{Ref: cfg.CoverageRef}
+		ref := notes.RemoteRef{Ref: cfg.CoverageRef, Compress: cfg.CompressNotes}
 		return notes.Store(ctx, ref, stmts)
 	}
 
 	return nil
 }
 
+// runWorst will show the least covered paths of a coverprofile
+func runWorst(c *cli.Context) error {
+	if cfg.Format == "lcov" || cfg.Format == "sarif" {
+		return errUnsupportedFormat(cfg.Format)
+	}
+	ctx := cfg.Context(c)
+
+	stmts, err := coverage.MergeProfiles(ctx, cfg.CoverProfiles.Value(), profileOptions())
+	if err != nil {
+		return err
+	}
+
+	cov, err := group(ctx, cfg.GroupBy, stmts)
+	if err != nil {
+		return err
+	}
+
+	// the total of the listed paths would mislead, so only they are shown
+	opts := reportOptions(ctx)
+	opts.Sort = coverage.SortByCoverage
+	opts.NoTotal = true
+	return writeReport(ctx, opts, coverage.Below(cov, cfg.Below, cfg.Limit), nil, nil)
+}
+
+// runHTML will write an html report for a coverprofile
+func runHTML(c *cli.Context) error {
+	ctx := cfg.Context(c)
+
+	stmts, err := coverage.LoadProfile(ctx, cfg.CoverProfile, profileOptions())
+	if err != nil {
+		return err
+	}
+
+	write := func(w io.Writer) error {
+		return coverage.WriteHTML(ctx, w, stmts)
+	}
+	if cfg.Open {
+		return writeOpened(ctx, "coverpkg*.html", write)
+	}
+	return writeOutput(write)
+}
+
+// runBlame will write the uncovered statements of a coverprofile by author
+func runBlame(c *cli.Context) error {
+	ctx := cfg.Context(c)
+
+	stmts, err := coverage.LoadProfile(ctx, cfg.CoverProfile, profileOptions())
+	if err != nil {
+		return err
+	}
+
+	authors, err := coverage.UncoveredByAuthor(ctx, stmts, func(file string) (map[int]string, error) {
+		return blameAuthors(ctx, file)
+	})
+	if err != nil {
+		return err
+	}
+	return writeOutput(func(w io.Writer) error {
+		return writeAuthors(w, authors)
+	})
+}
+
+// runBadge will write an svg badge for a coverprofile
+func runBadge(c *cli.Context) error {
+	ctx := cfg.Context(c)
+
+	stmts, err := coverage.LoadProfile(ctx, cfg.CoverProfile, profileOptions())
+	if err != nil {
+		return err
+	}
+
+	pct := coverage.Percent(coverage.ByFiles(ctx, stmts))
+	return writeOutput(func(w io.Writer) error {
+		return coverage.WriteBadge(w, pct, cfg.BadgeLabel, cfg.BadgeBands)
+	})
+}
+
+// runBaseline will save file coverage of a profile as JSON
+func runBaseline(c *cli.Context) error {
+	ctx := cfg.Context(c)
+
+	stmts, err := coverage.LoadProfile(ctx, cfg.CoverProfile, profileOptions())
+	if err != nil {
+		return err
+	}
+
+	filecov := coverage.ByFiles(ctx, stmts)
+	return writeOutput(func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(filecov)
+	})
+}
+
+// loadBase loads file coverage from a baseline written by runBaseline, or
+// from a coverprofile, telling them apart by content.
+func loadBase(ctx diag.Context, name string, options *coverage.TestOptions) (coverage.FileData, error) {
+	buf, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(bytes.TrimSpace(buf), []byte("{")) {
+		var filecov coverage.FileData
+		err := json.Unmarshal(buf, &filecov)
+		return filecov, err
+	}
+	stmts, err := coverage.ReadProfile(ctx, bytes.NewReader(buf), options)
+	if err != nil {
+		return nil, err
+	}
+	return coverage.ByFiles(ctx, stmts), nil
+}
+
+// writeOutput calls write with the output file, or stdout if unspecified.
+func writeOutput(write func(io.Writer) error) (err error) {
+	if cfg.Output == "" {
+		return write(os.Stdout)
+	}
+	f, err := os.Create(cfg.Output)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}()
+	return write(f)
+}
+
 func runDiff(c *cli.Context) error {
+	if cfg.Template == "" && (cfg.Format == "lcov" || cfg.Format == "sarif") {
+		return errUnsupportedFormat(cfg.Format)
+	}
+	if cfg.GroupBy == "function" {
+		// base and head coverage are compared by file, without functions
+		return coverage.GroupingError{Old: coverage.FunctionGrouping, New: coverage.FunctionGrouping}
+	}
+	switch cfg.Format {
+	case "md", "markdown", "txt", "ascii":
+	default:
+		if cfg.DetectRenames && cfg.Template == "" {
+			// renames are listed after the table of text and markdown reports
+			return errUnsupportedFormat(cfg.Format)
+		}
+	}
+
 	ctx := cfg.Context(c)
 	ref := notes.RemoteRef{Ref: cfg.CoverageRef}
-	options := &coverage.TestOptions{
-		Excludes: cfg.Excludes.Value(),
-		Packages: cfg.Packages.Value(),
-	}
+	options := testOptions()
 
+	// untested coverage is added to the head only when the base is collected
+	// or read here too; stored notes may have been stored without it
 	var basefilecov coverage.FileData
-	if cfg.BaseRef != "" {
-		err := notes.Load(ctx, ref, cfg.BaseRef, &basefilecov)
+	var basemode string
+	untested := cfg.ShowUntested
+	if cfg.Since != "" {
+		var err error
+		basefilecov, err = collectAt(ctx, cfg.Since, *options)
+		if err != nil {
+			return fmt.Errorf("testing %s: %w", cfg.Since, err)
+		}
+		basemode = options.Mode()
+	} else if cfg.BaseRef != "" {
+		var note coverage.Note
+		err := notes.Load(ctx, ref, cfg.BaseRef, &note)
 		if err != nil {
 			return fmt.Errorf("loading base ref: %w", err)
 		}
-	} else if cfg.BaseProfile != "" {
-		stmts, err := coverage.LoadProfile(ctx, cfg.BaseProfile, options)
+		basefilecov, basemode = note.Files, note.Mode
+		untested = false
+	} else if cfg.BaseBranch != "" {
+		var err error
+		basefilecov, basemode, err = loadMergeBase(ctx, ref)
+		if err != nil {
+			return err
+		}
+		untested = false
+	}
+	if basefilecov == nil && cfg.BaseRef == "" && cfg.Since == "" && cfg.BaseProfile != "" {
+		var err error
+		basefilecov, err = loadBase(ctx, cfg.BaseProfile, options)
 		if err != nil {
 			return fmt.Errorf("loading base coverprofile: %w", err)
 		}
-		basefilecov = coverage.ByFiles(ctx, stmts)
+		untested = cfg.ShowUntested
+		if untested {
+			if err := coverage.AddUntested(ctx, basefilecov, options); err != nil {
+				return err
+			}
+		}
+	}
+
+	var headfilecov coverage.FileData
+	headmode := options.Mode()
+	if cfg.HeadRef != "" {
+		var note coverage.Note
+		err := notes.Load(ctx, ref, cfg.HeadRef, &note)
+		if err != nil {
+			return fmt.Errorf("loading head ref: %w", err)
+		}
+		headfilecov, headmode = note.Files, note.Mode
+	} else {
+		tctx, cancel := testContext(ctx)
+		defer cancel()
+		var err error
+		headfilecov, err = coverage.CollectFiles(tctx, options)
+		if err != nil {
+			return err
+		}
+		if untested {
+			if err := coverage.AddUntested(ctx, headfilecov, options); err != nil {
+				return err
+			}
+		}
 	}
+	coverage.CheckModes(ctx, basemode, headmode)
 
-	headfilecov, err := coverage.CollectFiles(ctx, options)
+	basecov, err := group(ctx, cfg.GroupBy, basefilecov)
+	if err != nil {
+		return err
+	}
+	headcov, err := group(ctx, cfg.GroupBy, headfilecov)
+	if err != nil {
+		return err
+	}
+	delta, err := coverage.Diff(ctx, basecov, headcov)
 	if err != nil {
 		return err
 	}
 
-	basepkgcov := coverage.ByPackage(ctx, basefilecov)
-	headpkgcov := coverage.ByPackage(ctx, headfilecov)
-	pkgdelta := coverage.Diff(ctx, headpkgcov, basepkgcov)
+	var filedelta coverage.ChangeDetailer
+	if cfg.Detailed {
+		filedelta, err = coverage.Diff(ctx, basefilecov, headfilecov)
+		if err != nil {
+			return err
+		}
+	}
+	if err := writeReport(ctx, reportOptions(ctx), delta, nil, filedelta); err != nil {
+		return err
+	}
+
+	if cfg.FailOnDecrease || cfg.StrictExit {
+		base, head := coverage.Percent(basecov), coverage.Percent(headcov)
+		if base-head > cfg.DecreaseTolerance {
+			err := errDecrease{Grouping: delta.Grouping(), Base: base, Head: head, Tolerance: cfg.DecreaseTolerance, Paths: decreased(delta)}
+			if cfg.StrictExit {
+				return errExit{Err: err, Code: exitRegressed}
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+type (
+	// groupable is coverage that group can regroup.
+	groupable interface {
+		coverage.EachFiler
+		coverage.EachPackager
+	}
+
+	// grouped is coverage grouped by group.
+	grouped interface {
+		coverage.EachPather
+		coverage.PathDetailer
+	}
+)
+
+// group groups cov by groupBy, one of the values of the group-by flag. Only
+// StatementData locates the statements of functions, so grouping anything
+// else by function returns a GroupingError.
+func group(ctx diag.Context, groupBy string, cov groupable) (grouped, error) {
+	switch groupBy {
+	case "function":
+		if stmts, ok := cov.(coverage.StatementData); ok {
+			return coverage.ByFunction(ctx, stmts)
+		}
+		return nil, coverage.GroupingError{Old: coverage.FunctionGrouping, New: coverage.FunctionGrouping}
+	case "file":
+		if files, ok := cov.(coverage.FileData); ok {
+			return files, nil
+		}
+		if stmts, ok := cov.(coverage.EachStatementer); ok {
+			return coverage.ByFiles(ctx, stmts), nil
+		}
+	case "package":
+		return coverage.ByPackage(ctx, cov), nil
+	case "root":
+		return coverage.ByRoot(ctx, cov), nil
+	case "module":
+		return coverage.ByResolvedModule(ctx, cov), nil
+	}
+	return nil, errInvalidGroupBy(groupBy)
+}
+
+// loadMergeBase loads the coverage stored for the merge-base of the base branch
+// and the head. If there is none, it warns and returns nil coverage.
+func loadMergeBase(ctx diag.Context, ref notes.RemoteRef) (coverage.FileData, string, error) {
+	head := cfg.HeadRef
+	if head == "" {
+		head = "HEAD"
+	}
+	base, err := git.MergeBase(ctx, cfg.BaseBranch, head)
+	if err != nil {
+		return nil, "", fmt.Errorf("finding merge-base of %s: %w", cfg.BaseBranch, err)
+	}
+	base = strings.TrimSpace(base)
+
+	var note coverage.Note
+	if err := notes.Load(ctx, ref, base, &note); err != nil {
+		diag.Warning(ctx, "no coverage stored at merge-base", base, "of", cfg.BaseBranch+":", err)
+		return nil, "", nil
+	}
+	diag.Debug(ctx, "loaded base coverage from merge-base", base)
+	return note.Files, note.Mode, nil
+}
+
+// writeTemplate prints c in the given order, formatted by cfg.Template.
+func writeTemplate(c coverage.PathDetailer, by coverage.SortOrder) error {
+	buf, err := os.ReadFile(cfg.Template)
+	if err != nil {
+		return err
+	}
+	t, err := template.New(filepath.Base(cfg.Template)).Parse(string(buf))
+	if err != nil {
+		return fmt.Errorf("parsing template: %w", err)
+	}
+	c, err = coverage.Sort(c, by)
+	if err != nil {
+		return err
+	}
+	if err := coverage.WriteTemplate(os.Stdout, c, t); err != nil {
+		return fmt.Errorf("executing template: %w", err)
+	}
+	return nil
+}
+
+// reportOptions returns the report options selected by the flags.
+func reportOptions(ctx diag.Context) coverage.ReportOptions {
+	opts := coverage.ReportOptions{TotalOnly: cfg.TotalOnly, NoTotal: cfg.NoTotal, ChangedOnly: cfg.ChangedOnly, Renames: cfg.DetectRenames}
+	switch cfg.Sort {
+	case "coverage":
+		opts.Sort = coverage.SortByCoverage
+	case "delta":
+		opts.Sort = coverage.SortByDelta
+	case "statements":
+		opts.Sort = coverage.SortByStatements
+	}
+	if cfg.Relative {
+		opts.Module = string(coverage.Module(ctx))
+	}
+	return opts
+}
+
+// writeReport prints c with opts in the selected format.
+// Statements are only required for lcov and sarif. Detailed markdown lists
+// files, or those of statements if files is nil.
+func writeReport(ctx diag.Context, opts coverage.ReportOptions, c coverage.PathDetailer, stmts coverage.StatementData, files coverage.PathDetailer) error {
+	if cfg.Detailed {
+		if files == nil && stmts != nil {
+			files = coverage.ByFiles(ctx, stmts)
+		}
+		opts.Files = files
+	}
+	if cfg.Template != "" {
+		return writeTemplate(c, opts.Sort)
+	}
 
 	switch cfg.Format {
-	case "markdown":
-		fmt.Print(coverage.ReportMD(pkgdelta))
-	default:
-		fmt.Print(coverage.Report(pkgdelta))
+	case "md", "markdown":
+		return coverage.WriteReportMD(os.Stdout, c, opts)
+	case "txt", "ascii":
+		opts.Color = useColor()
+		return coverage.WriteReport(os.Stdout, c, opts)
+	case "cobertura":
+		if stmts != nil && cfg.GroupBy != "function" {
+			lines, err := group(ctx, cfg.GroupBy, coverage.ByLines(stmts))
+			if err != nil {
+				return err
+			}
+			c = lines
+		}
 	}
 
+	c, err := coverage.Sort(c, opts.Sort)
+	if err != nil {
+		return err
+	}
+	switch cfg.Format {
+	case "lcov":
+		return coverage.WriteLCOV(os.Stdout, stmts)
+	case "sarif":
+		return coverage.WriteSARIF(os.Stdout, stmts.Relative(string(coverage.Module(ctx))), cfg.SARIFMin)
+	case "cobertura":
+		return coverage.WriteCobertura(os.Stdout, c)
+	case "json":
+		return coverage.WriteJSON(os.Stdout, c)
+	case "csv":
+		return coverage.WriteCSV(os.Stdout, c)
+	case "tsv":
+		return coverage.WriteTSV(os.Stdout, c)
+	case "summary":
+		fmt.Println(coverage.Summary(c))
+	}
 	return nil
 }
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/mutility/diag/testdiag"
+	"github.com/urfave/cli/v2"
+
+	"github.com/mutility/coverpkg/internal/coverage"
+	"github.com/mutility/coverpkg/internal/testgit"
+)
+
+func TestDiffGroupBy(t *testing.T) {
+	dir := t.TempDir()
+	base, _ := json.Marshal(map[string]any{
+		"github.com/mutility/coverpkg/x/a/a.go": map[string]int{"Count": 4, "Covered": 2},
+		"github.com/mutility/coverpkg/x/b/b.go": map[string]int{"Count": 4, "Covered": 2},
+		"github.com/mutility/coverpkg/y/c.go":   map[string]int{"Count": 2, "Covered": 2},
+	})
+	head := "mode: set\n" +
+		"github.com/mutility/coverpkg/x/a/a.go:1.1,2.2 4 1\n" +
+		"github.com/mutility/coverpkg/x/b/b.go:1.1,2.2 4 0\n" +
+		"github.com/mutility/coverpkg/y/c.go:1.1,2.2 2 0\n"
+	files := map[string]string{
+		"base.json": string(base),
+		"head.out":  head,
+		"test.sh":   "#!/bin/sh\ncp " + filepath.Join(dir, "head.out") + " \"$2\"\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	defer func(old config) { cfg = old }(cfg)
+	cfg.GroupBy = "root"
+	cfg.Format = "summary"
+	cfg.BaseProfile = filepath.Join(dir, "base.json")
+	cfg.TestRunner = filepath.Join(dir, "test.sh")
+	cfg.FailOnDecrease = true
+
+	// x/a rises and x/b falls, so only the root y decreases
+	c := cli.NewContext(&cli.App{Writer: io.Discard}, nil, nil)
+	err := runDiff(c)
+	want := "root coverage decreased 20.00% from 60.00% to 40.00%; tolerance 0.00%; decreased in github.com/mutility/coverpkg/y"
+	if err == nil || err.Error() != want {
+		t.Errorf("diff: got %v, want %s", err, want)
+	}
+	if code := exitCode(err, false); code != 1 {
+		t.Errorf("exit code: got %d, want 1", code)
+	}
+
+	cfg.FailOnDecrease = false
+	cfg.StrictExit = true
+	err = runDiff(c)
+	if code := exitCode(err, true); err == nil || err.Error() != want || code != exitRegressed {
+		t.Errorf("strict diff: got %v, exit code %d, want %s, %d", err, code, want, exitRegressed)
+	}
+	if code := exitCode(errInvalidFormat("x"), true); code != exitError {
+		t.Errorf("strict exit code of other errors: got %d, want %d", code, exitError)
+	}
+}
+
+func TestDiffShowUntested(t *testing.T) {
+	dir := t.TempDir()
+	profile := "mode: set\nexample.com/mod/a.go:1.1,2.2 2 1\n"
+	files := map[string]string{
+		"base.out": profile,
+		"head.out": profile,
+		"test.sh":  "#!/bin/sh\ncp " + filepath.Join(dir, "head.out") + " \"$2\"\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	defer func(old config) { cfg = old }(cfg)
+	cfg.GroupBy = "root"
+	cfg.Format = "summary"
+	cfg.BaseProfile = filepath.Join(dir, "base.out")
+	cfg.TestRunner = filepath.Join(dir, "test.sh")
+	cfg.FailOnDecrease = true
+	cfg.ShowUntested = true
+	if err := cfg.CoverPkgs.Set("../../internal/coverage/testdata/funcs"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the untested package is added to both sides, so nothing decreases
+	c := cli.NewContext(&cli.App{Writer: io.Discard}, nil, nil)
+	if err := runDiff(c); err != nil {
+		t.Errorf("diff: got %v, want no decrease", err)
+	}
+}
+
+func TestStrictExitFlagError(t *testing.T) {
+	t.Setenv("COVERPKG_STRICT_EXIT", "")
+	defer func(old config) { cfg = old }(cfg)
+
+	tests := []struct {
+		args []string
+		want int
+	}{
+		{[]string{"diff", "--no-such-flag", "--strict-exit"}, exitError},
+		{[]string{"diff", "--no-such-flag", "--strict-exit=true"}, exitError},
+		{[]string{"diff", "--no-such-flag", "--strict-exit=false"}, 1},
+		{[]string{"diff", "--no-such-flag"}, 1},
+	}
+	for _, tt := range tests {
+		app := newApp()
+		app.Writer, app.ErrWriter = io.Discard, io.Discard
+		err := app.Run(append([]string{"coverpkg"}, tt.args...))
+		if err == nil {
+			t.Fatalf("%v: got nil error", tt.args)
+		}
+		if code := exitCode(err, strictExit(tt.args)); code != tt.want {
+			t.Errorf("%v: got exit code %d, want %d", tt.args, code, tt.want)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	dir := t.TempDir()
+	prof := filepath.Join(dir, "cover.out")
+	if err := os.WriteFile(prof, []byte("mode: set\nexample.com/mod/a/a.go:1.1,2.2 1 1\nexample.com/mod/a/a.go:3.1,4.2 3 0\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(old config, oldFile fileConfig) { cfg, fileCfg = old, oldFile }(cfg, fileCfg)
+	cfg.GroupBy = "package"
+	cfg.CoverProfiles = *cli.NewStringSlice(prof)
+	fileCfg = fileConfig{}
+
+	c := cli.NewContext(&cli.App{Writer: io.Discard, ErrWriter: io.Discard}, nil, nil)
+	c.Command = &cli.Command{Name: "check"}
+	if err := runCheck(c); !errors.Is(err, errNoMinimums("check")) {
+		t.Errorf("no minimums: got %v, want %v", err, errNoMinimums("check"))
+	}
+
+	fileCfg.Targets = map[string]float64{"example.com/mod/a": 50}
+	var targets errTargets
+	if err := runCheck(c); !errors.As(err, &targets) || len(targets) != 1 {
+		t.Errorf("targets: got %v, want 1 path below its target", err)
+	}
+
+	fileCfg.Targets["example.com/mod/a"] = 25
+	if err := runCheck(c); err != nil {
+		t.Errorf("met targets: got %v", err)
+	}
+}
+
+func TestGroup(t *testing.T) {
+	ctx := testdiag.Context(t)
+	files := coverage.FileData{
+		"example.com/mod/a/a.go":   {Count: 4, Covered: 2},
+		"example.com/mod/a/b/b.go": {Count: 4, Covered: 4},
+	}
+
+	got, err := group(ctx, "file", files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(files, got); diff != "" {
+		t.Errorf("file (-want +got):\n%s", diff)
+	}
+	got, err = group(ctx, "package", files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"example.com/mod/a", "example.com/mod/a/b"}, got.Paths()); diff != "" {
+		t.Errorf("package (-want +got):\n%s", diff)
+	}
+
+	var grpErr coverage.GroupingError
+	if _, err := group(ctx, "function", files); !errors.As(err, &grpErr) {
+		t.Errorf("function of files: got %v, want a GroupingError", err)
+	}
+	if _, err := group(ctx, "dir", files); err != errInvalidGroupBy("dir") {
+		t.Errorf("dir: got %v, want %v", err, errInvalidGroupBy("dir"))
+	}
+}
+
+func TestCheckoutAt(t *testing.T) {
+	repo := testgit.New(t)
+	repo.Commit("2\n")
+	first := repo.Git("rev-parse", "HEAD~1")
+
+	ctx := testdiag.Context(t)
+	restore, err := checkoutAt(ctx, "HEAD~1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := repo.Git("rev-parse", "HEAD"); got != first {
+		t.Errorf("checked out %s, want %s", got, first)
+	}
+	restore()
+	if got := repo.Git("symbolic-ref", "--short", "HEAD"); got != "main" {
+		t.Errorf("restored %s, want main", got)
+	}
+
+	repo.Write("dirty\n")
+	var dirty errDirty
+	if _, err := checkoutAt(ctx, first); !errors.As(err, &dirty) {
+		t.Errorf("dirty: got %v, want errDirty", err)
+	}
+}
+
+func TestDiffSince(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"1.out":   "mode: set\nexample.com/mod/a.go:1.1,2.2 2 1\n",
+		"2.out":   "mode: set\nexample.com/mod/a.go:1.1,2.2 1 1\nexample.com/mod/a.go:3.1,4.2 1 0\n",
+		"test.sh": "#!/bin/sh\ncp " + dir + "/$(cat a.txt).out \"$2\"\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	repo := testgit.New(t)
+	repo.Commit("2\n")
+
+	defer func(old config) { cfg = old }(cfg)
+	cfg.GroupBy = "root"
+	cfg.Format = "summary"
+	cfg.Since = "HEAD~1"
+	cfg.TestRunner = filepath.Join(dir, "test.sh")
+	cfg.FailOnDecrease = true
+
+	c := cli.NewContext(&cli.App{Writer: io.Discard}, nil, nil)
+	err := runDiff(c)
+	want := "root coverage decreased 50.00% from 100.00% to 50.00%; tolerance 0.00%; decreased in example.com/mod"
+	if err == nil || err.Error() != want {
+		t.Errorf("diff: got %v, want %s", err, want)
+	}
+	if got := repo.Git("symbolic-ref", "--short", "HEAD"); got != "main" {
+		t.Errorf("restored %s, want main", got)
+	}
+}
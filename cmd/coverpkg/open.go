@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+
+	"github.com/mutility/diag"
+)
+
+// openCommand returns the command that opens name in the default browser
+// on goos.
+func openCommand(goos, name string) []string {
+	switch goos {
+	case "darwin":
+		return []string{"open", name}
+	case "windows":
+		return []string{"cmd", "/c", "start", "", name}
+	default:
+		return []string{"xdg-open", name}
+	}
+}
+
+// openBrowser opens name in the default browser.
+func openBrowser(ctx diag.Context, name string) error {
+	args := openCommand(runtime.GOOS, name)
+	diag.Debug(ctx, "exec>", args)
+	return exec.CommandContext(ctx, args[0], args[1:]...).Run()
+}
+
+// writeOpened writes the output file with write, and opens it in the
+// default browser. Without an output file it writes a temporary file, which
+// is left for the browser to read, and removed only if it cannot be opened.
+func writeOpened(ctx diag.Context, pattern string, write func(io.Writer) error) error {
+	name := cfg.Output
+	var f *os.File
+	var err error
+	if name == "" {
+		f, err = os.CreateTemp("", pattern)
+	} else {
+		f, err = os.Create(name)
+	}
+	if err != nil {
+		return err
+	}
+	err = write(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = openBrowser(ctx, f.Name())
+	}
+	if err != nil && name == "" {
+		os.Remove(f.Name())
+		return err
+	}
+	if name == "" {
+		diag.Print(ctx, "wrote", f.Name())
+	}
+	return err
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestOpenCommand(t *testing.T) {
+	for _, tt := range []struct {
+		goos string
+		want []string
+	}{
+		{"linux", []string{"xdg-open", "cover.html"}},
+		{"freebsd", []string{"xdg-open", "cover.html"}},
+		{"darwin", []string{"open", "cover.html"}},
+		{"windows", []string{"cmd", "/c", "start", "", "cover.html"}},
+	} {
+		t.Run(tt.goos, func(t *testing.T) {
+			if diff := cmp.Diff(tt.want, openCommand(tt.goos, "cover.html")); diff != "" {
+				t.Errorf("command (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
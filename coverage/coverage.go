@@ -0,0 +1,277 @@
+// Package coverage is the public API of coverpkg. It runs go test to collect
+// cross-package coverage, groups it by file, package, root, or module,
+// compares it between revisions, and reports it as text or markdown.
+//
+// The signatures in this package are stable; it forwards to the
+// implementation in coverpkg's internal packages.
+package coverage
+
+import (
+	"io"
+	"text/template"
+
+	"github.com/mutility/diag"
+
+	"github.com/mutility/coverpkg/internal/coverage"
+)
+
+type (
+	// TestOptions controls how go test is run and which results are kept.
+	TestOptions = coverage.TestOptions
+
+	// StatementData records every statement and its hit count.
+	StatementData = coverage.StatementData
+	// FileData records statement counts per file.
+	FileData = coverage.FileData
+	// LineData records coverage per line, keyed by file:line.
+	LineData = coverage.LineData
+	// FunctionData records statement counts per function.
+	FunctionData = coverage.FunctionData
+	// PackageData records statement counts per package.
+	PackageData = coverage.PackageData
+	// RootData records statement counts per root package.
+	RootData = coverage.RootData
+	// ModuleData records statement counts per module.
+	ModuleData = coverage.ModuleData
+
+	// Counts are the statement counts of a path.
+	Counts = coverage.Counts
+	// Grouping describes the granularity of paths.
+	Grouping = coverage.Grouping
+	// GroupingError reports coverage Diff can't compare.
+	GroupingError = coverage.GroupingError
+	// TestRunError reports a failed go test run, and whether it failed to build.
+	TestRunError = coverage.TestRunError
+	// Rename pairs a removed path with a new path that likely replaced it.
+	Rename = coverage.Rename
+
+	// ReportOptions controls the reports written by WriteReport and
+	// WriteReportMD; the zero value matches Report and ReportMD.
+	ReportOptions = coverage.ReportOptions
+	// SortOrder selects the order of report rows.
+	SortOrder = coverage.SortOrder
+
+	// TemplateView is the data WriteTemplate executes a template against.
+	TemplateView = coverage.TemplateView
+	// TemplateRow holds the counts of a path in a TemplateView.
+	TemplateRow = coverage.TemplateRow
+
+	// PathDetailer provides the paths and counts of a report.
+	PathDetailer = coverage.PathDetailer
+	// ChangeDetailer adds base counts to a PathDetailer.
+	ChangeDetailer = coverage.ChangeDetailer
+
+	// EachPather enumerates paths at their own grouping.
+	EachPather = coverage.EachPather
+	// EachStatementer enumerates statements.
+	EachStatementer = coverage.EachStatementer
+	// EachFiler enumerates files.
+	EachFiler = coverage.EachFiler
+	// EachPackager enumerates packages.
+	EachPackager = coverage.EachPackager
+)
+
+// ErrNoPackages is returned when no statements are left after filtering,
+// unless TestOptions.AllowEmpty is set.
+var ErrNoPackages = coverage.ErrNoPackages
+
+const (
+	UnknownGrouping   = coverage.UnknownGrouping
+	StatementGrouping = coverage.StatementGrouping
+	FunctionGrouping  = coverage.FunctionGrouping
+	FileGrouping      = coverage.FileGrouping
+	PackageGrouping   = coverage.PackageGrouping
+	RootGrouping      = coverage.RootGrouping
+	ModuleGrouping    = coverage.ModuleGrouping
+)
+
+const (
+	SortByName       = coverage.SortByName
+	SortByCoverage   = coverage.SortByCoverage
+	SortByDelta      = coverage.SortByDelta
+	SortByStatements = coverage.SortByStatements
+)
+
+// DefaultTestOptions are used when options are nil.
+var DefaultTestOptions = coverage.DefaultTestOptions
+
+// CollectStatements runs go test as described by options and returns the
+// coverage of each statement.
+func CollectStatements(ctx diag.Context, options *TestOptions) (StatementData, error) {
+	return coverage.CollectStatements(ctx, options)
+}
+
+// CollectFiles runs go test as described by options and returns the coverage
+// of each file.
+func CollectFiles(ctx diag.Context, options *TestOptions) (FileData, error) {
+	return coverage.CollectFiles(ctx, options)
+}
+
+// AddUntested adds uncovered entries to files for the Go files of the
+// packages options covers that files lacks, such as those without tests.
+func AddUntested(ctx diag.Context, files FileData, options *TestOptions) error {
+	return coverage.AddUntested(ctx, files, options)
+}
+
+// FilesFromReader reads a coverprofile from r and returns the coverage of each
+// file selected by options, without running tests or opening files.
+func FilesFromReader(ctx diag.Context, r io.Reader, options *TestOptions) (FileData, error) {
+	return coverage.FilesFromReader(ctx, r, options)
+}
+
+// LoadProfile loads statement coverage from a coverprofile file, keeping the
+// files selected by options.
+func LoadProfile(ctx diag.Context, prof string, options *TestOptions) (StatementData, error) {
+	return coverage.LoadProfile(ctx, prof, options)
+}
+
+// ByFiles groups statements by file.
+func ByFiles(log diag.Interface, stmts EachStatementer) FileData {
+	return coverage.ByFiles(log, stmts)
+}
+
+// Merge returns new FileData with the counts of each file of a and b summed.
+// The By* functions may run concurrently on separate inputs, and Merge
+// combines their results; FileData itself isn't safe for concurrent mutation.
+func Merge(a, b FileData) FileData {
+	return coverage.Merge(a, b)
+}
+
+// ByLines groups statements by the line each block starts on, a line being
+// covered if any block starting on it is. Group it further with ByFiles or
+// ByPackage to count lines instead of statements.
+func ByLines(stmts StatementData) LineData {
+	return coverage.ByLines(stmts)
+}
+
+// ByFunction groups statements by function, reading source to find them.
+func ByFunction(ctx diag.Context, stmts StatementData) (FunctionData, error) {
+	return coverage.ByFunction(ctx, stmts)
+}
+
+// ByPackage groups files by package.
+func ByPackage(log diag.Interface, files EachFiler) PackageData {
+	return coverage.ByPackage(log, files)
+}
+
+// ByRoot groups packages by their root package.
+func ByRoot(log diag.Interface, pkgs EachPackager) RootData {
+	return coverage.ByRoot(log, pkgs)
+}
+
+// ByModule groups packages into modules of three path segments.
+func ByModule(log diag.Interface, pkgs EachPackager) ModuleData {
+	return coverage.ByModule(log, pkgs)
+}
+
+// ByModuleDepth groups packages into modules of depth path segments.
+func ByModuleDepth(log diag.Interface, pkgs EachPackager, depth int) ModuleData {
+	return coverage.ByModuleDepth(log, pkgs, depth)
+}
+
+// ResolveModules runs go list -m all, until it succeeds, so that ByModule and
+// ByModuleDepth group packages into the module with the longest matching path.
+func ResolveModules(ctx diag.Context) error {
+	return coverage.ResolveModules(ctx)
+}
+
+// Diff compares coverage of old and new at the coarser of their groupings. It
+// panics with a GroupingError if they can't be compared at that grouping;
+// Compare returns it instead.
+func Diff(log diag.Interface, old, new EachPather) ChangeDetailer {
+	d, err := coverage.Diff(log, old, new)
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
+// Compare is like Diff, but returns a GroupingError if old and new can't be
+// compared.
+func Compare(log diag.Interface, old, new EachPather) (ChangeDetailer, error) {
+	return coverage.Diff(log, old, new)
+}
+
+// DiffStatements groups base and head as grouping, one of "file", "package",
+// "root", or "module", and compares them.
+func DiffStatements(log diag.Interface, base, head StatementData, grouping string) (ChangeDetailer, error) {
+	return coverage.DiffStatements(log, base, head, grouping)
+}
+
+// Percent returns the total coverage percentage of c.
+func Percent(c EachPather) float64 {
+	return coverage.Percent(c)
+}
+
+// Report creates a multi-line text report with a line for each path.
+func Report(c PathDetailer) string {
+	return coverage.Report(c)
+}
+
+// ReportTo writes Report to w.
+func ReportTo(w io.Writer, c PathDetailer) {
+	coverage.ReportTo(w, c)
+}
+
+// ReportMD creates a markdown table with a row for each path.
+func ReportMD(c PathDetailer) string {
+	return coverage.ReportMD(c)
+}
+
+// ReportMDTo writes ReportMD to w.
+func ReportMDTo(w io.Writer, c PathDetailer) {
+	coverage.ReportMDTo(w, c)
+}
+
+// Below returns c with only its paths below pct coverage, lowest first, and
+// at most limit of them if limit is positive.
+func Below(c PathDetailer, pct float64, limit int) PathDetailer {
+	return coverage.Below(c, pct, limit)
+}
+
+// Delta classes returned by ClassifyDelta.
+const (
+	DeltaNew       = coverage.DeltaNew
+	DeltaImproved  = coverage.DeltaImproved
+	DeltaRegressed = coverage.DeltaRegressed
+	DeltaRemoved   = coverage.DeltaRemoved
+	DeltaUnchanged = coverage.DeltaUnchanged
+)
+
+// ClassifyDelta buckets the paths of d as new, improved, regressed, removed,
+// or unchanged.
+func ClassifyDelta(d ChangeDetailer) map[string][]string {
+	return coverage.ClassifyDelta(d)
+}
+
+// Classification counts the changed paths of classes, such as
+// "2 improved, 1 regressed".
+func Classification(classes map[string][]string) string {
+	return coverage.Classification(classes)
+}
+
+// DetectRenames pairs removed paths of d with new paths that have as many
+// statements, as likely renames.
+func DetectRenames(d ChangeDetailer) []Rename {
+	return coverage.DetectRenames(d)
+}
+
+// WriteReport writes Report to w, formatted as requested by opts.
+func WriteReport(w io.Writer, c PathDetailer, opts ReportOptions) error {
+	return coverage.WriteReport(w, c, opts)
+}
+
+// WriteReportMD writes ReportMD to w, formatted as requested by opts.
+func WriteReportMD(w io.Writer, c PathDetailer, opts ReportOptions) error {
+	return coverage.WriteReportMD(w, c, opts)
+}
+
+// NewTemplateView returns the TemplateView of c.
+func NewTemplateView(c PathDetailer) TemplateView {
+	return coverage.NewTemplateView(c)
+}
+
+// WriteTemplate executes t against the TemplateView of c, writing to w.
+func WriteTemplate(w io.Writer, c PathDetailer, t *template.Template) error {
+	return coverage.WriteTemplate(w, c, t)
+}
@@ -0,0 +1,62 @@
+package coverage_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/mutility/diag/testdiag"
+
+	"github.com/mutility/coverpkg/coverage"
+)
+
+func TestFacade(t *testing.T) {
+	ctx := testdiag.Context(t)
+	files := coverage.FileData{
+		"example.com/mod/a/a.go": {Count: 10, Covered: 7},
+		"example.com/mod/b/b.go": {Count: 13, Covered: 3},
+	}
+	pkgs := coverage.ByPackage(ctx, files)
+
+	want := "" +
+		"example.com/mod/a:      70.00%   7 of 10\n" +
+		"example.com/mod/b:      23.08%   3 of 13\n" +
+		"<all>:                  43.48%  10 of 23\n"
+	if got := coverage.Report(pkgs); got != want {
+		t.Errorf("report: got %q, want %q", got, want)
+	}
+
+	delta := coverage.Diff(ctx, coverage.ByModule(ctx, pkgs), pkgs)
+	if got := delta.Grouping(); got != coverage.ModuleGrouping {
+		t.Errorf("grouping: got %v, want %v", got, coverage.ModuleGrouping)
+	}
+
+	var funcs coverage.FunctionData
+	if _, err := coverage.Compare(ctx, funcs, funcs); err == nil {
+		t.Error("compare functions: got nil error")
+	}
+}
+
+func TestFilesFromReader(t *testing.T) {
+	const prof = `mode: set
+example.com/mod/a/a.go:1.2,2.3 2 1
+example.com/mod/a/a.go:4.2,5.3 1 0
+example.com/mod/b/b.go:1.2,2.3 3 0
+`
+	ctx := testdiag.Context(t)
+	files, err := coverage.FilesFromReader(ctx, strings.NewReader(prof), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := coverage.FileData{
+		"example.com/mod/a/a.go": {Count: 3, Covered: 2},
+		"example.com/mod/b/b.go": {Count: 3, Covered: 0},
+	}
+	if diff := cmp.Diff(want, files); diff != "" {
+		t.Errorf("files (-want +got):\n%s", diff)
+	}
+
+	if _, err := coverage.FilesFromReader(ctx, strings.NewReader("m/a.go:1.2,2.3 x 1\n"), nil); err == nil {
+		t.Error("malformed profile: got nil, want error")
+	}
+}
@@ -7,6 +7,7 @@ require (
 	github.com/google/go-github/v57 v57.0.0
 	github.com/mutility/diag v1.2.0
 	github.com/urfave/cli/v2 v2.27.1
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -0,0 +1,119 @@
+package coverage
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type errInvalidBand string
+
+func (e errInvalidBand) Error() string {
+	return fmt.Sprintf("band value '%s'; must be percent:color, with a color such as red, orange, yellow, green, or #rrggbb", string(e))
+}
+
+// BadgeBand colors badges whose coverage is below Limit, unless a band with a
+// lower Limit applies. The band with the highest Limit also colors coverage
+// at or above it.
+type BadgeBand struct {
+	Limit float64
+	Color string // SVG fill color
+}
+
+// DefaultBadgeBands are used by WriteBadge when it is given no bands.
+var DefaultBadgeBands = []BadgeBand{
+	{50, "#e05d44"},  // red
+	{70, "#fe7d37"},  // orange
+	{80, "#dfb317"},  // yellow
+	{100, "#44cc11"}, // green
+}
+
+// badgeColors maps shields.io style color names to their SVG fill colors.
+var badgeColors = map[string]string{
+	"red":         "#e05d44",
+	"orange":      "#fe7d37",
+	"yellow":      "#dfb317",
+	"yellowgreen": "#a4a61d",
+	"green":       "#44cc11",
+	"brightgreen": "#44cc11",
+	"blue":        "#007ec6",
+	"lightgrey":   "#9f9f9f",
+	"grey":        "#555",
+}
+
+// ParseBadgeBand parses a band written as percent:color, such as 80:yellow or
+// 90:#97ca00.
+func ParseBadgeBand(s string) (BadgeBand, error) {
+	n := strings.IndexByte(s, ':')
+	if n < 0 {
+		return BadgeBand{}, errInvalidBand(s)
+	}
+	limit, err := strconv.ParseFloat(strings.TrimSuffix(s[:n], "%"), 64)
+	if err != nil || limit < 0 || limit > 100 {
+		return BadgeBand{}, errInvalidBand(s)
+	}
+	color := strings.ToLower(s[n+1:])
+	if hex, ok := badgeColors[color]; ok {
+		color = hex
+	} else if !isHexColor(color) {
+		return BadgeBand{}, errInvalidBand(s)
+	}
+	return BadgeBand{Limit: limit, Color: color}, nil
+}
+
+func isHexColor(s string) bool {
+	if len(s) != 4 && len(s) != 7 || s[0] != '#' {
+		return false
+	}
+	_, err := strconv.ParseUint(s[1:], 16, 32)
+	return err == nil
+}
+
+// badgeColor returns the color of the band for a coverage percentage.
+func badgeColor(pct float64, bands []BadgeBand) string {
+	if len(bands) == 0 {
+		bands = DefaultBadgeBands
+	}
+	bands = append([]BadgeBand(nil), bands...)
+	sort.SliceStable(bands, func(i, j int) bool { return bands[i].Limit < bands[j].Limit })
+	for _, b := range bands {
+		if pct < b.Limit {
+			return b.Color
+		}
+	}
+	return bands[len(bands)-1].Color
+}
+
+// badgeWidth approximates the rendered width of s in 11px Verdana, plus padding.
+func badgeWidth(s string) int {
+	return 7*len([]rune(s)) + 10
+}
+
+// WriteBadge writes a shields.io style SVG badge showing label and pct, colored
+// by bands, or DefaultBadgeBands if bands is empty.
+func WriteBadge(w io.Writer, pct float64, label string, bands []BadgeBand) error {
+	value := fmt.Sprintf("%.1f%%", pct)
+	lw, vw := badgeWidth(label), badgeWidth(value)
+	label, value = html.EscapeString(label), html.EscapeString(value)
+	_, err := fmt.Fprintf(w, `<svg xmlns="http://www.w3.org/2000/svg" width="%[1]d" height="20" role="img" aria-label="%[4]s: %[5]s">
+<title>%[4]s: %[5]s</title>
+<linearGradient id="s" x2="0" y2="100%%"><stop offset="0" stop-color="#bbb" stop-opacity=".1"/><stop offset="1" stop-opacity=".1"/></linearGradient>
+<clipPath id="r"><rect width="%[1]d" height="20" rx="3" fill="#fff"/></clipPath>
+<g clip-path="url(#r)">
+<rect width="%[2]d" height="20" fill="#555"/>
+<rect x="%[2]d" width="%[3]d" height="20" fill="%[6]s"/>
+<rect width="%[1]d" height="20" fill="url(#s)"/>
+</g>
+<g fill="#fff" text-anchor="middle" font-family="Verdana,Geneva,DejaVu Sans,sans-serif" font-size="11">
+<text x="%[7]d" y="15" fill="#010101" fill-opacity=".3">%[4]s</text>
+<text x="%[7]d" y="14">%[4]s</text>
+<text x="%[8]d" y="15" fill="#010101" fill-opacity=".3">%[5]s</text>
+<text x="%[8]d" y="14">%[5]s</text>
+</g>
+</svg>
+`, lw+vw, lw, vw, label, value, badgeColor(pct, bands), lw/2, lw+vw/2)
+	return err
+}
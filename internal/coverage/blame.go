@@ -0,0 +1,73 @@
+package coverage
+
+import (
+	"path/filepath"
+	"sort"
+
+	"github.com/mutility/diag"
+)
+
+// AuthorCount is the number of uncovered statements attributed to Author.
+type AuthorCount struct {
+	Author    string
+	Uncovered int
+}
+
+// UncoveredByAuthor attributes each uncovered block of stmts to the author of
+// its first line, and returns the uncovered statement count of each author,
+// most first. Authors maps the lines of a source file to their authors, such
+// as by git blame; files it cannot attribute are skipped.
+func UncoveredByAuthor(ctx diag.Context, stmts StatementData, authors func(file string) (map[int]string, error)) ([]AuthorCount, error) {
+	blocks := make(map[string]map[block]int)
+	pkgs := make(map[string]bool)
+	for k, hits := range stmts {
+		if hits > 0 || k.count == 0 {
+			continue
+		}
+		path, pos := k.loc()
+		b, err := parseBlock(pos)
+		if err != nil {
+			continue
+		}
+		if blocks[path] == nil {
+			blocks[path] = make(map[block]int)
+			pkgs[pathpkg(ctx, path)] = true
+		}
+		blocks[path][b] += k.count
+	}
+
+	dirs, err := packageDirs(ctx, pkgs)
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[string]int)
+	for path, bs := range blocks {
+		dir, ok := dirs[pathpkg(ctx, path)]
+		if !ok {
+			continue
+		}
+		lines, err := authors(filepath.Join(dir, filepath.Base(path)))
+		if err != nil {
+			diag.Debug(ctx, "attributing", path+":", err)
+			continue
+		}
+		for b, n := range bs {
+			if author, ok := lines[b.startLine]; ok {
+				counts[author] += n
+			}
+		}
+	}
+
+	byAuthor := make([]AuthorCount, 0, len(counts))
+	for author, n := range counts {
+		byAuthor = append(byAuthor, AuthorCount{author, n})
+	}
+	sort.Slice(byAuthor, func(i, j int) bool {
+		if byAuthor[i].Uncovered != byAuthor[j].Uncovered {
+			return byAuthor[i].Uncovered > byAuthor[j].Uncovered
+		}
+		return byAuthor[i].Author < byAuthor[j].Author
+	})
+	return byAuthor, nil
+}
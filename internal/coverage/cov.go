@@ -8,26 +8,43 @@ import (
 	"io"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/mutility/diag"
 )
 
-var ErrNoPackages = errors.New("no packages specified")
+// ErrNoPackages is returned, along with the empty StatementData, when a
+// profile has no statements left after filtering, unless
+// TestOptions.AllowEmpty is set.
+var ErrNoPackages = errors.New("no statements matched")
 
-type (
-	// StatementData records all statements (including location data) and covered status
-	StatementData map[stmt]bool // StatementData skips EachPath as EachStatement is not unique per file.
+// errWorkspaceJobs is returned when TestOptions.Jobs is more than 1 with
+// TestOptions.Workspace, whose modules are tested one at a time.
+var errWorkspaceJobs = errors.New("jobs value must be 1 with workspace")
 
-	StmtCount   struct{ Count, Covered int }
-	FileData    map[string]StmtCount
-	PathData    map[string]StmtCount
-	PackageData struct{ PathData }
-	RootData    struct{ PathData }
-	ModuleData  struct{ PathData }
+type (
+	// StatementData records all statements (including location data) and their hit counts
+	StatementData map[stmt]int // StatementData skips EachPath as EachStatement is not unique per file.
+
+	StmtCount struct{ Count, Covered int }
+
+	// FileData and PathData are maps, so they aren't safe for concurrent
+	// mutation. The By* functions only read their input and return new data,
+	// so they may run concurrently on inputs nothing modifies, such as the
+	// shards of a parallel collector, whose results Merge and MergePathData
+	// combine.
+	FileData     map[string]StmtCount
+	PathData     map[string]StmtCount
+	FunctionData struct{ PathData }
+	PackageData  struct{ PathData }
+	RootData     struct{ PathData }
+	ModuleData   struct{ PathData }
 
 	StmtDelta    struct{ BaseCount, BaseCovered, HeadCount, HeadCovered int }
 	PathDelta    map[string]StmtDelta
@@ -42,15 +59,16 @@ type (
 const (
 	UnknownGrouping Grouping = iota
 	StatementGrouping
+	FunctionGrouping
 	FileGrouping
 	PackageGrouping
 	RootGrouping
 	ModuleGrouping
 )
 
-const _grouping_names = "UnknownStatementFilePackageRootModule"
+const _grouping_names = "UnknownStatementFunctionFilePackageRootModule"
 
-var _grouping_idx = [...]uint8{0, 7, 16, 20, 27, 31, 37}
+var _grouping_idx = [...]uint8{0, 7, 16, 24, 28, 35, 39, 45}
 
 func (g Grouping) String() string {
 	n := int(g)
@@ -60,6 +78,7 @@ func (g Grouping) String() string {
 	return _grouping_names[_grouping_idx[n]:_grouping_idx[n+1]]
 }
 
+func (FunctionData) Grouping() Grouping            { return FunctionGrouping }
 func (FileData) Grouping() Grouping                { return FileGrouping }
 func (FileDelta) Grouping() Grouping               { return FileGrouping }
 func (PackageData) Grouping() Grouping             { return PackageGrouping }
@@ -68,6 +87,7 @@ func (RootData) Grouping() Grouping                { return RootGrouping }
 func (RootDelta) Grouping() Grouping               { return RootGrouping }
 func (ModuleData) Grouping() Grouping              { return ModuleGrouping }
 func (ModuleDelta) Grouping() Grouping             { return ModuleGrouping }
+func (fd FunctionData) Detail(p string) Counts     { return fd.PathData.Detail(p, false) }
 func (fd FileDelta) Detail(p string) Counts        { return fd.PathDelta.Detail(p, false) }
 func (pd PackageData) Detail(p string) Counts      { return pd.PathData.Detail(p, false) }
 func (pd PackageDelta) Detail(p string) Counts     { return pd.PathDelta.Detail(p, false) }
@@ -87,6 +107,66 @@ func (sd StatementData) EachStatement(fn func(path, pos string, count int, cover
 	}
 }
 
+// EachStatementCount is like EachStatement, but reports the number of times
+// each statement was executed instead of its covered count. Hit counts are
+// only meaningful for profiles recorded with -covermode=count or atomic.
+func (sd StatementData) EachStatementCount(fn func(path, pos string, count int, hits int)) {
+	for k, v := range sd {
+		path, pos := k.loc()
+		fn(path, pos, k.count, v)
+	}
+}
+
+// Span is the source extent of a statement block.
+type Span struct {
+	File                string
+	StartLine, StartCol int
+	EndLine, EndCol     int
+}
+
+// Uncovered returns the spans of uncovered statements, sorted by file and position.
+func (sd StatementData) Uncovered() []Span {
+	var spans []Span
+	for k, hits := range sd {
+		if hits > 0 || k.count == 0 {
+			continue
+		}
+		path, pos := k.loc()
+		b, err := parseBlock(pos)
+		if err != nil {
+			continue
+		}
+		spans = append(spans, Span{path, b.startLine, b.startCol, b.endLine, b.endCol})
+	}
+	sort.Slice(spans, func(i, j int) bool {
+		a, b := spans[i], spans[j]
+		if a.File != b.File {
+			return a.File < b.File
+		}
+		if a.StartLine != b.StartLine {
+			return a.StartLine < b.StartLine
+		}
+		return a.StartCol < b.StartCol
+	})
+	return spans
+}
+
+// UncoveredLines returns the line ranges of uncovered statements, sorted by
+// file and line. Overlapping and adjacent ranges in a file are joined.
+func (sd StatementData) UncoveredLines() []Span {
+	var lines []Span
+	for _, sp := range sd.Uncovered() {
+		if n := len(lines) - 1; n >= 0 && lines[n].File == sp.File && sp.StartLine <= lines[n].EndLine+1 {
+			if sp.EndLine > lines[n].EndLine || sp.EndLine == lines[n].EndLine && sp.EndCol > lines[n].EndCol {
+				lines[n].EndLine, lines[n].EndCol = sp.EndLine, sp.EndCol
+			}
+			continue
+		}
+		lines = append(lines, sp)
+	}
+	return lines
+}
+
 func (sd StatementData) EachFile(fn func(path string, count int, covered int)) {
 	for k, v := range sd {
 		fn(k.file(), k.count, k.covered(v))
@@ -166,29 +246,39 @@ func (pd PathData) EachModule(fn func(path string, count int, covered int)) {
 	}
 }
 
-func Diff(log diag.Interface, old, new EachPather) ChangeDetailer {
-	oldGrp, newGrp := old.Grouping(), new.Grouping()
+// GroupingError reports coverage that Diff cannot compare because neither
+// grouping can be regrouped as the other.
+type GroupingError struct {
+	Old, New Grouping
+}
 
-	as := func(log diag.Interface, grp Grouping, ep EachPather) EachPather {
-		switch grp {
-		case PackageGrouping:
-			return ByPackage(log, ep.(EachFiler))
-		case RootGrouping:
-			return ByRoot(log, ep.(EachPackager))
-		case ModuleGrouping:
-			return ByModule(log, ep.(EachPackager))
-		}
-		panic(grp)
-	}
+func (e GroupingError) Error() string {
+	return fmt.Sprintf("cannot compare %s coverage with %s coverage",
+		strings.ToLower(e.Old.String()), strings.ToLower(e.New.String()))
+}
+
+// Diff compares old and new at the coarser of their groupings. It returns a
+// GroupingError if the finer can't be regrouped as the coarser, or if the
+// grouping can't be compared, such as by function.
+func Diff(log diag.Interface, old, new EachPather) (ChangeDetailer, error) {
+	oldGrp, newGrp := old.Grouping(), new.Grouping()
 
 	oldEach := old.EachPath
 	newEach := new.EachPath
 	grp := oldGrp
 	if oldGrp < newGrp {
-		oldEach = as(log, newGrp, old).EachPath
+		ep, ok := regroup(log, newGrp, old)
+		if !ok {
+			return nil, GroupingError{Old: oldGrp, New: newGrp}
+		}
+		oldEach = ep.EachPath
 		grp = newGrp
 	} else if newGrp < oldGrp {
-		newEach = as(log, oldGrp, new).EachPath
+		ep, ok := regroup(log, oldGrp, new)
+		if !ok {
+			return nil, GroupingError{Old: oldGrp, New: newGrp}
+		}
+		newEach = ep.EachPath
 	}
 
 	delta := make(map[string]StmtDelta)
@@ -206,15 +296,73 @@ func Diff(log diag.Interface, old, new EachPather) ChangeDetailer {
 	})
 	switch grp {
 	case ModuleGrouping:
-		return ModuleDelta{delta}
+		return ModuleDelta{delta}, nil
 	case RootGrouping:
-		return RootDelta{delta}
+		return RootDelta{delta}, nil
 	case PackageGrouping:
-		return PackageDelta{delta}
+		return PackageDelta{delta}, nil
+	case FileGrouping:
+		return FileDelta{delta}, nil
+	}
+	return nil, GroupingError{Old: oldGrp, New: newGrp}
+}
+
+// regroup groups ep as grp, if it provides the finer data grp requires.
+func regroup(log diag.Interface, grp Grouping, ep EachPather) (EachPather, bool) {
+	switch grp {
 	case FileGrouping:
-		return FileDelta{delta}
+		if stmts, ok := ep.(EachStatementer); ok {
+			return ByFiles(log, stmts), true
+		}
+	case PackageGrouping:
+		if files, ok := ep.(EachFiler); ok {
+			return ByPackage(log, files), true
+		}
+		if pkgs, ok := ep.(EachPackager); ok {
+			pd := make(PathData)
+			pkgs.EachPackage(func(path string, count int, covered int) {
+				cc := pd[path]
+				cc.Count += count
+				cc.Covered += covered
+				pd[path] = cc
+			})
+			return PackageData{pd}, true
+		}
+	case RootGrouping:
+		if pkgs, ok := ep.(EachPackager); ok {
+			return ByRoot(log, pkgs), true
+		}
+	case ModuleGrouping:
+		if pkgs, ok := ep.(EachPackager); ok {
+			return ByModule(log, pkgs), true
+		}
+	}
+	return nil, false
+}
+
+type errInvalidGrouping string
+
+func (e errInvalidGrouping) Error() string {
+	return fmt.Sprintf("grouping value '%s'; must be file, package, root, or module", string(e))
+}
+
+// DiffStatements groups base and head as grouping, one of "file", "package",
+// "root", or "module", and compares them.
+func DiffStatements(log diag.Interface, base, head StatementData, grouping string) (ChangeDetailer, error) {
+	var group func(StatementData) EachPather
+	switch grouping {
+	case "file":
+		group = func(st StatementData) EachPather { return ByFiles(log, st) }
+	case "package":
+		group = func(st StatementData) EachPather { return ByPackage(log, st) }
+	case "root":
+		group = func(st StatementData) EachPather { return ByRoot(log, st) }
+	case "module":
+		group = func(st StatementData) EachPather { return ByModule(log, st) }
+	default:
+		return nil, errInvalidGrouping(grouping)
 	}
-	panic(grp)
+	return Diff(log, group(base), group(head))
 }
 
 func (pd PathData) Paths() []string {
@@ -251,10 +399,19 @@ func (pd PathDelta) BaseDetail(path string, agg bool) Counts {
 }
 
 func CollectStatements(ctx diag.Context, options *TestOptions) (StatementData, error) {
+	if _, err := options.includer(); err != nil {
+		return nil, err
+	}
+	if _, err := options.globExcluder(); err != nil {
+		return nil, err
+	}
 	prof, err := coverprofile(ctx, options)
 	if err != nil {
 		return nil, err
 	}
+	if options == nil || options.CoverProfile == "" {
+		defer os.Remove(prof)
+	}
 	return LoadProfile(ctx, prof, options)
 }
 
@@ -267,6 +424,15 @@ func CollectFiles(ctx diag.Context, options *TestOptions) (FileData, error) {
 	return ByFiles(ctx, stmts), nil
 }
 
+func FilesFromReader(ctx diag.Context, r io.Reader, options *TestOptions) (FileData, error) {
+	stmts, err := ReadProfile(ctx, r, options)
+	if err != nil {
+		return nil, err
+	}
+
+	return ByFiles(ctx, stmts), nil
+}
+
 func Percent(c EachPather) float64 {
 	totalct, totalcov := 0, 0
 	c.EachPath(func(_ string, count, covered int) {
@@ -325,6 +491,32 @@ func ByFiles(log diag.Interface, stmts EachStatementer) FileData {
 	return fd
 }
 
+// Merge returns new FileData with the counts of each file of a and b summed,
+// leaving a and b unchanged. It suits shards that measure disjoint files;
+// shards that measure the same files should merge statements instead, as a
+// statement covered in both would be counted twice.
+func Merge(a, b FileData) FileData {
+	return FileData(mergeCounts(a, b))
+}
+
+// MergePathData is like Merge, for PathData.
+func MergePathData(a, b PathData) PathData {
+	return PathData(mergeCounts(a, b))
+}
+
+func mergeCounts(a, b map[string]StmtCount) map[string]StmtCount {
+	m := make(map[string]StmtCount, len(a)+len(b))
+	for _, src := range []map[string]StmtCount{a, b} {
+		for k, v := range src {
+			cc := m[k]
+			cc.Count += v.Count
+			cc.Covered += v.Covered
+			m[k] = cc
+		}
+	}
+	return m
+}
+
 func ByPackage(log diag.Interface, files EachFiler) PackageData {
 	pd := make(PathData)
 	files.EachFile(func(path string, count int, covered int) {
@@ -376,6 +568,9 @@ func pathpkg(log diag.Interface, path string) string {
 }
 
 func pathmod(log diag.Interface, path string) string {
+	if mod, ok := findModule(path); ok {
+		return mod
+	}
 	n := nth(path, '/', 2)
 	if n < 0 {
 		diag.Debug(log, "can't find module in:", path)
@@ -384,17 +579,35 @@ func pathmod(log diag.Interface, path string) string {
 	return path[:n]
 }
 
+// DefaultModuleDepth is the number of path segments ByModule assumes form a
+// module path, as in github.com/owner/repo.
+const DefaultModuleDepth = 3
+
+// ByModule groups packages into modules of DefaultModuleDepth path segments.
 func ByModule(log diag.Interface, pkgs EachPackager) ModuleData {
+	return ByModuleDepth(log, pkgs, DefaultModuleDepth)
+}
+
+// ByModuleDepth groups packages into modules of depth path segments. A depth
+// less than 1 uses DefaultModuleDepth. See Module(ctx).Depth() to detect it.
+// Packages in a module found by ResolveModules are grouped into that module.
+func ByModuleDepth(log diag.Interface, pkgs EachPackager, depth int) ModuleData {
+	if depth < 1 {
+		depth = DefaultModuleDepth
+	}
 	md := make(PathData)
 	pkgs.EachPackage(func(path string, count int, covered int) {
-		parts := strings.Split(path, "/")
-		if len(parts) > 3 {
-			parts = parts[:3]
-		}
-		if len(parts) < 2 && len(path) > 0 {
-			diag.Debug(log, "can't find module in:", path)
+		mod, ok := findModule(path)
+		if !ok {
+			parts := strings.Split(path, "/")
+			if len(parts) > depth {
+				parts = parts[:depth]
+			}
+			if len(parts) < 2 && len(path) > 0 {
+				diag.Debug(log, "can't find module in:", path)
+			}
+			mod = strings.Join(parts, "/")
 		}
-		mod := strings.Join(parts, "/")
 
 		cc := md[mod]
 		cc.Count += count
@@ -405,13 +618,99 @@ func ByModule(log diag.Interface, pkgs EachPackager) ModuleData {
 }
 
 type TestOptions struct {
-	CoverProfile   string
-	Flags          []string
+	CoverProfile   string   // File to write the coverprofile to and keep; a temporary file removed after reading if empty
+	CoverMode      string   // -covermode for go test: "set", "count", or "atomic"; go's default if empty
+	TestRunner     []string // Command that runs go test with the flags that follow; "go", "test" if empty
+	Flags          []string // Passed to go test after -coverprofile, -covermode, -coverpkg, and -tags, before Packages
+	BuildTags      []string // Passed to go test and go list as -tags; statements in files they exclude are skipped
 	Packages       []string
+	CoverPkgs      []string // Packages whose coverage is measured, as -coverpkg; Packages if empty
 	Excludes       []string
+	ExcludeGlobs   []string // Glob patterns of file paths to exclude; see MatchGlob
+	Includes       []string // Regexps of file paths to include; all if empty. Excludes take precedence.
+	SkipGenerated  bool     // Skip files with a "Code generated ... DO NOT EDIT." comment
+	NoTestFiles    bool     // Skip statements in _test.go files
+	AllowEmpty     bool     // Return empty coverage instead of ErrNoPackages
+	Workspace      bool     // Test each module of the go.work workspace, resolving Packages within each
+	Jobs           int      // If more than 1, test each root of Packages separately, this many at a time; not with Workspace
 	Stdout, Stderr io.Writer
 }
 
+// includer compiles Includes into a func reporting if path is included.
+func (o *TestOptions) includer() (func(path string) bool, error) {
+	if o == nil || len(o.Includes) == 0 {
+		return func(string) bool { return true }, nil
+	}
+	res := make([]*regexp.Regexp, len(o.Includes))
+	for i, in := range o.Includes {
+		re, err := regexp.Compile(in)
+		if err != nil {
+			return nil, fmt.Errorf("include: %w", err)
+		}
+		res[i] = re
+	}
+	return func(path string) bool {
+		for _, re := range res {
+			if re.MatchString(path) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+// globExcluder checks ExcludeGlobs and returns a func reporting if file is
+// excluded by them.
+func (o *TestOptions) globExcluder() (func(file string) bool, error) {
+	if o == nil || len(o.ExcludeGlobs) == 0 {
+		return func(string) bool { return false }, nil
+	}
+	for _, g := range o.ExcludeGlobs {
+		if _, err := path.Match(g, ""); err != nil {
+			return nil, fmt.Errorf("exclude glob '%s': %w", g, err)
+		}
+	}
+	return func(file string) bool {
+		for _, g := range o.ExcludeGlobs {
+			if MatchGlob(g, file) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+// MatchGlob reports whether file matches pattern. Each slash-separated
+// segment of pattern matches one segment of file as with path.Match, except
+// that ** matches any number of segments. The pattern is unanchored: it may
+// match starting at any segment of file, and matching a directory matches
+// the files below it, so internal/*/gen matches example.com/mod/internal/x/gen/a.go.
+func MatchGlob(pattern, file string) bool {
+	segs := strings.Split(file, "/")
+	pats := strings.Split(strings.Trim(pattern, "/"), "/")
+	for i := range segs {
+		if matchSegments(pats, segs[i:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchSegments reports whether pats matches a leading run of segs.
+func matchSegments(pats, segs []string) bool {
+	if len(pats) == 0 {
+		return true
+	}
+	if pats[0] == "**" {
+		return matchSegments(pats[1:], segs) || len(segs) > 0 && matchSegments(pats, segs[1:])
+	}
+	if len(segs) == 0 {
+		return false
+	}
+	ok, _ := path.Match(pats[0], segs[0])
+	return ok && matchSegments(pats[1:], segs[1:])
+}
+
 func (o *TestOptions) excludes(path string) bool {
 	if o == nil {
 		return false
@@ -425,14 +724,59 @@ func (o *TestOptions) excludes(path string) bool {
 	return false
 }
 
+// Mode returns the cover mode go test uses with these options: CoverMode or
+// a -covermode in Flags if set, or go's default of atomic with -race, and set
+// otherwise.
+func (o *TestOptions) Mode() string {
+	if o == nil {
+		return "set"
+	}
+	if o.CoverMode != "" {
+		return o.CoverMode
+	}
+	mode := "set"
+	for i, f := range o.Flags {
+		f = "-" + strings.TrimLeft(f, "-")
+		switch {
+		case strings.HasPrefix(f, "-covermode="):
+			return strings.TrimPrefix(f, "-covermode=")
+		case f == "-covermode" && i+1 < len(o.Flags):
+			return o.Flags[i+1]
+		case f == "-race" || f == "-race=true":
+			mode = "atomic"
+		}
+	}
+	return mode
+}
+
+// skipsTest reports whether statements in file are skipped as test code.
+func (o *TestOptions) skipsTest(file string) bool {
+	return o != nil && o.NoTestFiles && strings.HasSuffix(file, "_test.go")
+}
+
+func (o *TestOptions) allowsEmpty() bool {
+	return o != nil && o.AllowEmpty
+}
+
+// DefaultTestRunner runs go test when TestOptions.TestRunner is empty.
+var DefaultTestRunner = []string{"go", "test"}
+
 var DefaultTestOptions = &TestOptions{
 	Flags:    nil,
 	Packages: []string{"."},
 	Excludes: nil,
 }
 
-// coverprofile collects a coverprofile and returns the filename
-func coverprofile(log diag.Interface, options *TestOptions) (string, error) {
+// coverprofile collects a coverprofile and returns the filename.
+// Cancelling ctx kills the go test process. A temporary profile is removed
+// if tests fail, while options.CoverProfile is kept to inspect the failure.
+func coverprofile(ctx diag.Context, options *TestOptions) (string, error) {
+	if options == nil {
+		options = DefaultTestOptions
+	}
+	if options.Workspace && options.Jobs > 1 {
+		return "", errWorkspaceJobs
+	}
 	profile := options.CoverProfile
 	if profile == "" {
 		prof, err := os.CreateTemp("", "covpkg*")
@@ -443,18 +787,65 @@ func coverprofile(log diag.Interface, options *TestOptions) (string, error) {
 		profile = prof.Name()
 	}
 
-	if options == nil {
-		options = DefaultTestOptions
-	}
 	if len(options.Packages) == 0 {
 		options.Packages = append(options.Packages, ".")
 	}
-	diag.Debug(log, "Creating profile in:", profile, "packages", options.Packages)
+	diag.Debug(ctx, "Creating profile in:", profile, "packages", options.Packages)
+
+	var err error
+	if options.Workspace {
+		err = workspaceProfile(ctx, options, profile)
+	} else if options.Jobs > 1 {
+		err = parallelProfile(ctx, options, profile)
+	} else {
+		err = goTest(ctx, options, "", profile)
+	}
+	if err != nil {
+		if options.CoverProfile == "" {
+			os.Remove(profile)
+		}
+		return "", err
+	}
+	return profile, nil
+}
+
+// goTest runs go test, or options.TestRunner, in dir, or the current
+// directory if dir is empty, writing a coverprofile to profile. Package
+// directories are relative to dir.
+func goTest(ctx diag.Context, options *TestOptions, dir, profile string) error {
+	pkgs := packageArgs(options.Packages, dir)
+	return runTests(ctx, options, dir, profile, coverPkgArgs(options, dir, pkgs), pkgs)
+}
 
-	pkgs := make([]string, len(options.Packages))
-	for i, arg := range options.Packages {
-		if st, err := os.Stat(arg); err == nil && st.IsDir() {
-			if rel, err := filepath.Rel(".", arg); err == nil {
+// coverPkgArgs returns options.CoverPkgs as go test arguments, or pkgs if
+// there are none.
+func coverPkgArgs(options *TestOptions, dir string, pkgs []string) []string {
+	if len(options.CoverPkgs) == 0 {
+		return pkgs
+	}
+	return packageArgs(options.CoverPkgs, dir)
+}
+
+// packageArgs returns packages as go test arguments, replacing each
+// directory with a pattern of the packages in and below it. Patterns such as
+// ./cmd/... and import paths such as example.com/mod/pkg are passed as is.
+func packageArgs(packages []string, dir string) []string {
+	base := "."
+	if dir != "" {
+		base = dir
+	}
+	pkgs := make([]string, len(packages))
+	for i, arg := range packages {
+		if isPackagePattern(arg) {
+			pkgs[i] = arg
+			continue
+		}
+		path := arg
+		if dir != "" && !filepath.IsAbs(arg) {
+			path = filepath.Join(dir, arg)
+		}
+		if st, err := os.Stat(path); err == nil && st.IsDir() {
+			if rel, err := filepath.Rel(base, path); err == nil {
 				if rel == "." {
 					pkgs[i] = "./..."
 				} else {
@@ -465,22 +856,162 @@ func coverprofile(log diag.Interface, options *TestOptions) (string, error) {
 		}
 		pkgs[i] = arg
 	}
+	return pkgs
+}
+
+// isPackagePattern reports whether arg is a ... pattern, or an import path
+// whose first element is a domain, rather than a directory.
+func isPackagePattern(arg string) bool {
+	if strings.Contains(arg, "...") {
+		return true
+	}
+	first, _, _ := strings.Cut(filepath.ToSlash(arg), "/")
+	return first != "." && first != ".." && strings.Contains(first, ".")
+}
 
-	diag.Debug(log, "run> go test -coverprofile", profile, "-coverpkg", strings.Join(pkgs, ","), strings.Join(pkgs, " "))
-	cmd := exec.Command("go", append([]string{"test", "-coverprofile", profile, "-coverpkg", strings.Join(pkgs, ",")}, pkgs...)...)
+// runTests runs the tests of pkgs in dir, measuring coverage of coverpkg.
+func runTests(ctx diag.Context, options *TestOptions, dir, profile string, coverpkg, pkgs []string) error {
+	runner := options.TestRunner
+	if len(runner) == 0 {
+		runner = DefaultTestRunner
+	}
+	args := append([]string(nil), runner[1:]...)
+	args = append(args, "-coverprofile", profile)
+	if options.CoverMode != "" {
+		args = append(args, "-covermode", options.CoverMode)
+	}
+	args = append(args, "-coverpkg", strings.Join(coverpkg, ","))
+	args = append(args, tagsFlag(options.BuildTags)...)
+	args = append(args, options.Flags...)
+	args = append(args, pkgs...)
+
+	diag.Debug(ctx, "run>", runner[0], strings.Join(args, " "))
+	cmd := exec.CommandContext(ctx, runner[0], args...)
+	cmd.Dir = dir
+	// Keep the last lines of output, to explain a failure.
+	output := &tailWriter{n: failureLines}
+	cmd.Stdout, cmd.Stderr = output, output
 	if options.Stdout != nil {
-		cmd.Stdout = options.Stdout
-		fmt.Fprintln(options.Stdout, "go test -coverprofile", profile, "-coverpkg", strings.Join(pkgs, ","), strings.Join(pkgs, " "))
+		cmd.Stdout = io.MultiWriter(options.Stdout, output)
+		fmt.Fprintln(options.Stdout, runner[0], strings.Join(args, " "))
 	}
 	if options.Stderr != nil {
-		cmd.Stderr = options.Stderr
+		cmd.Stderr = io.MultiWriter(options.Stderr, output)
 	}
 	err := cmd.Run()
 	if err != nil {
-		os.Remove(profile)
-		return "", fmt.Errorf("tests failed: %w", err)
+		if cerr := ctx.Err(); cerr != nil {
+			return fmt.Errorf("tests canceled: %w", cerr)
+		}
+		terr := &TestRunError{Err: err, ExitCode: -1, Output: output.String(), build: output.build}
+		terr.shown = options.Stdout != nil && options.Stderr != nil
+		var exit *exec.ExitError
+		if errors.As(err, &exit) {
+			terr.ExitCode = exit.ExitCode()
+		}
+		return terr
 	}
-	return profile, nil
+	return nil
+}
+
+// TestRunError reports a test run that failed, whether because tests failed,
+// packages failed to build, or the test runner could not be started.
+type TestRunError struct {
+	Err      error  // Error running the test runner, often an *exec.ExitError
+	ExitCode int    // Exit code of the test runner, or -1 if it did not exit
+	Output   string // Last lines of the combined output of the test runner
+	shown    bool   // Output was written to TestOptions.Stdout and Stderr
+	build    bool   // Output reported a package that failed to build or set up
+}
+
+func (e *TestRunError) Error() string {
+	what := "tests failed"
+	if e.build {
+		what = "build failed"
+	}
+	if tail := lastLines(e.Output, failureLines); tail != "" && !e.shown {
+		return fmt.Sprintf("%s: %v\n%s", what, e.Err, tail)
+	}
+	return fmt.Sprintf("%s: %v", what, e.Err)
+}
+
+func (e *TestRunError) Unwrap() error { return e.Err }
+
+// BuildFailed reports whether any package failed to build or set up, rather
+// than failing its tests. It only recognizes the "[build failed]" and
+// "[setup failed]" markers of go test output, so it reports false for test
+// runners, such as gotestsum with another format, that don't print them.
+func (e *TestRunError) BuildFailed() bool {
+	return e.build
+}
+
+// failureLines limits the captured test output included in a failure.
+const failureLines = 20
+
+// tailWriter keeps the last n lines written to it, and whether any line
+// reported a package that failed to build or set up. It is safe for the
+// concurrent writes of a command's Stdout and Stderr.
+type tailWriter struct {
+	n       int
+	mu      sync.Mutex
+	lines   []string // ring of the last n complete lines, oldest at next
+	next    int
+	partial []byte // unterminated last line
+	build   bool
+}
+
+func (w *tailWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.partial = append(w.partial, p...)
+	for {
+		i := bytes.IndexByte(w.partial, '\n')
+		if i < 0 {
+			break
+		}
+		w.add(string(w.partial[:i]))
+		w.partial = w.partial[i+1:]
+	}
+	return len(p), nil
+}
+
+func (w *tailWriter) add(line string) {
+	if strings.Contains(line, "[build failed]") || strings.Contains(line, "[setup failed]") {
+		w.build = true
+	}
+	if len(w.lines) < w.n {
+		w.lines = append(w.lines, line)
+		return
+	}
+	w.lines[w.next] = line
+	w.next = (w.next + 1) % w.n
+}
+
+// String returns the kept lines, oldest first, and any unterminated line.
+func (w *tailWriter) String() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var sb strings.Builder
+	for i := range w.lines {
+		sb.WriteString(w.lines[(w.next+i)%len(w.lines)])
+		sb.WriteByte('\n')
+	}
+	sb.Write(w.partial)
+	return sb.String()
+}
+
+// lastLines returns the last n lines of s, without a trailing newline.
+func lastLines(s string, n int) string {
+	s = strings.TrimRight(s, "\n")
+	i := len(s)
+	for ; n > 0; n-- {
+		j := strings.LastIndexByte(s[:i], '\n')
+		if j < 0 {
+			return s
+		}
+		i = j
+	}
+	return s[i+1:]
 }
 
 type stmt struct {
@@ -508,8 +1039,8 @@ func (s stmt) mod() string {
 	return pathmod(nil, s.filepos)
 }
 
-func (s stmt) covered(cov bool) int {
-	if cov {
+func (s stmt) covered(hits int) int {
+	if hits > 0 {
 		return s.count
 	}
 	return 0
@@ -530,18 +1061,92 @@ func LoadProfile(ctx diag.Context, prof string, options *TestOptions) (Statement
 	return stmts, err
 }
 
+// ModeError reports profiles that MergeProfiles cannot combine because they
+// were measured with different cover modes.
+type ModeError struct {
+	Profile    string // Profile whose mode differs
+	Mode, Want string // Its mode, and that of the profiles before it
+}
+
+func (e ModeError) Error() string {
+	return fmt.Sprintf("%s: mode %s; must match mode %s of the other profiles", e.Profile, e.Mode, e.Want)
+}
+
+// MergeProfiles loads statement coverage from several coverprofile files. A
+// statement is covered if it is covered in any profile, and hit counts are summed.
+// It returns a ModeError if the profiles have different modes; a profile
+// without a mode line matches any mode.
+func MergeProfiles(ctx diag.Context, profiles []string, options *TestOptions) (StatementData, error) {
+	stmts := make(StatementData)
+	mode := ""
+	// A single profile may be empty if the others aren't.
+	each := TestOptions{AllowEmpty: true}
+	if options != nil {
+		each = *options
+		each.AllowEmpty = true
+	}
+	for _, prof := range profiles {
+		st, m, err := loadProfileMode(ctx, prof, &each)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", prof, err)
+		}
+		switch {
+		case m == "":
+		case mode == "":
+			mode = m
+		case m != mode:
+			return nil, ModeError{Profile: prof, Mode: m, Want: mode}
+		}
+		for loc, hits := range st {
+			stmts[loc] += hits
+		}
+	}
+	if len(stmts) == 0 && !options.allowsEmpty() {
+		return stmts, ErrNoPackages
+	}
+	return stmts, nil
+}
+
+// loadProfileMode is like LoadProfile, but also returns the mode of its
+// mode line, or "" if it lacks one.
+func loadProfileMode(ctx diag.Context, prof string, options *TestOptions) (StatementData, string, error) {
+	r, err := os.Open(prof)
+	if err != nil {
+		return nil, "", err
+	}
+
+	stmts, mode, err := scanStatements(ctx, bufio.NewScanner(r), options)
+
+	if err := r.Close(); err != nil {
+		diag.Debug(ctx, "closing coverprofile:", err)
+	}
+	return stmts, mode, err
+}
+
 // ReadProfile loads statement coverage from a Reader.
 func ReadProfile(ctx diag.Context, r io.Reader, options *TestOptions) (StatementData, error) {
-	scan := bufio.NewScanner(r)
-	return scanStatements(ctx, scan, options)
+	stmts, _, err := scanStatements(ctx, bufio.NewScanner(r), options)
+	return stmts, err
 }
 
-func scanStatements(ctx diag.Context, s *bufio.Scanner, options *TestOptions) (StatementData, error) {
+// scanStatements reads the statement coverage of a coverprofile, and the
+// mode of its mode line.
+func scanStatements(ctx diag.Context, s *bufio.Scanner, options *TestOptions) (StatementData, string, error) {
 	stmts := make(StatementData)
+	mode := ""
+	includes, err := options.includer()
+	if err != nil {
+		return nil, "", err
+	}
+	globExcludes, err := options.globExcluder()
+	if err != nil {
+		return nil, "", err
+	}
 
 	for s.Scan() && ctx.Err() == nil {
 		line := s.Text()
 		if strings.HasPrefix(line, "mode:") {
+			mode = strings.TrimSpace(strings.TrimPrefix(line, "mode:"))
 			continue
 		}
 
@@ -554,28 +1159,128 @@ func scanStatements(ctx diag.Context, s *bufio.Scanner, options *TestOptions) (S
 		if options.excludes(f[0]) {
 			continue
 		}
+		if n := strings.LastIndexByte(f[0], ':'); n < 0 || !includes(f[0][:n]) || globExcludes(f[0][:n]) || options.skipsTest(f[0][:n]) {
+			continue
+		}
 
-		ct, err := strconv.Atoi(f[1])
+		loc, hits, err := parseFields(f)
 		if err != nil {
 			diag.Debug(ctx, "invalid fields:", line)
-			return nil, err
+			return nil, "", err
 		}
-		loc := stmt{f[0], ct}
-		cov := f[2] != "0"
-		stmts[loc] = cov || stmts[loc]
+		stmts[loc] += hits
+	}
+	if err := ctx.Err(); err != nil {
+		return stmts, mode, err
 	}
 
-	return stmts, ctx.Err()
+	if options != nil && len(options.BuildTags) > 0 {
+		if err := skipUnbuilt(ctx, stmts, options.BuildTags); err != nil {
+			return nil, "", err
+		}
+	}
+	if options != nil && options.SkipGenerated {
+		if err := skipGenerated(ctx, stmts); err != nil {
+			return nil, "", err
+		}
+	}
+	if len(stmts) == 0 && !options.allowsEmpty() {
+		return stmts, mode, ErrNoPackages
+	}
+	return stmts, mode, nil
+}
+
+// parseFields parses the statement count and hits of a coverprofile line
+// split into its three fields.
+func parseFields(f []string) (stmt, int, error) {
+	ct, err := strconv.Atoi(f[1])
+	if err != nil {
+		return stmt{}, 0, err
+	}
+	hits, err := strconv.Atoi(f[2])
+	if err != nil {
+		return stmt{}, 0, err
+	}
+	return stmt{f[0], ct}, hits, nil
+}
+
+// ProfileError describes a malformed line of a coverprofile.
+type ProfileError struct {
+	Line   int // 1-based line number
+	Text   string
+	Reason string
+}
+
+func (e ProfileError) Error() string {
+	return fmt.Sprintf("line %d: %s: %q", e.Line, e.Reason, e.Text)
+}
+
+// ValidateProfile reports each line of a coverprofile that ReadProfile would
+// skip or fail to read, and a missing mode line. It returns an error only if
+// r can't be read.
+func ValidateProfile(r io.Reader) ([]ProfileError, error) {
+	var errs []ProfileError
+	scan := bufio.NewScanner(r)
+	n := 0
+	for scan.Scan() {
+		n++
+		line := scan.Text()
+		if strings.HasPrefix(line, "mode:") {
+			continue
+		}
+		if n == 1 {
+			errs = append(errs, ProfileError{n, line, "missing mode line"})
+		}
+
+		f := strings.Fields(line)
+		if len(f) != 3 {
+			errs = append(errs, ProfileError{n, line, "invalid line"})
+			continue
+		}
+		loc, _, err := parseFields(f)
+		if err != nil {
+			errs = append(errs, ProfileError{n, line, "invalid fields"})
+			continue
+		}
+		if i := strings.LastIndexByte(loc.filepos, ':'); i < 0 {
+			errs = append(errs, ProfileError{n, line, "invalid position"})
+		} else if _, err := parseBlock(loc.filepos[i+1:]); err != nil {
+			errs = append(errs, ProfileError{n, line, "invalid position"})
+		}
+	}
+	if n == 0 {
+		errs = append(errs, ProfileError{1, "", "missing mode line"})
+	}
+	return errs, scan.Err()
 }
 
 type module string
 
+// Module returns the module of the package in the current directory, or
+// failing that the main module reported by go list -m if there is only one.
 func Module(ctx diag.Context) module {
 	diag.Debug(ctx, "exec> go list -f {{ .Module }}")
 	cmd := exec.CommandContext(ctx, "go", "list", "-f", "{{ .Module }}")
 	mod, err := cmd.Output()
-	if err != nil {
+	if err == nil {
+		return module(bytes.TrimSpace(mod))
+	}
+
+	diag.Debug(ctx, "exec> go list -m")
+	cmd = exec.CommandContext(ctx, "go", "list", "-m")
+	mod, err = cmd.Output()
+	mod = bytes.TrimSpace(mod)
+	if err != nil || bytes.ContainsRune(mod, '\n') {
 		return ""
 	}
-	return module(bytes.TrimSpace(mod))
+	return module(mod)
+}
+
+// Depth returns the number of path segments in the module path, or 0 if the
+// module is unknown.
+func (m module) Depth() int {
+	if m == "" {
+		return 0
+	}
+	return strings.Count(string(m), "/") + 1
 }
@@ -1,6 +1,13 @@
 package coverage
 
 import (
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
@@ -52,3 +59,967 @@ func TestLoadAgg(t *testing.T) {
 		t.Errorf("byroot (-want +got):\n%s", diff)
 	}
 }
+
+func TestLoadAtomic(t *testing.T) {
+	const prof = `mode: atomic
+example.com/mod/pkg/a.go:1.2,2.3 2 7
+example.com/mod/pkg/a.go:1.2,2.3 2 5
+example.com/mod/pkg/a.go:4.2,5.3 1 0
+`
+	ctx := testdiag.Context(t)
+	st, err := ReadProfile(ctx, strings.NewReader(prof), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hits := make(map[string]int)
+	st.EachStatementCount(func(_, pos string, _ int, n int) { hits[pos] = n })
+	if diff := cmp.Diff(map[string]int{"1.2,2.3": 12, "4.2,5.3": 0}, hits); diff != "" {
+		t.Errorf("hits (-want +got):\n%s", diff)
+	}
+
+	covered := make(map[string]int)
+	st.EachStatement(func(_, pos string, _ int, n int) { covered[pos] = n })
+	if diff := cmp.Diff(map[string]int{"1.2,2.3": 2, "4.2,5.3": 0}, covered); diff != "" {
+		t.Errorf("covered (-want +got):\n%s", diff)
+	}
+}
+
+func TestMergeProfiles(t *testing.T) {
+	const prof = "testdata/cover.prof"
+
+	ctx := testdiag.Context(t)
+	st, err := MergeProfiles(ctx, []string{prof, prof}, DefaultTestOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(st) != 216 {
+		t.Errorf("statements: got %v, want %v", len(st), 216)
+	}
+	if got, want := Percent(ByFiles(ctx, st)), 77*100/359.0; got != want {
+		t.Errorf("percent: got %v, want %v", got, want)
+	}
+
+	if _, err := MergeProfiles(ctx, []string{prof, "testdata/missing.prof"}, nil); err == nil {
+		t.Error("missing: got nil error")
+	}
+}
+
+func TestMergeProfilesMode(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		t.Helper()
+		name = filepath.Join(dir, name)
+		if err := os.WriteFile(name, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return name
+	}
+	set1 := write("set1.out", "mode: set\nexample.com/mod/a.go:1.2,2.3 2 1\n")
+	set2 := write("set2.out", "mode: set\nexample.com/mod/a.go:4.2,5.3 1 0\n")
+	count := write("count.out", "mode: count\nexample.com/mod/a.go:1.2,2.3 2 3\n")
+	none := write("none.out", "example.com/mod/a.go:4.2,5.3 1 1\n")
+
+	ctx := testdiag.Context(t)
+	st, err := MergeProfiles(ctx, []string{set1, none, set2}, nil)
+	if err != nil || len(st) != 2 {
+		t.Errorf("set+set: got %v, %v, want 2 statements", st, err)
+	}
+
+	var merr ModeError
+	if _, err := MergeProfiles(ctx, []string{set1, count}, nil); !errors.As(err, &merr) || merr.Profile != count || merr.Mode != "count" || merr.Want != "set" {
+		t.Errorf("set+count: got %v, want ModeError", err)
+	}
+}
+
+func TestIncludes(t *testing.T) {
+	const prof = `mode: set
+example.com/mod/api/v1/a.go:1.2,2.3 2 1
+example.com/mod/api/v2/gen/b.go:1.2,2.3 3 1
+example.com/mod/api/internal/c.go:1.2,2.3 4 1
+example.com/mod/d.go:1.2,2.3 5 1
+`
+	ctx := testdiag.Context(t)
+	opts := &TestOptions{Includes: []string{`.*/api/v[0-9]+`}, Excludes: []string{"gen"}}
+	st, err := ReadProfile(ctx, strings.NewReader(prof), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := FileData{"example.com/mod/api/v1/a.go": StmtCount{2, 2}}
+	if diff := cmp.Diff(want, ByFiles(ctx, st)); diff != "" {
+		t.Errorf("files (-want +got):\n%s", diff)
+	}
+
+	opts.Includes = []string{`(`}
+	if _, err := ReadProfile(ctx, strings.NewReader(prof), opts); err == nil {
+		t.Error("invalid include: got nil error")
+	}
+}
+
+func TestExcludeGlobs(t *testing.T) {
+	const prof = `mode: set
+example.com/mod/api/mocks/a.go:1.2,2.3 2 1
+example.com/mod/internal/x/gen/b.go:1.2,2.3 3 1
+example.com/mod/internal/gen/c.go:1.2,2.3 4 1
+example.com/mod/d_string.go:1.2,2.3 5 1
+`
+	ctx := testdiag.Context(t)
+	opts := &TestOptions{ExcludeGlobs: []string{"**/mocks/*", "internal/*/gen", "*_string.go"}}
+	st, err := ReadProfile(ctx, strings.NewReader(prof), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := FileData{"example.com/mod/internal/gen/c.go": StmtCount{4, 4}}
+	if diff := cmp.Diff(want, ByFiles(ctx, st)); diff != "" {
+		t.Errorf("files (-want +got):\n%s", diff)
+	}
+
+	opts.ExcludeGlobs = []string{"["}
+	if _, err := ReadProfile(ctx, strings.NewReader(prof), opts); err == nil {
+		t.Error("invalid glob: got nil error")
+	}
+}
+
+func TestNoPackages(t *testing.T) {
+	const prof = `mode: set
+example.com/mod/gen/a.go:1.2,2.3 2 1
+`
+	ctx := testdiag.Context(t)
+	opts := &TestOptions{Excludes: []string{"gen"}}
+	st, err := ReadProfile(ctx, strings.NewReader(prof), opts)
+	if err != ErrNoPackages {
+		t.Errorf("read: got %v, want %v", err, ErrNoPackages)
+	}
+	if len(st) != 0 {
+		t.Errorf("read: got %v, want empty", st)
+	}
+
+	opts.AllowEmpty = true
+	if _, err := ReadProfile(ctx, strings.NewReader(prof), opts); err != nil {
+		t.Errorf("allow empty: got %v, want nil", err)
+	}
+}
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		pattern, file string
+		want          bool
+	}{
+		{"**/mocks/*", "example.com/mod/mocks/a.go", true},
+		{"**/mocks/*", "example.com/mod/mocks/sub/a.go", true},
+		{"mocks", "example.com/mod/mocks/a.go", true},
+		{"mocks", "example.com/mod/mocksy/a.go", false},
+		{"internal/**/gen", "example.com/mod/internal/gen/a.go", true},
+		{"internal/**/gen", "example.com/mod/internal/x/y/gen/a.go", true},
+		{"internal/*/gen", "example.com/mod/internal/x/y/gen/a.go", false},
+		{"example.com/mod/*.go", "example.com/mod/a.go", true},
+		{"mod/*.go", "example.com/mod/pkg/a.go", false},
+	}
+	for _, tt := range tests {
+		if got := MatchGlob(tt.pattern, tt.file); got != tt.want {
+			t.Errorf("MatchGlob(%q, %q): got %v, want %v", tt.pattern, tt.file, got, tt.want)
+		}
+	}
+}
+
+func TestAddUntested(t *testing.T) {
+	const pkg = "github.com/mutility/coverpkg/internal/coverage/testdata/funcs"
+	ctx := testdiag.Context(t)
+	opts := &TestOptions{Packages: []string{"./testdata/funcs"}}
+
+	files := FileData{"example.com/mod/a.go": StmtCount{2, 1}}
+	if err := AddUntested(ctx, files, opts); err != nil {
+		t.Fatal(err)
+	}
+	want := FileData{
+		"example.com/mod/a.go": StmtCount{2, 1},
+		pkg + "/funcs.go":      StmtCount{5, 0},
+	}
+	if diff := cmp.Diff(want, files); diff != "" {
+		t.Errorf("files (-want +got):\n%s", diff)
+	}
+
+	files = FileData{pkg + "/funcs.go": StmtCount{5, 3}}
+	if err := AddUntested(ctx, files, opts); err != nil || len(files) != 1 {
+		t.Errorf("tested package: got %v, %v, want it unchanged", files, err)
+	}
+
+	files = FileData{}
+	opts.Excludes = []string{"funcs"}
+	if err := AddUntested(ctx, files, opts); err != nil || len(files) != 0 {
+		t.Errorf("excluded package: got %v, %v, want none", files, err)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	ctx := testdiag.Context(t)
+	shards := []StatementData{
+		{{"example.com/mod/a/a.go:1.2,2.3", 2}: 1, {"example.com/mod/a/a.go:4.2,5.3", 1}: 0},
+		{{"example.com/mod/a/b.go:1.2,2.3", 3}: 1},
+		{{"example.com/mod/c/c.go:1.2,2.3", 4}: 0},
+	}
+
+	files := make([]FileData, len(shards))
+	pkgs := make([]PackageData, len(shards))
+	var wg sync.WaitGroup
+	for i, st := range shards {
+		wg.Add(1)
+		go func(i int, st StatementData) {
+			defer wg.Done()
+			files[i] = ByFiles(ctx, st)
+			pkgs[i] = ByPackage(ctx, files[i])
+		}(i, st)
+	}
+	wg.Wait()
+
+	fd, pd := FileData{}, PathData{}
+	for i := range shards {
+		fd = Merge(fd, files[i])
+		pd = MergePathData(pd, pkgs[i].PathData)
+	}
+	want := FileData{
+		"example.com/mod/a/a.go": {Count: 3, Covered: 2},
+		"example.com/mod/a/b.go": {Count: 3, Covered: 3},
+		"example.com/mod/c/c.go": {Count: 4, Covered: 0},
+	}
+	if diff := cmp.Diff(want, fd); diff != "" {
+		t.Errorf("files (-want +got):\n%s", diff)
+	}
+	wantpd := PathData{
+		"example.com/mod/a": {Count: 6, Covered: 5},
+		"example.com/mod/c": {Count: 4, Covered: 0},
+	}
+	if diff := cmp.Diff(wantpd, pd); diff != "" {
+		t.Errorf("packages (-want +got):\n%s", diff)
+	}
+	if len(files[0]) != 1 {
+		t.Errorf("merge modified its input: %v", files[0])
+	}
+}
+
+func TestByFunction(t *testing.T) {
+	const pkg = "github.com/mutility/coverpkg/internal/coverage/testdata/funcs"
+	const prof = `mode: set
+` + pkg + `/funcs.go:5.24,7.2 1 1
+` + pkg + `/funcs.go:9.22,11.2 1 0
+` + pkg + `/funcs.go:13.24,14.11 1 1
+` + pkg + `/funcs.go:14.11,16.3 1 0
+` + pkg + `/funcs.go:17.2,17.9 1 1
+` + pkg + `/funcs.go:20.14,20.15 0 0
+`
+	ctx := testdiag.Context(t)
+	st, err := ReadProfile(ctx, strings.NewReader(prof), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd, err := ByFunction(ctx, st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := FunctionData{PathData{
+		pkg + ".Add":      StmtCount{1, 1},
+		pkg + ".T.Get":    StmtCount{1, 0},
+		pkg + ".(*T).Set": StmtCount{3, 2},
+	}}
+	if diff := cmp.Diff(want, fd); diff != "" {
+		t.Errorf("byfunc (-want +got):\n%s", diff)
+	}
+
+	if diff := cmp.Diff(RootData{PathData{"github.com/mutility/coverpkg/internal": StmtCount{5, 3}}}, ByRoot(ctx, fd)); diff != "" {
+		t.Errorf("byroot (-want +got):\n%s", diff)
+	}
+}
+
+func TestWriteHTML(t *testing.T) {
+	const pkg = "github.com/mutility/coverpkg/internal/coverage/testdata/funcs"
+	const prof = `mode: set
+` + pkg + `/funcs.go:5.24,7.2 1 1
+` + pkg + `/funcs.go:9.22,11.2 1 0
+` + pkg + `/missing.go:1.1,2.2 1 0
+`
+	ctx := testdiag.Context(t)
+	st, err := ReadProfile(ctx, strings.NewReader(prof), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb := &strings.Builder{}
+	if err := WriteHTML(ctx, sb, st); err != nil {
+		t.Fatal(err)
+	}
+	got := sb.String()
+	for _, want := range []string{
+		`<h1>Coverage <span class="pct">33.33% (1 of 3)</span></h1>`,
+		`<h2>github.com/mutility/coverpkg/internal/... <span class="pct">33.33% (1 of 3)</span></h2>`,
+		`<h3>` + pkg + ` <span class="pct">33.33% (1 of 3)</span></h3>`,
+		"<pre>\n<span>package funcs</span>\n",
+		"\n<span class=\"cov\">func Add(a, b int) int {</span>\n",
+		"\n<span class=\"uncov\">\treturn t.n</span>\n",
+		"\n<span>func Empty() {}</span>\n",
+		"<summary>" + pkg + "/missing.go <span class=\"pct\">0.00% (0 of 1)</span></summary>\n<p>Source not found.</p>",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("html: missing %q", want)
+		}
+	}
+	if t.Failed() {
+		t.Log(got)
+	}
+}
+
+func TestUncovered(t *testing.T) {
+	const prof = `mode: set
+example.com/mod/b.go:3.4,5.6 1 0
+example.com/mod/a.go:7.2,8.3 2 0
+example.com/mod/a.go:1.2,2.3 2 1
+example.com/mod/a.go:4.2,4.9 1 0
+example.com/mod/a.go:9.1,9.2 0 0
+`
+	ctx := testdiag.Context(t)
+	st, err := ReadProfile(ctx, strings.NewReader(prof), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Span{
+		{"example.com/mod/a.go", 4, 2, 4, 9},
+		{"example.com/mod/a.go", 7, 2, 8, 3},
+		{"example.com/mod/b.go", 3, 4, 5, 6},
+	}
+	if diff := cmp.Diff(want, st.Uncovered()); diff != "" {
+		t.Errorf("uncovered (-want +got):\n%s", diff)
+	}
+}
+
+func TestByModuleDepth(t *testing.T) {
+	ctx := testdiag.Context(t)
+	pkgs := PackageData{PathData{
+		"example.com/team/group/project/a": StmtCount{10, 5},
+		"example.com/team/group/project/b": StmtCount{10, 3},
+		"example.com/team/other/c":         StmtCount{4, 4},
+	}}
+
+	want := ModuleData{PathData{
+		"example.com/team/group/project": StmtCount{20, 8},
+		"example.com/team/other/c":       StmtCount{4, 4},
+	}}
+	if diff := cmp.Diff(want, ByModuleDepth(ctx, pkgs, 4)); diff != "" {
+		t.Errorf("depth 4 (-want +got):\n%s", diff)
+	}
+
+	want = ModuleData{PathData{
+		"example.com/team/group": StmtCount{20, 8},
+		"example.com/team/other": StmtCount{4, 4},
+	}}
+	if diff := cmp.Diff(want, ByModule(ctx, pkgs)); diff != "" {
+		t.Errorf("default (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(want, ByModuleDepth(ctx, pkgs, 0)); diff != "" {
+		t.Errorf("depth 0 (-want +got):\n%s", diff)
+	}
+
+	if got := module("example.com/team/group/project").Depth(); got != 4 {
+		t.Errorf("depth: got %d, want 4", got)
+	}
+}
+
+func TestByModuleResolved(t *testing.T) {
+	setModules([]string{"example.com/team", "example.com/team/group/project"})
+	defer setModules(nil)
+
+	ctx := testdiag.Context(t)
+	pkgs := PackageData{PathData{
+		"example.com/team/group/project/a": StmtCount{10, 5},
+		"example.com/team/group/project/b": StmtCount{10, 3},
+		"example.com/team/other/c":         StmtCount{4, 4},
+		"example.org/x/y/z":                StmtCount{2, 1},
+	}}
+
+	want := ModuleData{PathData{
+		"example.com/team/group/project": StmtCount{20, 8},
+		"example.com/team":               StmtCount{4, 4},
+		"example.org/x/y":                StmtCount{2, 1},
+	}}
+	if diff := cmp.Diff(want, ByModule(ctx, pkgs)); diff != "" {
+		t.Errorf("ByModule (-want +got):\n%s", diff)
+	}
+
+	if got, want := pathmod(ctx, "example.com/team/group/project/a/a.go"), "example.com/team/group/project"; got != want {
+		t.Errorf("pathmod: got %q, want %q", got, want)
+	}
+	if got, want := pathmod(ctx, "example.com/teamwork/a/a.go"), "example.com/teamwork"; got != want {
+		t.Errorf("pathmod: got %q, want %q", got, want)
+	}
+}
+
+func TestResolveModulesRetries(t *testing.T) {
+	defer func() {
+		setModules(nil)
+		modules.resolved = false
+	}()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := testdiag.Context(t)
+
+	// outside any module go list fails, and the failure is not kept
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("GOWORK", "off")
+	err = ResolveModules(ctx)
+	if err := os.Chdir(wd); err != nil {
+		t.Fatal(err)
+	}
+	if err == nil {
+		t.Fatal("resolving outside a module: got nil, want an error")
+	}
+
+	if err := ResolveModules(ctx); err != nil {
+		t.Fatalf("resolving again: %v", err)
+	}
+	if got, ok := findModule("github.com/mutility/coverpkg/internal/coverage"); !ok || got != "github.com/mutility/coverpkg" {
+		t.Errorf("findModule: got %q, %v, want github.com/mutility/coverpkg", got, ok)
+	}
+}
+
+func TestWorkspace(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs go test")
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir("testdata/workspace"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	t.Setenv("GOFLAGS", "")
+	t.Setenv("GOWORK", "")
+
+	ctx := testdiag.Context(t)
+	files, err := CollectFiles(ctx, &TestOptions{Workspace: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := FileData{
+		"example.com/a/a.go": StmtCount{3, 2},
+		"example.com/b/b.go": StmtCount{1, 1},
+	}
+	if diff := cmp.Diff(want, files); diff != "" {
+		t.Errorf("files (-want +got):\n%s", diff)
+	}
+}
+
+// grouped is an EachPather at an arbitrary grouping.
+type grouped struct {
+	PathData
+	grp Grouping
+}
+
+func (g grouped) Grouping() Grouping { return g.grp }
+
+func TestDiffGroupings(t *testing.T) {
+	ctx := testdiag.Context(t)
+	files := FileData{
+		"example.com/mod/a/a.go": StmtCount{4, 2},
+		"example.com/mod/b/b.go": StmtCount{4, 4},
+	}
+	levels := []EachPather{
+		grouped{PathData{"example.com/mod/a:1.1,2.1": StmtCount{1, 1}}, StatementGrouping},
+		FunctionData{PathData{"example.com/mod/a.A": StmtCount{4, 2}}},
+		files,
+		ByPackage(ctx, files),
+		ByRoot(ctx, files),
+		ByModule(ctx, files),
+	}
+
+	for _, old := range levels {
+		for _, new := range levels {
+			oldGrp, newGrp := old.Grouping(), new.Grouping()
+			grp := oldGrp
+			if newGrp > grp {
+				grp = newGrp
+			}
+			name := oldGrp.String() + "-" + newGrp.String()
+			delta, err := Diff(ctx, old, new)
+
+			switch {
+			case oldGrp <= FunctionGrouping && newGrp <= FileGrouping,
+				newGrp <= FunctionGrouping && oldGrp <= FileGrouping:
+				want := GroupingError{Old: oldGrp, New: newGrp}
+				if err != want {
+					t.Errorf("%s: got %v, want %v", name, err, want)
+				}
+			case err != nil:
+				t.Errorf("%s: %v", name, err)
+			case delta.Grouping() != grp:
+				t.Errorf("%s: got %v, want %v", name, delta.Grouping(), grp)
+			}
+		}
+	}
+}
+
+func TestDiffStatements(t *testing.T) {
+	const base = `mode: set
+example.com/mod/a/a.go:1.2,2.3 2 1
+example.com/mod/a/b.go:1.2,2.3 2 0
+`
+	const head = `mode: set
+example.com/mod/a/a.go:1.2,2.3 2 1
+example.com/mod/a/b.go:1.2,2.3 2 1
+example.com/mod/c/c.go:1.2,2.3 1 0
+`
+	ctx := testdiag.Context(t)
+	old, err := ReadProfile(ctx, strings.NewReader(base), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	new, err := ReadProfile(ctx, strings.NewReader(head), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	delta, err := DiffStatements(ctx, old, new, "package")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := PackageDelta{map[string]StmtDelta{
+		"example.com/mod/a": {BaseCount: 4, BaseCovered: 2, HeadCount: 4, HeadCovered: 4},
+		"example.com/mod/c": {HeadCount: 1},
+	}}
+	if diff := cmp.Diff(want, delta); diff != "" {
+		t.Errorf("delta (-want +got):\n%s", diff)
+	}
+
+	if _, err := DiffStatements(ctx, old, new, "function"); err == nil {
+		t.Error("function: got nil, want error")
+	}
+}
+
+func TestNoTestFiles(t *testing.T) {
+	const prof = `mode: set
+example.com/mod/a.go:3.10,5.2 2 1
+example.com/mod/helper_test.go:4.2,6.3 3 0
+`
+	ctx := testdiag.Context(t)
+	for _, tt := range []struct {
+		skip bool
+		want FileData
+	}{
+		{false, FileData{"example.com/mod/a.go": {2, 2}, "example.com/mod/helper_test.go": {3, 0}}},
+		{true, FileData{"example.com/mod/a.go": {2, 2}}},
+	} {
+		st, err := ReadProfile(ctx, strings.NewReader(prof), &TestOptions{NoTestFiles: tt.skip})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(tt.want, ByFiles(ctx, st)); diff != "" {
+			t.Errorf("NoTestFiles %v (-want +got):\n%s", tt.skip, diff)
+		}
+	}
+}
+
+func TestUncoveredLines(t *testing.T) {
+	const prof = `mode: set
+example.com/mod/a.go:3.10,5.2 2 0
+example.com/mod/a.go:6.2,6.20 1 0
+example.com/mod/a.go:8.2,9.3 1 1
+example.com/mod/a.go:12.2,12.9 1 0
+example.com/mod/b.go:4.2,4.9 1 0
+`
+	ctx := testdiag.Context(t)
+	st, err := ReadProfile(ctx, strings.NewReader(prof), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Span{
+		{"example.com/mod/a.go", 3, 10, 6, 20},
+		{"example.com/mod/a.go", 12, 2, 12, 9},
+		{"example.com/mod/b.go", 4, 2, 4, 9},
+	}
+	if diff := cmp.Diff(want, st.UncoveredLines()); diff != "" {
+		t.Errorf("lines (-want +got):\n%s", diff)
+	}
+}
+
+func TestSkipGenerated(t *testing.T) {
+	const pkg = "github.com/mutility/coverpkg/internal/coverage/testdata/skipgen"
+	const prof = `mode: set
+` + pkg + `/gen.go:5.18,5.28 1 0
+` + pkg + `/plain.go:4.20,4.30 1 1
+`
+	ctx := testdiag.Context(t)
+	st, err := ReadProfile(ctx, strings.NewReader(prof), &TestOptions{SkipGenerated: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := FileData{pkg + "/plain.go": StmtCount{1, 1}}
+	if diff := cmp.Diff(want, ByFiles(ctx, st)); diff != "" {
+		t.Errorf("files (-want +got):\n%s", diff)
+	}
+
+	st, err = ReadProfile(ctx, strings.NewReader(prof), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(st) != 2 {
+		t.Errorf("statements: got %d, want 2", len(st))
+	}
+}
+
+func TestBuildTags(t *testing.T) {
+	const pkg = "github.com/mutility/coverpkg/internal/coverage/testdata/tags"
+	const prof = `mode: set
+` + pkg + `/integration.go:5.26,5.36 1 0
+` + pkg + `/plain.go:4.20,4.30 1 1
+example.com/missing/m.go:1.1,1.2 1 0
+`
+	ctx := testdiag.Context(t)
+	st, err := ReadProfile(ctx, strings.NewReader(prof), &TestOptions{BuildTags: []string{"unit"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := FileData{
+		pkg + "/plain.go":          StmtCount{1, 1},
+		"example.com/missing/m.go": StmtCount{1, 0},
+	}
+	if diff := cmp.Diff(want, ByFiles(ctx, st)); diff != "" {
+		t.Errorf("files (-want +got):\n%s", diff)
+	}
+
+	st, err = ReadProfile(ctx, strings.NewReader(prof), &TestOptions{BuildTags: []string{"unit", "integration"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(st) != 3 {
+		t.Errorf("statements: got %d, want 3", len(st))
+	}
+}
+
+func TestJobs(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs go test")
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir("testdata/jobs"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	t.Setenv("GOFLAGS", "")
+	t.Setenv("GOWORK", "off")
+
+	ctx := testdiag.Context(t)
+	want, err := CollectFiles(ctx, &TestOptions{CoverMode: "count"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := want["example.com/jobs/two/b/b.go"]; got != (StmtCount{3, 2}) {
+		t.Errorf("b.go: got %v, want {3 2}", got)
+	}
+
+	got, err := CollectFiles(ctx, &TestOptions{CoverMode: "count", Jobs: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("files (-single +jobs):\n%s", diff)
+	}
+
+	if _, err := CollectFiles(ctx, &TestOptions{Workspace: true, Jobs: 2}); err != errWorkspaceJobs {
+		t.Errorf("workspace jobs: got %v, want %v", err, errWorkspaceJobs)
+	}
+}
+
+func TestTestFailureOutput(t *testing.T) {
+	ctx := testdiag.Context(t)
+	script := `for i in $(seq 1 30); do echo line $i >&2; done; exit 1`
+	_, err := CollectFiles(ctx, &TestOptions{TestRunner: []string{"sh", "-c", script, "sh"}})
+	if err == nil {
+		t.Fatal("got nil, want error")
+	}
+	lines := strings.Split(err.Error(), "\n")
+	if len(lines) != failureLines+1 || lines[0] != "tests failed: exit status 1" || lines[failureLines] != "line 30" {
+		t.Errorf("got %q", err)
+	}
+	var terr *TestRunError
+	var exit *exec.ExitError
+	if !errors.As(err, &terr) || terr.ExitCode != 1 || terr.BuildFailed() || !errors.As(err, &exit) {
+		t.Errorf("got %#v, want a TestRunError with exit code 1 wrapping an ExitError", err)
+	}
+
+	// the build failure scrolls out of the kept output, but is still reported
+	script = `echo 'FAIL	m [build failed]'; for i in $(seq 1 30); do echo line $i; done; exit 1`
+	_, err = CollectFiles(ctx, &TestOptions{TestRunner: []string{"sh", "-c", script, "sh"}})
+	if !errors.As(err, &terr) || !terr.BuildFailed() || !strings.HasPrefix(err.Error(), "build failed: exit status 1\nline 11\n") {
+		t.Errorf("build: got %v, want a build failure", err)
+	}
+	if n := strings.Count(terr.Output, "\n"); n != failureLines {
+		t.Errorf("build: got %d lines of output, want %d", n, failureLines)
+	}
+
+	_, err = CollectFiles(ctx, &TestOptions{TestRunner: []string{"coverpkg-no-such-runner"}})
+	if !errors.As(err, &terr) || terr.ExitCode != -1 || errors.As(err, &exit) {
+		t.Errorf("missing runner: got %#v, want a TestRunError with exit code -1", err)
+	}
+
+	w := &tailWriter{n: 2}
+	for _, p := range []string{"a\nb", "\nc\n", "d"} {
+		w.Write([]byte(p))
+	}
+	if got := w.String(); got != "b\nc\nd" {
+		t.Errorf("tailWriter: got %q, want last 2 lines and the unterminated one", got)
+	}
+
+	if got := lastLines("", 2); got != "" {
+		t.Errorf("lastLines empty: got %q", got)
+	}
+	if got := lastLines("a\nb\n", 3); got != "a\nb" {
+		t.Errorf("lastLines short: got %q", got)
+	}
+}
+
+func TestCoverPkgs(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs go test")
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir("testdata/jobs"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	t.Setenv("GOFLAGS", "")
+	t.Setenv("GOWORK", "off")
+
+	ctx := testdiag.Context(t)
+	files, err := CollectFiles(ctx, &TestOptions{Packages: []string{"one/a"}, CoverPkgs: []string{"two/b"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := FileData{"example.com/jobs/two/b/b.go": StmtCount{3, 1}}
+	if diff := cmp.Diff(want, files); diff != "" {
+		t.Errorf("files (-want +got):\n%s", diff)
+	}
+}
+
+func TestValidateProfile(t *testing.T) {
+	const prof = `example.com/a.go:1.2,3.4 1 0
+example.com/a.go:1.2,3.4 x 0
+broken
+example.com/a.go:1.2 1 1
+`
+	errs, err := ValidateProfile(strings.NewReader(prof))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ProfileError{
+		{1, "example.com/a.go:1.2,3.4 1 0", "missing mode line"},
+		{2, "example.com/a.go:1.2,3.4 x 0", "invalid fields"},
+		{3, "broken", "invalid line"},
+		{4, "example.com/a.go:1.2 1 1", "invalid position"},
+	}
+	if diff := cmp.Diff(want, errs); diff != "" {
+		t.Errorf("errors (-want +got):\n%s", diff)
+	}
+
+	errs, err = ValidateProfile(strings.NewReader("mode: set\n" + prof[:29]))
+	if err != nil || len(errs) != 0 {
+		t.Errorf("valid: got %v, %v", errs, err)
+	}
+}
+
+func TestNote(t *testing.T) {
+	files := FileData{"example.com/mod/a.go": StmtCount{4, 2}}
+	for _, tt := range []struct {
+		name string
+		json string
+		want Note
+	}{
+		{"bare", `{"example.com/mod/a.go":{"Count":4,"Covered":2}}`, Note{Files: files}},
+		{"v1", `{"version":1,"mode":"count","data":{"example.com/mod/a.go":{"Count":4,"Covered":2}}}`, Note{Mode: "count", Files: files}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var got Note
+			if err := json.Unmarshal([]byte(tt.json), &got); err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("note (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	buf, err := json.Marshal(Note{Mode: "set", Files: files})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"version":1,"mode":"set","data":{"example.com/mod/a.go":{"Count":4,"Covered":2}}}`; string(buf) != want {
+		t.Errorf("marshal: got %s, want %s", buf, want)
+	}
+	if err := json.Unmarshal([]byte(`{"version":2,"data":{}}`), &Note{}); err != errNoteVersion(2) {
+		t.Errorf("version 2: got %v, want %v", err, errNoteVersion(2))
+	}
+	if err := json.Unmarshal([]byte(`{"mode":"count","files":{}}`), &Note{}); err == nil {
+		t.Error("unversioned mode: got nil, want error")
+	}
+
+	for flags, want := range map[string]string{
+		"":                           "set",
+		"-v -race":                   "atomic",
+		"-race -covermode=count":     "count",
+		"--covermode set -race=true": "set",
+	} {
+		if got := (&TestOptions{Flags: strings.Fields(flags)}).Mode(); got != want {
+			t.Errorf("mode %q: got %s, want %s", flags, got, want)
+		}
+	}
+	if got := (&TestOptions{CoverMode: "count", Flags: []string{"-race"}}).Mode(); got != "count" {
+		t.Errorf("mode count: got %s, want count", got)
+	}
+}
+
+func TestUncoveredByAuthor(t *testing.T) {
+	const pkg = "github.com/mutility/coverpkg/internal/coverage/testdata/funcs"
+	const prof = `mode: set
+` + pkg + `/funcs.go:5.24,7.2 1 0
+` + pkg + `/funcs.go:9.22,11.2 1 0
+` + pkg + `/funcs.go:13.24,14.11 2 0
+` + pkg + `/funcs.go:14.11,16.3 1 1
+` + pkg + `/funcs.go:17.2,17.9 1 0
+`
+	ctx := testdiag.Context(t)
+	st, err := ReadProfile(ctx, strings.NewReader(prof), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authors := func(file string) (map[int]string, error) {
+		if filepath.Base(file) != "funcs.go" {
+			t.Errorf("authors: got %s, want funcs.go", file)
+		}
+		return map[int]string{5: "ann", 9: "bob", 13: "bob", 17: "cy"}, nil
+	}
+	got, err := UncoveredByAuthor(ctx, st, authors)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []AuthorCount{{"bob", 3}, {"ann", 1}, {"cy", 1}}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("by author (-want +got):\n%s", diff)
+	}
+}
+
+func TestReadTokens(t *testing.T) {
+	const in = `# generated code
+gen
+  mocks  # test doubles
+
+internal/testdata
+`
+	got, err := ReadTokens(strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"gen", "mocks", "internal/testdata"}, got); diff != "" {
+		t.Errorf("tokens (-want +got):\n%s", diff)
+	}
+}
+
+func TestAppendExcludeFile(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "excludes")
+	if err := os.WriteFile(name, []byte("gen # generated\nmocks\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := AppendExcludeFile([]string{"vendor"}, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"vendor", "gen", "mocks"}, got); diff != "" {
+		t.Errorf("excludes (-want +got):\n%s", diff)
+	}
+
+	if got, err := AppendExcludeFile([]string{"vendor"}, ""); err != nil || len(got) != 1 {
+		t.Errorf("no file: got %v, %v; want [vendor], nil", got, err)
+	}
+	if _, err := AppendExcludeFile(nil, name+".missing"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("missing file: got %v, want %v", err, os.ErrNotExist)
+	}
+}
+
+func TestPackageArgs(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir("testdata/jobs"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	got := packageArgs([]string{".", "one", "./two/", "./one/...", "example.com/jobs/two/...", "example.com/jobs/one/a", "missing"}, "")
+	want := []string{"./...", "./one/...", "./two/...", "./one/...", "example.com/jobs/two/...", "example.com/jobs/one/a", "missing"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("args (-want +got):\n%s", diff)
+	}
+
+	got = packageArgs([]string{"jobs", "./jobs/one/..."}, "..")
+	want = []string{"./jobs/...", "./jobs/one/..."}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("args in dir (-want +got):\n%s", diff)
+	}
+}
+
+func TestExternalTestPackage(t *testing.T) {
+	// Files of an external test package sit in the directory of the package
+	// it tests, while a package in a foo_test directory is its own.
+	const prof = "mode: set\n" +
+		"example.com/mod/foo/foo.go:3.14,5.2 2 1\n" +
+		"example.com/mod/foo/helper_test.go:4.20,6.2 1 0\n" +
+		"example.com/mod/foo_test/e2e.go:3.14,5.2 4 1\n" +
+		"example.com/mod/bar/bar.go:3.14,5.2 1 1\n"
+
+	ctx := testdiag.Context(t)
+	st, err := ReadProfile(ctx, strings.NewReader(prof), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := PackageData{PathData{
+		"example.com/mod/foo":      StmtCount{3, 2},
+		"example.com/mod/foo_test": StmtCount{4, 4},
+		"example.com/mod/bar":      StmtCount{1, 1},
+	}}
+	if diff := cmp.Diff(want, ByPackage(ctx, st)); diff != "" {
+		t.Errorf("bypkg (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(want, ByPackage(ctx, ByFiles(ctx, st))); diff != "" {
+		t.Errorf("bypkg of files (-want +got):\n%s", diff)
+	}
+}
+
+func TestKeepProfile(t *testing.T) {
+	ctx := testdiag.Context(t)
+	kept := filepath.Join(t.TempDir(), "cover.out")
+	script := `printf 'mode: set\nm/a.go:1.1,2.2 1 1\n' > "$2"; exit $0`
+
+	for _, exit := range []string{"0", "1"} {
+		os.Remove(kept)
+		files, err := CollectFiles(ctx, &TestOptions{CoverProfile: kept, TestRunner: []string{"sh", "-c", script, exit}})
+		if (err != nil) != (exit != "0") {
+			t.Errorf("exit %s: got %v", exit, err)
+		}
+		if exit == "0" && files["m/a.go"] != (StmtCount{1, 1}) {
+			t.Errorf("exit %s: got %v, want m/a.go covered", exit, files)
+		}
+		if _, err := os.Stat(kept); err != nil {
+			t.Errorf("exit %s: profile not kept: %v", exit, err)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package coverage
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mutility/diag"
+)
+
+// EachPackage reports each function under its package. Package paths are
+// assumed not to contain a '.' in their final element.
+func (fd FunctionData) EachPackage(fn func(path string, count int, covered int)) {
+	for k, v := range fd.PathData {
+		fn(funcpkg(k), v.Count, v.Covered)
+	}
+}
+
+func (fd FunctionData) EachModule(fn func(path string, count int, covered int)) {
+	for k, v := range fd.PathData {
+		fn(pathmod(nil, funcpkg(k)), v.Count, v.Covered)
+	}
+}
+
+func funcpkg(fn string) string {
+	n := strings.LastIndexByte(fn, '/') + 1
+	if d := strings.IndexByte(fn[n:], '.'); d >= 0 {
+		return fn[:n+d]
+	}
+	return fn
+}
+
+// ByFunction groups statements by the function that contains them, keyed as
+// pkg.Func, pkg.Type.Method, or pkg.(*Type).Method. As profiles only record
+// import paths, this locates and parses the source files with go list.
+// Statements outside any function, and functions without statements, are
+// omitted.
+func ByFunction(ctx diag.Context, stmts StatementData) (FunctionData, error) {
+	files := make(map[string][]stmt)
+	pkgs := make(map[string]bool)
+	for k := range stmts {
+		f := k.file()
+		files[f] = append(files[f], k)
+		pkgs[pathpkg(ctx, f)] = true
+	}
+
+	dirs, err := packageDirs(ctx, pkgs)
+	if err != nil {
+		return FunctionData{}, err
+	}
+
+	fd := make(PathData)
+	for file, fstmts := range files {
+		pkg := pathpkg(ctx, file)
+		dir, ok := dirs[pkg]
+		if !ok {
+			diag.Debug(ctx, "can't find source for:", file)
+			continue
+		}
+		funcs, err := funcExtents(filepath.Join(dir, filepath.Base(file)))
+		if err != nil {
+			return FunctionData{}, err
+		}
+		for _, s := range fstmts {
+			_, pos := s.loc()
+			b, err := parseBlock(pos)
+			if err != nil {
+				diag.Debug(ctx, "invalid position:", s.filepos)
+				continue
+			}
+			for _, f := range funcs {
+				if f.contains(b) {
+					if s.count > 0 {
+						key := pkg + "." + f.name
+						cc := fd[key]
+						cc.Count += s.count
+						cc.Covered += s.covered(stmts[s])
+						fd[key] = cc
+					}
+					break
+				}
+			}
+		}
+	}
+	return FunctionData{fd}, nil
+}
+
+// packageDirs maps import paths to their source directories.
+func packageDirs(ctx diag.Context, pkgs map[string]bool) (map[string]string, error) {
+	args := []string{"list", "-e", "-f", "{{.ImportPath}}\t{{.Dir}}"}
+	for pkg := range pkgs {
+		args = append(args, pkg)
+	}
+	sort.Strings(args[4:])
+
+	diag.Debug(ctx, "exec> go", strings.Join(args, " "))
+	out, err := exec.CommandContext(ctx, "go", args...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("go list: %w", err)
+	}
+
+	dirs := make(map[string]string)
+	scan := bufio.NewScanner(bytes.NewReader(out))
+	for scan.Scan() {
+		pkg, dir, ok := strings.Cut(scan.Text(), "\t")
+		if ok && dir != "" {
+			dirs[pkg] = dir
+		}
+	}
+	return dirs, scan.Err()
+}
+
+// block is the extent of a statement block or function.
+type block struct {
+	startLine, startCol int
+	endLine, endCol     int
+}
+
+// parseBlock parses a statement position like "1.2,3.4".
+func parseBlock(pos string) (block, error) {
+	var b block
+	var err error
+	start, end, _ := strings.Cut(pos, ",")
+	if b.startLine, b.startCol, err = parseLineCol(start); err != nil {
+		return b, err
+	}
+	b.endLine, b.endCol, err = parseLineCol(end)
+	return b, err
+}
+
+func parseLineCol(lc string) (line, col int, err error) {
+	l, c, _ := strings.Cut(lc, ".")
+	if line, err = strconv.Atoi(l); err != nil {
+		return 0, 0, err
+	}
+	col, err = strconv.Atoi(c)
+	return line, col, err
+}
+
+func (b block) contains(o block) bool {
+	after := o.startLine > b.startLine || (o.startLine == b.startLine && o.startCol >= b.startCol)
+	before := o.endLine < b.endLine || (o.endLine == b.endLine && o.endCol <= b.endCol)
+	return after && before
+}
+
+type funcExtent struct {
+	block
+	name string
+}
+
+// funcExtents parses a go source file for its functions.
+func funcExtents(file string) ([]funcExtent, error) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, file, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	var funcs []funcExtent
+	for _, decl := range f.Decls {
+		fn, ok := decl.(*ast.FuncDecl)
+		if !ok || fn.Body == nil {
+			continue
+		}
+		start, end := fset.Position(fn.Pos()), fset.Position(fn.End())
+		funcs = append(funcs, funcExtent{
+			block: block{start.Line, start.Column, end.Line, end.Column},
+			name:  funcName(fn),
+		})
+	}
+	return funcs, nil
+}
+
+func funcName(fn *ast.FuncDecl) string {
+	if fn.Recv == nil || len(fn.Recv.List) == 0 {
+		return fn.Name.Name
+	}
+	typ := fn.Recv.List[0].Type
+	ptr := false
+	if star, ok := typ.(*ast.StarExpr); ok {
+		typ, ptr = star.X, true
+	}
+	switch t := typ.(type) {
+	case *ast.IndexExpr:
+		typ = t.X
+	case *ast.IndexListExpr:
+		typ = t.X
+	}
+	recv := "?"
+	if id, ok := typ.(*ast.Ident); ok {
+		recv = id.Name
+	}
+	if ptr {
+		return "(*" + recv + ")." + fn.Name.Name
+	}
+	return recv + "." + fn.Name.Name
+}
@@ -0,0 +1,80 @@
+package coverage
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/mutility/diag"
+)
+
+// generatedHeader matches the comment that marks a generated Go file.
+// See https://golang.org/s/generatedcode.
+var generatedHeader = regexp.MustCompile(`^// Code generated .* DO NOT EDIT\.$`)
+
+// skipGenerated removes statements in generated files from stmts. As profiles
+// only record import paths, this locates the source files with go list, and
+// reads each file's header once.
+func skipGenerated(ctx diag.Context, stmts StatementData) error {
+	files := make(map[string]bool)
+	pkgs := make(map[string]bool)
+	for k := range stmts {
+		f := k.file()
+		files[f] = false
+		pkgs[pathpkg(ctx, f)] = true
+	}
+	if len(files) == 0 {
+		return nil
+	}
+
+	dirs, err := packageDirs(ctx, pkgs)
+	if err != nil {
+		return err
+	}
+	for file := range files {
+		dir, ok := dirs[pathpkg(ctx, file)]
+		if !ok {
+			diag.Debug(ctx, "can't find source for:", file)
+			continue
+		}
+		gen, err := isGenerated(filepath.Join(dir, filepath.Base(file)))
+		if err != nil {
+			return err
+		}
+		if gen {
+			diag.Debug(ctx, "skipping generated:", file)
+		}
+		files[file] = gen
+	}
+
+	for k := range stmts {
+		if files[k.file()] {
+			delete(stmts, k)
+		}
+	}
+	return nil
+}
+
+// isGenerated reports if the Go file at name has a generated code comment
+// before its package clause.
+func isGenerated(name string) (bool, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	scan := bufio.NewScanner(f)
+	for scan.Scan() {
+		line := scan.Text()
+		if generatedHeader.MatchString(line) {
+			return true, nil
+		}
+		if strings.HasPrefix(line, "package ") {
+			break
+		}
+	}
+	return false, scan.Err()
+}
@@ -0,0 +1,184 @@
+package coverage
+
+import (
+	"bufio"
+	"bytes"
+	"html/template"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/mutility/diag"
+)
+
+type (
+	htmlReport struct {
+		Counts
+		Roots []*htmlRoot
+	}
+	htmlRoot struct {
+		Counts
+		Path     string
+		Packages []*htmlPackage
+	}
+	htmlPackage struct {
+		Counts
+		Path  string
+		Files []*htmlFile
+	}
+	htmlFile struct {
+		Counts
+		Path  string
+		Lines []htmlLine // nil if source was not found
+	}
+	htmlLine struct {
+		Class string // "cov", "uncov", or empty if no statements start or end here
+		Text  string
+	}
+)
+
+// WriteHTML writes an HTML document showing the source of each file with
+// covered lines in green and uncovered lines in red, grouped by root and
+// package. A line touched by both covered and uncovered statements is shown
+// as uncovered. Sources are located with go list; files that cannot be found
+// are listed without source.
+func WriteHTML(ctx diag.Context, w io.Writer, stmts StatementData) error {
+	type fileStmts struct {
+		Counts
+		blocks map[block]bool
+	}
+	files := make(map[string]*fileStmts)
+	pkgs := make(map[string]bool)
+	for k, hits := range stmts {
+		path, pos := k.loc()
+		f := files[path]
+		if f == nil {
+			f = &fileStmts{blocks: make(map[block]bool)}
+			files[path] = f
+			pkgs[pathpkg(ctx, path)] = true
+		}
+		f.add(Counts{Covered: k.covered(hits), Total: k.count})
+		if b, err := parseBlock(pos); err == nil && k.count > 0 {
+			f.blocks[b] = f.blocks[b] || hits > 0
+		}
+	}
+
+	dirs, err := packageDirs(ctx, pkgs)
+	if err != nil {
+		return err
+	}
+
+	paths := make([]string, 0, len(files))
+	for path := range files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	rep := &htmlReport{}
+	roots := make(map[string]*htmlRoot)
+	hpkgs := make(map[string]*htmlPackage)
+	for _, path := range paths {
+		f := files[path]
+		pkgPath := pathpkg(ctx, path)
+		pkg := hpkgs[pkgPath]
+		if pkg == nil {
+			rootPath := pathroot(ctx, pkgPath)
+			root := roots[rootPath]
+			if root == nil {
+				root = &htmlRoot{Path: rootPath}
+				roots[rootPath] = root
+				rep.Roots = append(rep.Roots, root)
+			}
+			pkg = &htmlPackage{Path: pkgPath}
+			hpkgs[pkgPath] = pkg
+			root.Packages = append(root.Packages, pkg)
+		}
+
+		hf := &htmlFile{Counts: f.Counts, Path: path}
+		if dir, ok := dirs[pkgPath]; ok {
+			hf.Lines, err = htmlLines(filepath.Join(dir, filepath.Base(path)), f.blocks)
+			if err != nil {
+				diag.Debug(ctx, "reading source:", err)
+			}
+		}
+		pkg.Files = append(pkg.Files, hf)
+		pkg.add(f.Counts)
+		roots[pathroot(ctx, pkgPath)].add(f.Counts)
+		rep.add(f.Counts)
+	}
+
+	sort.Slice(rep.Roots, func(i, j int) bool { return rep.Roots[i].Path < rep.Roots[j].Path })
+	for _, root := range rep.Roots {
+		sort.Slice(root.Packages, func(i, j int) bool { return root.Packages[i].Path < root.Packages[j].Path })
+	}
+
+	return htmlTemplate.Execute(w, rep)
+}
+
+// htmlLines reads file and classifies each line by the blocks that touch it.
+func htmlLines(file string, blocks map[block]bool) ([]htmlLine, error) {
+	src, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	uncov := make(map[int]bool)
+	for b, covered := range blocks {
+		for l := b.startLine; l <= b.endLine; l++ {
+			uncov[l] = uncov[l] || !covered
+		}
+	}
+
+	var lines []htmlLine
+	scan := bufio.NewScanner(bytes.NewReader(src))
+	for n := 1; scan.Scan(); n++ {
+		line := htmlLine{Text: scan.Text()}
+		if u, ok := uncov[n]; ok {
+			line.Class = "cov"
+			if u {
+				line.Class = "uncov"
+			}
+		}
+		lines = append(lines, line)
+	}
+	return lines, scan.Err()
+}
+
+var htmlTemplate = template.Must(template.New("html").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>coverpkg</title>
+<style>
+body { font-family: sans-serif; }
+pre { background: #fafafa; padding: 0.5em; }
+.cov { background: #d4f7d4; }
+.uncov { background: #f7d4d4; }
+.pct { color: #666; font-weight: normal; }
+</style>
+</head>
+<body>
+<h1>Coverage <span class="pct">{{ .Percent | printf "%.2f%%" }} ({{ .Covered }} of {{ .Total }})</span></h1>
+{{- range .Roots }}
+<h2>{{ .Path }}/... <span class="pct">{{ .Percent | printf "%.2f%%" }} ({{ .Covered }} of {{ .Total }})</span></h2>
+{{- range .Packages }}
+<h3>{{ .Path }} <span class="pct">{{ .Percent | printf "%.2f%%" }} ({{ .Covered }} of {{ .Total }})</span></h3>
+{{- range .Files }}
+<details>
+<summary>{{ .Path }} <span class="pct">{{ .Percent | printf "%.2f%%" }} ({{ .Covered }} of {{ .Total }})</span></summary>
+{{- if .Lines }}
+<pre>
+{{- range .Lines }}
+<span{{ with .Class }} class="{{ . }}"{{ end }}>{{ .Text }}</span>
+{{- end }}
+</pre>
+{{- else }}
+<p>Source not found.</p>
+{{- end }}
+</details>
+{{- end }}
+{{- end }}
+{{- end }}
+</body>
+</html>
+`))
@@ -0,0 +1,46 @@
+package coverage
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// WriteLCOV writes statement coverage as an LCOV tracefile, with a DA record
+// for every line a block spans. A line spanned by several blocks is counted
+// once, with the highest hit count among them, so it is covered if any of
+// them is.
+func WriteLCOV(w io.Writer, stmts StatementData) error {
+	files := lineHits(stmts)
+
+	paths := make([]string, 0, len(files))
+	for path := range files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "TN:")
+	for _, path := range paths {
+		lines := files[path]
+		nums := make([]int, 0, len(lines))
+		for n := range lines {
+			nums = append(nums, n)
+		}
+		sort.Ints(nums)
+
+		hit := 0
+		fmt.Fprintf(bw, "SF:%s\n", path)
+		for _, n := range nums {
+			if lines[n] > 0 {
+				hit++
+			}
+			fmt.Fprintf(bw, "DA:%d,%d\n", n, lines[n])
+		}
+		fmt.Fprintf(bw, "LF:%d\n", len(nums))
+		fmt.Fprintf(bw, "LH:%d\n", hit)
+		fmt.Fprintln(bw, "end_of_record")
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,69 @@
+package coverage
+
+import (
+	"strconv"
+	"strings"
+)
+
+// LineData records coverage by source line, keyed by file:line. Each line a
+// statement block spans counts once, and is covered if any block on it is
+// covered, as line-rate formats such as Cobertura and LCOV expect.
+type LineData map[string]StmtCount
+
+// ByLines groups statements by the lines each block spans.
+func ByLines(stmts StatementData) LineData {
+	ld := make(LineData)
+	for path, lines := range lineHits(stmts) {
+		for line, hits := range lines {
+			cc := StmtCount{Count: 1}
+			if hits > 0 {
+				cc.Covered = 1
+			}
+			ld[path+":"+strconv.Itoa(line)] = cc
+		}
+	}
+	return ld
+}
+
+// lineHits returns the highest hit count of the blocks spanning each line of
+// each file of stmts.
+func lineHits(stmts StatementData) map[string]map[int]int {
+	files := make(map[string]map[int]int)
+	stmts.EachStatementCount(func(path, pos string, _ int, hits int) {
+		b, err := parseBlock(pos)
+		if err != nil {
+			return
+		}
+		lines := files[path]
+		if lines == nil {
+			lines = make(map[int]int)
+			files[path] = lines
+		}
+		for line := b.startLine; line <= b.endLine; line++ {
+			if old, ok := lines[line]; !ok || hits > old {
+				lines[line] = hits
+			}
+		}
+	})
+	return files
+}
+
+// EachStatement calls back once for each line, as a statement at pos line.
+func (ld LineData) EachStatement(fn func(path, pos string, count int, covered int)) {
+	for k, v := range ld {
+		n := strings.LastIndexByte(k, ':')
+		fn(k[:n], k[n+1:], v.Count, v.Covered)
+	}
+}
+
+func (ld LineData) EachFile(fn func(path string, count int, covered int)) {
+	ld.EachStatement(func(path, _ string, count, covered int) { fn(path, count, covered) })
+}
+
+func (ld LineData) EachPackage(fn func(path string, count int, covered int)) {
+	ld.EachStatement(func(path, _ string, count, covered int) { fn(pathpkg(nil, path), count, covered) })
+}
+
+func (ld LineData) EachModule(fn func(path string, count int, covered int)) {
+	ld.EachStatement(func(path, _ string, count, covered int) { fn(pathmod(nil, path), count, covered) })
+}
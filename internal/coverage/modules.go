@@ -0,0 +1,90 @@
+package coverage
+
+import (
+	"bufio"
+	"bytes"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/mutility/diag"
+)
+
+// modules caches the module paths found by ResolveModules, longest first, so
+// that grouping by module can match real module boundaries.
+var modules struct {
+	mu       sync.RWMutex
+	resolved bool
+	paths    []string
+}
+
+// ResolveModules runs go list -m all, until it first succeeds, and caches the
+// module paths it reports. Once resolved, packages are grouped into the
+// module with the longest matching path prefix; other packages, and all
+// packages until then, are grouped by counting path segments. A failure is
+// not cached, so a later call tries again.
+func ResolveModules(ctx diag.Context) error {
+	modules.mu.RLock()
+	resolved := modules.resolved
+	modules.mu.RUnlock()
+	if resolved {
+		return nil
+	}
+
+	diag.Debug(ctx, "exec> go list -m -f {{.Path}} all")
+	cmd := exec.CommandContext(ctx, "go", "list", "-m", "-f", "{{.Path}}", "all")
+	out, err := cmd.Output()
+	if err != nil {
+		return err
+	}
+	var paths []string
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	for sc.Scan() {
+		if p := strings.TrimSpace(sc.Text()); p != "" {
+			paths = append(paths, p)
+		}
+	}
+	setModules(paths)
+	modules.mu.Lock()
+	modules.resolved = true
+	modules.mu.Unlock()
+	return nil
+}
+
+// ByResolvedModule groups pkgs by module, resolving module boundaries with
+// ResolveModules where it can and counting the path segments of the current
+// module otherwise.
+func ByResolvedModule(ctx diag.Context, pkgs EachPackager) ModuleData {
+	if err := ResolveModules(ctx); err != nil {
+		diag.Debug(ctx, "resolving modules:", err)
+	}
+	return ByModuleDepth(ctx, pkgs, Module(ctx).Depth())
+}
+
+// setModules replaces the cached module paths.
+func setModules(paths []string) {
+	paths = append([]string(nil), paths...)
+	sort.Slice(paths, func(i, j int) bool {
+		if len(paths[i]) != len(paths[j]) {
+			return len(paths[i]) > len(paths[j])
+		}
+		return paths[i] < paths[j]
+	})
+	modules.mu.Lock()
+	modules.paths = paths
+	modules.mu.Unlock()
+}
+
+// findModule returns the longest resolved module path that path is in or
+// under, if any.
+func findModule(path string) (string, bool) {
+	modules.mu.RLock()
+	defer modules.mu.RUnlock()
+	for _, m := range modules.paths {
+		if strings.HasPrefix(path, m) && (len(path) == len(m) || path[len(m)] == '/') {
+			return m, true
+		}
+	}
+	return "", false
+}
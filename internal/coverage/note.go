@@ -0,0 +1,70 @@
+package coverage
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/mutility/diag"
+)
+
+// NoteVersion is the version of the envelope Note is stored in.
+const NoteVersion = 1
+
+type errNoteVersion int
+
+func (e errNoteVersion) Error() string {
+	return fmt.Sprintf("note version %d; must be at most %d", int(e), NoteVersion)
+}
+
+// Note is file coverage as stored in git notes, with the cover mode that
+// measured it. It is stored in a versioned envelope, such as
+// {"version":1,"mode":"count","data":{...}}.
+type Note struct {
+	Mode  string
+	Files FileData
+}
+
+// noteV1 is the envelope of NoteVersion 1.
+type noteV1 struct {
+	Version int      `json:"version"`
+	Mode    string   `json:"mode,omitempty"`
+	Data    FileData `json:"data"`
+}
+
+// MarshalJSON stores n in the envelope of NoteVersion.
+func (n Note) MarshalJSON() ([]byte, error) {
+	return json.Marshal(noteV1{Version: NoteVersion, Mode: n.Mode, Data: n.Files})
+}
+
+// UnmarshalJSON reads any version of the envelope up to NoteVersion, as well
+// as the bare FileData of earlier notes, which leaves Mode empty.
+func (n *Note) UnmarshalJSON(b []byte) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return err
+	}
+	*n = Note{}
+	var version int
+	if err := json.Unmarshal(fields["version"], &version); err == nil {
+		switch version {
+		case 1:
+			var v1 noteV1
+			if err := json.Unmarshal(b, &v1); err != nil {
+				return err
+			}
+			n.Mode, n.Files = v1.Mode, v1.Data
+			return nil
+		default:
+			return errNoteVersion(version)
+		}
+	}
+	return json.Unmarshal(b, &n.Files)
+}
+
+// CheckModes warns if base and head coverage were measured with different
+// cover modes. An empty mode is unknown, and matches any other.
+func CheckModes(log diag.Interface, base, head string) {
+	if base != "" && head != "" && base != head {
+		diag.Warning(log, "comparing", base, "mode base coverage with", head, "mode head coverage")
+	}
+}
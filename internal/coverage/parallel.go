@@ -0,0 +1,120 @@
+package coverage
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/mutility/diag"
+)
+
+// rootShards lists the packages matched by pkgs and groups them by root, as
+// ByRoot would, returning each root's packages in the order of their roots.
+func rootShards(ctx diag.Context, options *TestOptions, pkgs []string) ([][]string, error) {
+	args := append([]string{"list"}, tagsFlag(options.BuildTags)...)
+	args = append(args, "-f", "{{.ImportPath}}")
+	args = append(args, pkgs...)
+
+	diag.Debug(ctx, "exec> go", strings.Join(args, " "))
+	out, err := exec.CommandContext(ctx, "go", args...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("go list: %w", err)
+	}
+
+	byRoot := make(map[string][]string)
+	scan := bufio.NewScanner(bytes.NewReader(out))
+	for scan.Scan() {
+		if pkg := scan.Text(); pkg != "" {
+			root := pathroot(ctx, pkg)
+			byRoot[root] = append(byRoot[root], pkg)
+		}
+	}
+	if err := scan.Err(); err != nil {
+		return nil, err
+	}
+
+	roots := make([]string, 0, len(byRoot))
+	for root := range byRoot {
+		roots = append(roots, root)
+	}
+	sort.Strings(roots)
+	shards := make([][]string, len(roots))
+	for i, root := range roots {
+		shards[i] = byRoot[root]
+	}
+	return shards, nil
+}
+
+// parallelProfile runs go test separately for the packages of each root,
+// up to options.Jobs at a time, and combines their coverprofiles into
+// profile. Sharding by root changes which packages each -coverpkg run
+// instruments, as only that root's test binaries are built, and so which
+// statements covered across packages are counted; the combined profile can
+// differ from that of a single run. The first failure cancels the rest.
+func parallelProfile(ctx diag.Context, options *TestOptions, profile string) error {
+	pkgs := packageArgs(options.Packages, "")
+	coverpkg := coverPkgArgs(options, "", pkgs)
+	shards, err := rootShards(ctx, options, pkgs)
+	if err != nil {
+		return err
+	}
+	if len(shards) < 2 {
+		return goTest(ctx, options, "", profile)
+	}
+
+	tmps := make([]string, len(shards))
+	for i := range tmps {
+		tmp, err := os.CreateTemp("", "covpkg*")
+		if err != nil {
+			return err
+		}
+		tmp.Close()
+		defer os.Remove(tmp.Name())
+		tmps[i] = tmp.Name()
+	}
+
+	cctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	sctx := diag.WithContext(cctx, ctx)
+
+	var (
+		wg       sync.WaitGroup
+		once     sync.Once
+		firstErr error
+	)
+	jobs := make(chan struct{}, options.Jobs)
+	for i, shard := range shards {
+		i, shard := i, shard
+		wg.Add(1)
+		jobs <- struct{}{}
+		go func() {
+			defer func() { <-jobs; wg.Done() }()
+			diag.Debug(ctx, "testing shard:", strings.Join(shard, " "))
+			if err := runTests(sctx, options, "", tmps[i], coverpkg, shard); err != nil {
+				once.Do(func() { firstErr = err; cancel() })
+			}
+		}()
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+
+	out, err := os.Create(profile)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	for i, tmp := range tmps {
+		if err := appendProfile(out, tmp, i == 0); err != nil {
+			return err
+		}
+	}
+	return out.Close()
+}
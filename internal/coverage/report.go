@@ -1,8 +1,15 @@
 package coverage
 
 import (
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
+	"path"
+	"sort"
+	"strconv"
 	"strings"
 )
 
@@ -33,6 +40,372 @@ type Counts struct {
 	IsAggregate bool
 }
 
+func (c Counts) Percent() float64 { return percent(c) }
+
+func (c *Counts) add(o Counts) {
+	c.Covered += o.Covered
+	c.Total += o.Total
+}
+
+// ErrNoChange is returned when sorting by delta without base coverage.
+var ErrNoChange = errors.New("sorting by delta requires a diff")
+
+// SortOrder selects the order of report rows.
+type SortOrder int
+
+const (
+	SortByName       SortOrder = iota // path name, as returned by Paths
+	SortByCoverage                    // lowest coverage percentage first
+	SortByDelta                       // largest coverage decrease first
+	SortByStatements                  // most statements first
+)
+
+type (
+	sortedPaths struct {
+		PathDetailer
+		paths []string
+	}
+	sortedChanges struct {
+		ChangeDetailer
+		paths []string
+	}
+)
+
+func (s sortedPaths) Paths() []string   { return s.paths }
+func (s sortedChanges) Paths() []string { return s.paths }
+
+// Sort returns c with its paths reordered. Ties retain their name order.
+// Sorting by delta requires a ChangeDetailer, and otherwise returns ErrNoChange.
+func Sort(c PathDetailer, by SortOrder) (PathDetailer, error) {
+	d, _ := c.(ChangeDetailer)
+	paths := c.Paths()
+	var less func(a, b string) bool
+	switch by {
+	case SortByName:
+		return c, nil
+	case SortByCoverage:
+		less = func(a, b string) bool { return percent(c.Detail(a)) < percent(c.Detail(b)) }
+	case SortByDelta:
+		if d == nil {
+			return nil, ErrNoChange
+		}
+		delta := func(p string) float64 { return percent(d.Detail(p)) - percent(d.BaseDetail(p)) }
+		less = func(a, b string) bool { return delta(a) < delta(b) }
+	case SortByStatements:
+		less = func(a, b string) bool { return c.Detail(a).Total > c.Detail(b).Total }
+	default:
+		panic(by)
+	}
+
+	sort.SliceStable(paths, func(i, j int) bool { return less(paths[i], paths[j]) })
+	if d != nil {
+		return sortedChanges{d, paths}, nil
+	}
+	return sortedPaths{c, paths}, nil
+}
+
+type (
+	relativePaths struct {
+		PathDetailer
+		relative
+	}
+	relativeChanges struct {
+		ChangeDetailer
+		relative
+	}
+	relative struct {
+		paths []string
+		orig  map[string]string
+	}
+)
+
+func (r relativePaths) Paths() []string              { return r.paths }
+func (r relativePaths) Detail(p string) Counts       { return r.PathDetailer.Detail(r.orig[p]) }
+func (r relativeChanges) Paths() []string            { return r.paths }
+func (r relativeChanges) Detail(p string) Counts     { return r.ChangeDetailer.Detail(r.orig[p]) }
+func (r relativeChanges) BaseDetail(p string) Counts { return r.ChangeDetailer.BaseDetail(r.orig[p]) }
+
+// Relative returns c with the module prefix trimmed from its paths for
+// display; the module itself is shown as '.'. Paths outside the module, and
+// all paths if module is empty, are unchanged.
+func Relative(c PathDetailer, module string) PathDetailer {
+	if module == "" {
+		return c
+	}
+	r := relative{orig: make(map[string]string)}
+	for _, p := range c.Paths() {
+		rel := relPath(p, module)
+		r.paths = append(r.paths, rel)
+		r.orig[rel] = p
+	}
+	if d, ok := c.(ChangeDetailer); ok {
+		return relativeChanges{d, r}
+	}
+	return relativePaths{c, r}
+}
+
+// relPath trims module from p as Relative does.
+func relPath(p, module string) string {
+	if p == module {
+		return "."
+	} else if module != "" && strings.HasPrefix(p, module+"/") {
+		return p[len(module)+1:]
+	}
+	return p
+}
+
+// withPaths returns c restricted to paths.
+func withPaths(c PathDetailer, paths []string) PathDetailer {
+	if d, ok := c.(ChangeDetailer); ok {
+		return sortedChanges{d, paths}
+	}
+	return sortedPaths{c, paths}
+}
+
+// NewUncovered returns the paths of delta that have statements in head but
+// none in base, and cover none of them in head.
+func NewUncovered(delta ChangeDetailer) []string {
+	var paths []string
+	for _, p := range delta.Paths() {
+		hd, bd := delta.Detail(p), delta.BaseDetail(p)
+		if bd.Total == 0 && hd.Total > 0 && hd.Covered == 0 {
+			paths = append(paths, p)
+		}
+	}
+	return paths
+}
+
+// Delta classes returned by ClassifyDelta, in the order Classification lists them.
+const (
+	DeltaNew       = "new"       // No base statements
+	DeltaImproved  = "improved"  // Higher coverage than the base
+	DeltaRegressed = "regressed" // Lower coverage than the base
+	DeltaRemoved   = "removed"   // No head statements
+	DeltaUnchanged = "unchanged" // The same coverage as the base
+)
+
+var deltaClasses = []string{DeltaNew, DeltaImproved, DeltaRegressed, DeltaRemoved, DeltaUnchanged}
+
+// ClassifyDelta buckets the paths of d by how their coverage changed: new
+// paths have no base statements, removed paths have no head statements, and
+// the rest improved, regressed, or are unchanged by percentage.
+func ClassifyDelta(d ChangeDetailer) map[string][]string {
+	classes := make(map[string][]string)
+	for _, p := range d.Paths() {
+		hd, bd := d.Detail(p), d.BaseDetail(p)
+		class := DeltaUnchanged
+		switch hpct, bpct := percent(hd), percent(bd); {
+		case bd.Total == 0 && hd.Total > 0:
+			class = DeltaNew
+		case hd.Total == 0 && bd.Total > 0:
+			class = DeltaRemoved
+		case hpct > bpct:
+			class = DeltaImproved
+		case hpct < bpct:
+			class = DeltaRegressed
+		}
+		classes[class] = append(classes[class], p)
+	}
+	return classes
+}
+
+// Classification counts the changed paths of classes, such as
+// "2 improved, 1 regressed", omitting unchanged paths and empty classes.
+func Classification(classes map[string][]string) string {
+	var parts []string
+	for _, class := range deltaClasses {
+		if n := len(classes[class]); n > 0 && class != DeltaUnchanged {
+			parts = append(parts, fmt.Sprintf("%d %s", n, class))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Rename pairs a path removed since the base with a new path that likely
+// replaced it.
+type Rename struct{ Old, New string }
+
+// DetectRenames pairs the removed paths of d with new paths that have as many
+// statements, as a fingerprint of moved or renamed code. Among several
+// candidates it prefers one with the same base name, then one covering as
+// many statements, then the first by path. Each path is paired at most once.
+func DetectRenames(d ChangeDetailer) []Rename {
+	classes := ClassifyDelta(d)
+	added := classes[DeltaNew]
+	used := make(map[string]bool)
+	var renames []Rename
+	for _, old := range classes[DeltaRemoved] {
+		bd := d.BaseDetail(old)
+		best, bestScore := "", -1
+		for _, p := range added {
+			hd := d.Detail(p)
+			if used[p] || hd.Total != bd.Total {
+				continue
+			}
+			score := 0
+			if path.Base(p) == path.Base(old) {
+				score += 2
+			}
+			if hd.Covered == bd.Covered {
+				score++
+			}
+			if score > bestScore {
+				best, bestScore = p, score
+			}
+		}
+		if best != "" {
+			used[best] = true
+			renames = append(renames, Rename{Old: old, New: best})
+		}
+	}
+	return renames
+}
+
+// renamesTo writes a section listing the renames of d, as markdown if md is
+// set, with module trimmed from their paths. It writes nothing if there are
+// none.
+func renamesTo(w io.Writer, d ChangeDetailer, module string, md bool) {
+	renames := DetectRenames(d)
+	if len(renames) == 0 {
+		return
+	}
+	if md {
+		fmt.Fprint(w, "\n**Renamed**\n\n")
+	} else {
+		fmt.Fprint(w, "\nRenamed:\n")
+	}
+	for _, r := range renames {
+		old, new := relPath(r.Old, module), relPath(r.New, module)
+		pctBase, pctHead := percent(d.BaseDetail(r.Old)), percent(d.Detail(r.New))
+		if md {
+			fmt.Fprintf(w, "- `%s` → `%s`: %.2f%% (was %.2f%%)\n", old, new, pctHead, pctBase)
+		} else {
+			fmt.Fprintf(w, "  %s → %s: %.2f%% (was %.2f%%)\n", old, new, pctHead, pctBase)
+		}
+	}
+}
+
+// Below returns c with only the paths whose coverage percentage is below pct,
+// lowest first, and at most limit of them if limit is positive. Paths without
+// statements are left out.
+func Below(c PathDetailer, pct float64, limit int) PathDetailer {
+	sorted, _ := Sort(c, SortByCoverage)
+	var paths []string
+	for _, p := range sorted.Paths() {
+		if d := c.Detail(p); d.Total > 0 && percent(d) < pct {
+			paths = append(paths, p)
+		}
+	}
+	if limit > 0 && len(paths) > limit {
+		paths = paths[:limit]
+	}
+	return withPaths(c, paths)
+}
+
+// unchanged reports whether hd and bd count the same statements.
+func unchanged(hd, bd Counts) bool {
+	return hd.Total == bd.Total && hd.Covered == bd.Covered
+}
+
+// unchangedLine describes n omitted unchanged paths of c.
+func unchangedLine(c PathDetailer, n int) string {
+	return fmt.Sprintf("%d unchanged %ss not shown", n, strings.ToLower(c.Grouping().String()))
+}
+
+// ReportOptions controls the text and markdown reports written by WriteReport
+// and WriteReportMD. The zero value writes them as Report and ReportMD do.
+type ReportOptions struct {
+	Color       bool      // Color percentages with ANSI escapes; text reports only
+	Sort        SortOrder // Order of rows; see Sort
+	TotalOnly   bool      // Include only the total row, even when c has a single path
+	NoTotal     bool      // Omit the total row, even when c has several paths; TotalOnly takes precedence
+	ChangedOnly bool      // Include only rows whose statement counts changed, the total, and a count of the rest
+	Module      string    // Trim this module prefix from paths, if set; see Relative
+	Renames     bool      // List likely renames after the table of a diff; see DetectRenames
+
+	// Files, such as FileData or a FileDelta, expands each row of markdown
+	// reports into a collapsible table of its files, if set.
+	Files PathDetailer
+}
+
+// apply returns c sorted, trimmed, and marked as o requests.
+func (o ReportOptions) apply(c PathDetailer) (PathDetailer, error) {
+	c, err := Sort(c, o.Sort)
+	if err != nil {
+		return nil, err
+	}
+	if o.Module != "" {
+		c = Relative(c, o.Module)
+	}
+	return c, nil
+}
+
+// WriteReport writes Report to w, formatted as requested by opts.
+func WriteReport(w io.Writer, c PathDetailer, opts ReportOptions) error {
+	rows, err := opts.apply(c)
+	if err != nil {
+		return err
+	}
+	reportTo(w, rows, opts)
+	if d, ok := c.(ChangeDetailer); ok && opts.Renames {
+		renamesTo(w, d, opts.Module, false)
+	}
+	return nil
+}
+
+// WriteReportMD writes ReportMD to w, formatted as requested by opts.
+func WriteReportMD(w io.Writer, c PathDetailer, opts ReportOptions) error {
+	rows, err := opts.apply(c)
+	if err != nil {
+		return err
+	}
+	reportMDTo(w, rows, opts)
+	if d, ok := c.(ChangeDetailer); ok && opts.Renames {
+		renamesTo(w, d, opts.Module, true)
+	}
+	if opts.Files == nil || opts.TotalOnly {
+		return nil
+	}
+	switch c.Grouping() {
+	case FileGrouping, FunctionGrouping:
+		return nil
+	}
+	c, err = Sort(c, opts.Sort)
+	if err != nil {
+		return err
+	}
+	reportFilesMDTo(w, c, opts)
+	return nil
+}
+
+// reportFilesMDTo writes a collapsible markdown table of the files of
+// opts.Files in each row of c.
+func reportFilesMDTo(w io.Writer, c PathDetailer, opts ReportOptions) {
+	d, _ := c.(ChangeDetailer)
+	for _, p := range c.Paths() {
+		hd := c.Detail(p)
+		if opts.ChangedOnly && d != nil && unchanged(hd, d.BaseDetail(p)) {
+			continue
+		}
+		var files []string
+		for _, f := range opts.Files.Paths() {
+			if path.Dir(f) == p || hd.IsAggregate && strings.HasPrefix(f, p+"/") {
+				files = append(files, f)
+			}
+		}
+		if len(files) == 0 {
+			continue
+		}
+		sub, err := Sort(withPaths(opts.Files, files), opts.Sort)
+		if err != nil {
+			sub = withPaths(opts.Files, files)
+		}
+		fmt.Fprintf(w, "\n<details><summary>%s</summary>\n\n", relPath(p, opts.Module))
+		reportMDTo(w, Relative(sub, p), ReportOptions{})
+		fmt.Fprintln(w, "\n</details>")
+	}
+}
+
 // Report creates a multi-line report with details of each package's coverage on
 // a line. If there is more than one package, a total package '.' will be added.
 func Report(c PathDetailer) string {
@@ -41,26 +414,70 @@ func Report(c PathDetailer) string {
 	return sb.String()
 }
 
+// ReportColor is like Report, but colors each percentage with ANSI escapes:
+// red below 50%, yellow below 80%, and green otherwise.
+func ReportColor(c PathDetailer) string {
+	sb := strings.Builder{}
+	ReportColorTo(&sb, c)
+	return sb.String()
+}
+
 // ReportTo writes Report to a specified Writer.
-func ReportTo(w io.Writer, c PathDetailer) {
+func ReportTo(w io.Writer, c PathDetailer) { reportTo(w, c, ReportOptions{}) }
+
+// ReportColorTo writes ReportColor to a specified Writer.
+func ReportColorTo(w io.Writer, c PathDetailer) { reportTo(w, c, ReportOptions{Color: true}) }
+
+const (
+	ansiRed    = "\x1b[31m"
+	ansiYellow = "\x1b[33m"
+	ansiGreen  = "\x1b[32m"
+	ansiReset  = "\x1b[0m"
+)
+
+// colorPct formats pct, colored by its value if color is set.
+func colorPct(pct float64, color bool) string {
+	s := fmt.Sprintf("%6.2f%%", pct)
+	if !color {
+		return s
+	}
+	switch {
+	case pct < 50:
+		return ansiRed + s + ansiReset
+	case pct < 80:
+		return ansiYellow + s + ansiReset
+	default:
+		return ansiGreen + s + ansiReset
+	}
+}
+
+// reportTo writes Report to w, with the color, totals, and changed rows of
+// opts. It neither sorts nor trims c.
+func reportTo(w io.Writer, c PathDetailer, opts ReportOptions) {
+	totalOnly, noTotal, color := opts.TotalOnly, opts.NoTotal, opts.Color
+	d, _ := c.(ChangeDetailer)
+	changedOnly := opts.ChangedOnly && d != nil
 	maxName := 0
 	pkgs := c.Paths()
 	for _, name := range pkgs {
-		if n := len(name); n > maxName {
+		if changedOnly && unchanged(c.Detail(name), d.BaseDetail(name)) {
+			continue
+		}
+		if n := len(name); n > maxName && !totalOnly {
 			maxName = n
 		}
 	}
 
-	if len(pkgs) > 1 {
+	npaths := len(pkgs)
+	if totalOnly || npaths > 1 && !noTotal {
 		pkgs = append(pkgs, "*")
 	}
 	var btot, htot Counts
 
-	d, _ := c.(ChangeDetailer)
 	var lenHT, lenHC, lenBC int
 	for i, pkg := range pkgs {
 		var bd, hd Counts
-		if i > 0 && i+1 == len(pkgs) {
+		if i == npaths {
 			bd, hd = btot, htot
 		} else {
 			hd = c.Detail(pkg)
@@ -87,16 +504,23 @@ func ReportTo(w io.Writer, c PathDetailer) {
 	lenHT, _ = fmt.Fprintf(io.Discard, "%d", lenHT)
 	lenBC, _ = fmt.Fprintf(io.Discard, "%d", lenBC)
 
+	omitted := 0
 	for i, pkg := range pkgs {
 		var bd, hd Counts
-		if i > 0 && i+1 == len(pkgs) {
+		if i == npaths {
 			bd, hd = btot, htot
 			pkg = "<all>:"
+		} else if totalOnly {
+			continue
 		} else {
 			hd = c.Detail(pkg)
 			if d != nil {
 				bd = d.BaseDetail(pkg)
 			}
+			if changedOnly && unchanged(hd, bd) {
+				omitted++
+				continue
+			}
 			if hd.IsAggregate {
 				pkg += "/...:"
 			} else {
@@ -104,38 +528,35 @@ func ReportTo(w io.Writer, c PathDetailer) {
 			}
 		}
 
-		pctBase, pctHead := 0.0, 0.0
-		if hd.Total != 0 {
-			pctHead = float64(100*hd.Covered) / float64(hd.Total)
-		}
-		if bd.Total != 0 {
-			pctBase = float64(100*bd.Covered) / float64(bd.Total)
-		}
+		pctBase, pctHead := percent(bd), percent(hd)
 
 		// report lines of: `{pkg}: {current}  {delta}  ({old})`
 		// where current/old are `percent  n of m` and include delta only
 		// for ChangeDetailers, include old only if nonzero base
 
 		if pctBase > 0 {
-			fmt.Fprintf(w, "%-*s %6.2f%%  %*d of %*d %+7.2f%%  (was %6.2f%%  %*d of %d)\n",
+			fmt.Fprintf(w, "%-*s %s  %*d of %*d %+7.2f%%  (was %6.2f%%  %*d of %d)\n",
 				maxName+5, pkg,
-				pctHead, lenHC, hd.Covered, lenHT, hd.Total,
+				colorPct(pctHead, color), lenHC, hd.Covered, lenHT, hd.Total,
 				pctHead-pctBase,
 				pctBase, lenBC, bd.Covered, bd.Total,
 			)
 		} else if d != nil {
-			fmt.Fprintf(w, "%-*s %6.2f%%  %*d of %*d %+7.2f%%\n",
+			fmt.Fprintf(w, "%-*s %s  %*d of %*d %+7.2f%%\n",
 				maxName+5, pkg,
-				pctHead, lenHC, hd.Covered, lenHT, hd.Total,
+				colorPct(pctHead, color), lenHC, hd.Covered, lenHT, hd.Total,
 				pctHead-pctBase,
 			)
 		} else {
-			fmt.Fprintf(w, "%-*s %6.2f%%  %*d of %d\n",
+			fmt.Fprintf(w, "%-*s %s  %*d of %d\n",
 				maxName+5, pkg,
-				pctHead, lenHC, hd.Covered, hd.Total,
+				colorPct(pctHead, color), lenHC, hd.Covered, hd.Total,
 			)
 		}
 	}
+	if omitted > 0 {
+		fmt.Fprintln(w, unchangedLine(c, omitted))
+	}
 }
 
 // ReportMD creates a multi-line report with details of each package's coverage on
@@ -146,18 +567,24 @@ func ReportMD(c PathDetailer) string {
 	return sb.String()
 }
 
-// ReportTo writes Report to a specified Writer.
-func ReportMDTo(w io.Writer, c PathDetailer) {
+// ReportMDTo writes ReportMD to a specified Writer.
+func ReportMDTo(w io.Writer, c PathDetailer) { reportMDTo(w, c, ReportOptions{}) }
+
+// reportMDTo writes ReportMD to w, with the totals and changed rows of opts.
+func reportMDTo(w io.Writer, c PathDetailer, opts ReportOptions) {
+	totalOnly, noTotal := opts.TotalOnly, opts.NoTotal
+	d, _ := c.(ChangeDetailer)
+	changedOnly := opts.ChangedOnly && d != nil
 	pkgs := c.Paths()
-	if len(pkgs) > 1 {
+	npaths := len(pkgs)
+	if totalOnly || npaths > 1 && !noTotal {
 		pkgs = append(pkgs, "*")
 	}
 	var btot, htot Counts
 
-	d, _ := c.(ChangeDetailer)
 	for i, pkg := range pkgs {
 		var bd, hd Counts
-		if i == 0 || i+1 != len(pkgs) {
+		if i < npaths {
 			hd = c.Detail(pkg)
 			if d != nil {
 				bd = d.BaseDetail(pkg)
@@ -177,13 +604,20 @@ func ReportMDTo(w io.Writer, c PathDetailer) {
 		fmt.Fprintln(w, "|:--|--:|--:|")
 	}
 
+	omitted := 0
 	for i, pkg := range pkgs {
 		bd, hd := btot, htot
-		if i == 0 || i+1 != len(pkgs) {
+		if i < npaths && totalOnly {
+			continue
+		} else if i < npaths {
 			hd = c.Detail(pkg)
 			if d != nil {
 				bd = d.BaseDetail(pkg)
 			}
+			if changedOnly && unchanged(hd, bd) {
+				omitted++
+				continue
+			}
 			if hd.IsAggregate {
 				pkg += "/..."
 			}
@@ -191,11 +625,7 @@ func ReportMDTo(w io.Writer, c PathDetailer) {
 			pkg = "**Total**"
 		}
 		if bd.Total > 0 {
-			hpct := 0.0
-			if hd.Total > 0 {
-				hpct = float64(100*hd.Covered) / float64(hd.Total)
-			}
-			bpct := float64(100*bd.Covered) / float64(bd.Total)
+			hpct, bpct := percent(hd), percent(bd)
 			fmt.Fprintf(w, "%s|%.2f%%|%d of %d|%+.2f%%|(%.2f%%)|(%d of %d)\n", pkg,
 				hpct, hd.Covered, hd.Total,
 				hpct-bpct,
@@ -203,8 +633,270 @@ func ReportMDTo(w io.Writer, c PathDetailer) {
 			)
 		} else {
 			fmt.Fprintf(w, "%s|%.2f%%|%d of %d\n", pkg,
-				float64(100*hd.Covered)/float64(hd.Total), hd.Covered, hd.Total,
+				percent(hd), hd.Covered, hd.Total,
 			)
 		}
 	}
+	if omitted > 0 {
+		fmt.Fprintf(w, "\n%s\n", unchangedLine(c, omitted))
+	}
+}
+
+// Summary creates a single-line report of the total coverage, such as
+// `coverage: 78.42%`. For a ChangeDetailer it appends the change from the
+// base, such as `coverage: 78.42% (+1.20%)`, treating a missing base as 0%.
+func Summary(c PathDetailer) string {
+	d, _ := c.(ChangeDetailer)
+	var btot, htot Counts
+	for _, p := range c.Paths() {
+		hd := c.Detail(p)
+		htot.Covered += hd.Covered
+		htot.Total += hd.Total
+		if d != nil {
+			bd := d.BaseDetail(p)
+			btot.Covered += bd.Covered
+			btot.Total += bd.Total
+		}
+	}
+	if d == nil {
+		return fmt.Sprintf("coverage: %.2f%%", percent(htot))
+	}
+	return fmt.Sprintf("coverage: %.2f%% (%+.2f%%)", percent(htot), percent(htot)-percent(btot))
+}
+
+// Go coverprofiles record statement blocks, not branches, so there is no
+// branch data to report. The branch attributes are always zero, and are
+// written only because stricter consumers, such as the Jenkins Cobertura
+// plugin, reject documents without them.
+type (
+	coberturaCoverage struct {
+		XMLName         xml.Name           `xml:"coverage"`
+		LineRate        float64            `xml:"line-rate,attr"`
+		BranchRate      float64            `xml:"branch-rate,attr"`
+		LinesCovered    int                `xml:"lines-covered,attr"`
+		LinesValid      int                `xml:"lines-valid,attr"`
+		BranchesCovered int                `xml:"branches-covered,attr"`
+		BranchesValid   int                `xml:"branches-valid,attr"`
+		Version         string             `xml:"version,attr"`
+		Packages        []coberturaPackage `xml:"packages>package"`
+	}
+	coberturaPackage struct {
+		Name       string           `xml:"name,attr"`
+		LineRate   float64          `xml:"line-rate,attr"`
+		BranchRate float64          `xml:"branch-rate,attr"`
+		Classes    []coberturaClass `xml:"classes>class"`
+		counts     Counts
+	}
+	coberturaClass struct {
+		Name       string  `xml:"name,attr"`
+		Filename   string  `xml:"filename,attr"`
+		LineRate   float64 `xml:"line-rate,attr"`
+		BranchRate float64 `xml:"branch-rate,attr"`
+	}
+)
+
+func lineRate(c Counts) float64 {
+	if c.Total == 0 {
+		return 0
+	}
+	return float64(c.Covered) / float64(c.Total)
+}
+
+// WriteCobertura writes a Cobertura XML document to a specified Writer. Each
+// path becomes a package with a single class, except at file grouping where
+// files are gathered into a package for their directory. Branch rates and
+// counts are always zero, as coverprofiles have no branch data.
+func WriteCobertura(w io.Writer, c PathDetailer) error {
+	var pkgs []coberturaPackage
+	var tot Counts
+	index := make(map[string]int)
+	byFile := c.Grouping() == FileGrouping
+	for _, p := range c.Paths() {
+		d := c.Detail(p)
+		tot.Covered += d.Covered
+		tot.Total += d.Total
+
+		name := p
+		if byFile {
+			name = path.Dir(p)
+		}
+		i, ok := index[name]
+		if !ok {
+			i = len(pkgs)
+			index[name] = i
+			pkgs = append(pkgs, coberturaPackage{Name: name})
+		}
+		pkg := &pkgs[i]
+		pkg.counts.Covered += d.Covered
+		pkg.counts.Total += d.Total
+		pkg.LineRate = lineRate(pkg.counts)
+		pkg.Classes = append(pkg.Classes, coberturaClass{
+			Name:     path.Base(p),
+			Filename: p,
+			LineRate: lineRate(d),
+		})
+	}
+
+	doc := coberturaCoverage{
+		LineRate:     lineRate(tot),
+		LinesCovered: tot.Covered,
+		LinesValid:   tot.Total,
+		Version:      "coverpkg",
+		Packages:     pkgs,
+	}
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	e := xml.NewEncoder(w)
+	e.Indent("", "  ")
+	if err := e.Encode(doc); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+type (
+	jsonReport struct {
+		Grouping string     `json:"grouping"`
+		Paths    []jsonPath `json:"paths"`
+		Total    jsonTotal  `json:"total"`
+	}
+	jsonPath struct {
+		Path      string `json:"path"`
+		Aggregate bool   `json:"aggregate,omitempty"`
+		jsonTotal
+	}
+	jsonTotal struct {
+		jsonCounts
+		Base  *jsonCounts `json:"base,omitempty"`
+		Delta *float64    `json:"delta,omitempty"`
+	}
+	jsonCounts struct {
+		Covered int     `json:"covered"`
+		Total   int     `json:"total"`
+		Percent float64 `json:"percent"`
+	}
+)
+
+func percent(c Counts) float64 {
+	if c.Total == 0 {
+		return 0
+	}
+	return float64(100*c.Covered) / float64(c.Total)
+}
+
+func newJSONTotal(hd Counts, bd *Counts) jsonTotal {
+	t := jsonTotal{jsonCounts: jsonCounts{Covered: hd.Covered, Total: hd.Total, Percent: percent(hd)}}
+	if bd != nil {
+		t.Base = &jsonCounts{Covered: bd.Covered, Total: bd.Total, Percent: percent(*bd)}
+		delta := t.Percent - t.Base.Percent
+		t.Delta = &delta
+	}
+	return t
+}
+
+// WriteJSON writes a JSON document to a specified Writer. The document has
+// the following shape, where base and delta are only present for a
+// ChangeDetailer, and aggregate is only present when true:
+//
+//	{
+//	  "grouping": "package",
+//	  "paths": [
+//	    {
+//	      "path": "example.com/mod/pkg",
+//	      "aggregate": true,
+//	      "covered": 7, "total": 10, "percent": 70,
+//	      "base": {"covered": 6, "total": 10, "percent": 60},
+//	      "delta": 10
+//	    }
+//	  ],
+//	  "total": {"covered": 7, "total": 10, "percent": 70, "base": {...}, "delta": 10}
+//	}
+func WriteJSON(w io.Writer, c PathDetailer) error {
+	d, _ := c.(ChangeDetailer)
+	rep := jsonReport{
+		Grouping: strings.ToLower(c.Grouping().String()),
+		Paths:    []jsonPath{},
+	}
+	var btot, htot Counts
+	for _, p := range c.Paths() {
+		hd := c.Detail(p)
+		htot.Covered += hd.Covered
+		htot.Total += hd.Total
+		var bd *Counts
+		if d != nil {
+			b := d.BaseDetail(p)
+			btot.Covered += b.Covered
+			btot.Total += b.Total
+			bd = &b
+		}
+		rep.Paths = append(rep.Paths, jsonPath{
+			Path:      p,
+			Aggregate: hd.IsAggregate,
+			jsonTotal: newJSONTotal(hd, bd),
+		})
+	}
+	if d != nil {
+		rep.Total = newJSONTotal(htot, &btot)
+	} else {
+		rep.Total = newJSONTotal(htot, nil)
+	}
+
+	e := json.NewEncoder(w)
+	e.SetIndent("", "  ")
+	return e.Encode(rep)
+}
+
+// WriteCSV writes a comma-separated table to a specified Writer, with a header
+// row of path, covered, total, and percent, followed by base_covered,
+// base_total, base_percent, and delta for a ChangeDetailer. The last row is
+// the total, with path <all>.
+func WriteCSV(w io.Writer, c PathDetailer) error { return writeDelimited(w, c, ',') }
+
+// WriteTSV is like WriteCSV, but separates values with tabs.
+func WriteTSV(w io.Writer, c PathDetailer) error { return writeDelimited(w, c, '\t') }
+
+func writeDelimited(w io.Writer, c PathDetailer, comma rune) error {
+	d, _ := c.(ChangeDetailer)
+	cw := csv.NewWriter(w)
+	cw.Comma = comma
+
+	header := []string{"path", "covered", "total", "percent"}
+	if d != nil {
+		header = append(header, "base_covered", "base_total", "base_percent", "delta")
+	}
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+
+	pct := func(f float64) string { return strconv.FormatFloat(f, 'f', 2, 64) }
+	row := func(p string, hd, bd Counts) error {
+		rec := []string{p, strconv.Itoa(hd.Covered), strconv.Itoa(hd.Total), pct(percent(hd))}
+		if d != nil {
+			rec = append(rec, strconv.Itoa(bd.Covered), strconv.Itoa(bd.Total), pct(percent(bd)), pct(percent(hd)-percent(bd)))
+		}
+		return cw.Write(rec)
+	}
+
+	var btot, htot Counts
+	for _, p := range c.Paths() {
+		var bd Counts
+		hd := c.Detail(p)
+		if d != nil {
+			bd = d.BaseDetail(p)
+		}
+		htot.Covered += hd.Covered
+		htot.Total += hd.Total
+		btot.Covered += bd.Covered
+		btot.Total += bd.Total
+		if err := row(p, hd, bd); err != nil {
+			return err
+		}
+	}
+	if err := row("<all>", htot, btot); err != nil {
+		return err
+	}
+	cw.Flush()
+	return cw.Error()
 }
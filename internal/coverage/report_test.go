@@ -1,8 +1,11 @@
 package coverage_test
 
 import (
+	"encoding/json"
+	"fmt"
 	"strings"
 	"testing"
+	"text/template"
 
 	"github.com/google/go-cmp/cmp"
 
@@ -219,7 +222,10 @@ func TestLoadDiffReport(t *testing.T) {
 	{
 		fa := coverage.ByFiles(ctx, sa)
 		fb := coverage.ByFiles(ctx, sb)
-		fd := coverage.Diff(ctx, fa, fb)
+		fd, err := coverage.Diff(ctx, fa, fb)
+		if err != nil {
+			t.Fatal(err)
+		}
 		got := coverage.ReportMD(fd)
 		want := `| File | Coverage | Statements | Change | (Covered) | (Statements) |
 |:--|--:|--:|--:|--:|--:|
@@ -233,7 +239,10 @@ github.com/mutility/coverpkg/internal/testdata/fake.go|100.00%|2 of 2|+100.00%|(
 	{
 		pa := coverage.ByPackage(ctx, sa)
 		pb := coverage.ByPackage(ctx, sb)
-		pd := coverage.Diff(ctx, pa, pb)
+		pd, err := coverage.Diff(ctx, pa, pb)
+		if err != nil {
+			t.Fatal(err)
+		}
 		got := coverage.ReportMD(pd)
 		want := `| Package | Coverage | Statements | Change | (Covered) | (Statements) |
 |:--|--:|--:|--:|--:|--:|
@@ -247,7 +256,10 @@ github.com/mutility/coverpkg/internal/testdata|100.00%|2 of 2|+100.00%|(0.00%)|(
 	{
 		ra := coverage.ByRoot(ctx, sa)
 		rb := coverage.ByRoot(ctx, sb)
-		rd := coverage.Diff(ctx, ra, rb)
+		rd, err := coverage.Diff(ctx, ra, rb)
+		if err != nil {
+			t.Fatal(err)
+		}
 		got := coverage.ReportMD(rd)
 		want := `| Root | Coverage | Statements | Change | (Covered) | (Statements) |
 |:--|--:|--:|--:|--:|--:|
@@ -261,7 +273,10 @@ github.com/mutility/coverpkg/internal/...|100.00%|2 of 2|+100.00%|(0.00%)|(0 of
 	{
 		ma := coverage.ByModule(ctx, sa)
 		mb := coverage.ByModule(ctx, sb)
-		md := coverage.Diff(ctx, ma, mb)
+		md, err := coverage.Diff(ctx, ma, mb)
+		if err != nil {
+			t.Fatal(err)
+		}
 		got := coverage.ReportMD(md)
 		want := `| Module | Coverage | Statements | Change | (Covered) | (Statements) |
 |:--|--:|--:|--:|--:|--:|
@@ -273,3 +288,812 @@ github.com/mutility/coverpkg/...|100.00%|2 of 2|+100.00%|(0.00%)|(0 of 2)
 		}
 	}
 }
+
+func TestWriteLCOV(t *testing.T) {
+	const prof = `mode: set
+example.com/mod/pkg/b.go:3.10,4.2 1 0
+example.com/mod/pkg/a.go:1.2,2.3 2 1
+example.com/mod/pkg/a.go:1.5,1.9 1 0
+example.com/mod/pkg/a.go:5.1,6.2 1 0
+`
+	ctx := testdiag.Context(t)
+	st, err := coverage.ReadProfile(ctx, strings.NewReader(prof), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sb := &strings.Builder{}
+	if err := coverage.WriteLCOV(sb, st); err != nil {
+		t.Fatal(err)
+	}
+	want := `TN:
+SF:example.com/mod/pkg/a.go
+DA:1,1
+DA:2,1
+DA:5,0
+DA:6,0
+LF:4
+LH:2
+end_of_record
+SF:example.com/mod/pkg/b.go
+DA:3,0
+DA:4,0
+LF:2
+LH:0
+end_of_record
+`
+	if diff := cmp.Diff(want, sb.String()); diff != "" {
+		t.Errorf("lcov (-want +got):\n%s", diff)
+	}
+}
+
+func TestByLines(t *testing.T) {
+	// a.go line 6 ends an uncovered block and starts a covered one
+	const prof = `mode: set
+example.com/mod/pkg/b.go:3.10,4.2 1 0
+example.com/mod/pkg/a.go:1.2,2.3 2 1
+example.com/mod/pkg/a.go:1.5,1.9 1 0
+example.com/mod/pkg/a.go:5.1,6.2 1 0
+example.com/mod/pkg/a.go:6.4,8.2 2 1
+`
+	ctx := testdiag.Context(t)
+	st, err := coverage.ReadProfile(ctx, strings.NewReader(prof), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := coverage.ByLines(st)
+	want := coverage.LineData{
+		"example.com/mod/pkg/a.go:1": {Count: 1, Covered: 1},
+		"example.com/mod/pkg/a.go:2": {Count: 1, Covered: 1},
+		"example.com/mod/pkg/a.go:5": {Count: 1, Covered: 0},
+		"example.com/mod/pkg/a.go:6": {Count: 1, Covered: 1},
+		"example.com/mod/pkg/a.go:7": {Count: 1, Covered: 1},
+		"example.com/mod/pkg/a.go:8": {Count: 1, Covered: 1},
+		"example.com/mod/pkg/b.go:3": {Count: 1, Covered: 0},
+		"example.com/mod/pkg/b.go:4": {Count: 1, Covered: 0},
+	}
+	if diff := cmp.Diff(want, lines); diff != "" {
+		t.Errorf("lines (-want +got):\n%s", diff)
+	}
+
+	wantfiles := coverage.FileData{
+		"example.com/mod/pkg/a.go": {Count: 6, Covered: 5},
+		"example.com/mod/pkg/b.go": {Count: 2, Covered: 0},
+	}
+	if diff := cmp.Diff(wantfiles, coverage.ByFiles(ctx, lines)); diff != "" {
+		t.Errorf("files (-want +got):\n%s", diff)
+	}
+	if got := coverage.ByPackage(ctx, lines).Detail("example.com/mod/pkg"); got.Total != 8 || got.Covered != 5 {
+		t.Errorf("package: got %+v, want 5 of 8 lines", got)
+	}
+}
+
+func TestWriteCobertura(t *testing.T) {
+	sb := &strings.Builder{}
+	err := coverage.WriteCobertura(sb, bypkg{pkgs{scov("mod/a", 7, 10), scov("mod/b", 3, 10)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `<?xml version="1.0" encoding="UTF-8"?>
+<coverage line-rate="0.5" branch-rate="0" lines-covered="10" lines-valid="20" branches-covered="0" branches-valid="0" version="coverpkg">
+  <packages>
+    <package name="mod/a" line-rate="0.7" branch-rate="0">
+      <classes>
+        <class name="a" filename="mod/a" line-rate="0.7" branch-rate="0"></class>
+      </classes>
+    </package>
+    <package name="mod/b" line-rate="0.3" branch-rate="0">
+      <classes>
+        <class name="b" filename="mod/b" line-rate="0.3" branch-rate="0"></class>
+      </classes>
+    </package>
+  </packages>
+</coverage>
+`
+	if diff := cmp.Diff(want, sb.String()); diff != "" {
+		t.Errorf("cobertura (-want +got):\n%s", diff)
+	}
+}
+
+func TestWriteJSON(t *testing.T) {
+	sb := &strings.Builder{}
+	err := coverage.WriteJSON(sb, byroot{pkgs{scov("sub", 8, 10), scov(".", 0, 2)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{
+  "grouping": "root",
+  "paths": [
+    {
+      "path": "sub",
+      "aggregate": true,
+      "covered": 8,
+      "total": 10,
+      "percent": 80
+    },
+    {
+      "path": ".",
+      "covered": 0,
+      "total": 2,
+      "percent": 0
+    }
+  ],
+  "total": {
+    "covered": 8,
+    "total": 12,
+    "percent": 66.66666666666667
+  }
+}
+`
+	if diff := cmp.Diff(want, sb.String()); diff != "" {
+		t.Errorf("json (-want +got):\n%s", diff)
+	}
+
+	sb.Reset()
+	err = coverage.WriteJSON(sb, bydpkg{dpkgs{sdcov("a", 1, 4, 3, 4)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = `{
+  "grouping": "package",
+  "paths": [
+    {
+      "path": "a",
+      "covered": 3,
+      "total": 4,
+      "percent": 75,
+      "base": {
+        "covered": 1,
+        "total": 4,
+        "percent": 25
+      },
+      "delta": 50
+    }
+  ],
+  "total": {
+    "covered": 3,
+    "total": 4,
+    "percent": 75,
+    "base": {
+      "covered": 1,
+      "total": 4,
+      "percent": 25
+    },
+    "delta": 50
+  }
+}
+`
+	if diff := cmp.Diff(want, sb.String()); diff != "" {
+		t.Errorf("json delta (-want +got):\n%s", diff)
+	}
+}
+
+func TestWriteCSV(t *testing.T) {
+	sb := &strings.Builder{}
+	if err := coverage.WriteCSV(sb, bypkg{pkgs{scov("a", 7, 10), scov("b", 3, 13)}}); err != nil {
+		t.Fatal(err)
+	}
+	want := "" +
+		"path,covered,total,percent\n" +
+		"a,7,10,70.00\n" +
+		"b,3,13,23.08\n" +
+		"<all>,10,23,43.48\n"
+	if diff := cmp.Diff(want, sb.String()); diff != "" {
+		t.Errorf("csv (-want +got):\n%s", diff)
+	}
+
+	sb.Reset()
+	if err := coverage.WriteTSV(sb, bydroot{dpkgs{sdcov("pkg", 7, 9, 7, 11)}}); err != nil {
+		t.Fatal(err)
+	}
+	want = "" +
+		"path\tcovered\ttotal\tpercent\tbase_covered\tbase_total\tbase_percent\tdelta\n" +
+		"pkg\t7\t11\t63.64\t7\t9\t77.78\t-14.14\n" +
+		"<all>\t7\t11\t63.64\t7\t9\t77.78\t-14.14\n"
+	if diff := cmp.Diff(want, sb.String()); diff != "" {
+		t.Errorf("tsv (-want +got):\n%s", diff)
+	}
+}
+
+func TestWriteTemplate(t *testing.T) {
+	tmpl := template.Must(template.New("t").Parse(
+		`{{ .Grouping }}{{ range .Paths }} {{ . }}={{ with index $.Detail . }}{{ .Covered }}/{{ .Total }}` +
+			`{{ with .Base }} from {{ .Covered }}/{{ .Total }}{{ end }}{{ end }}{{ end }}` +
+			` total={{ printf "%.2f" .Total.Percent }}{{ if .Total.Base }} delta={{ printf "%+.2f" .Total.Delta }}{{ end }}`))
+
+	sb := &strings.Builder{}
+	if err := coverage.WriteTemplate(sb, bypkg{pkgs{scov("a", 7, 10), scov("b", 3, 13)}}, tmpl); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := sb.String(), "package a=7/10 b=3/13 total=43.48"; got != want {
+		t.Errorf("template: got %q, want %q", got, want)
+	}
+
+	sb.Reset()
+	if err := coverage.WriteTemplate(sb, bydroot{dpkgs{sdcov("pkg", 7, 9, 7, 11)}}, tmpl); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := sb.String(), "root pkg=7/11 from 7/9 total=63.64 delta=-14.14"; got != want {
+		t.Errorf("template delta: got %q, want %q", got, want)
+	}
+}
+
+func TestSort(t *testing.T) {
+	cov := bydpkg{dpkgs{
+		sdcov("a", 5, 10, 9, 10),
+		sdcov("b", 8, 10, 2, 10),
+		sdcov("c", 1, 2, 1, 40),
+	}}
+	for _, tt := range []struct {
+		by   coverage.SortOrder
+		want []string
+	}{
+		{coverage.SortByName, []string{"a", "b", "c"}},
+		{coverage.SortByCoverage, []string{"c", "b", "a"}},
+		{coverage.SortByDelta, []string{"b", "c", "a"}},
+		{coverage.SortByStatements, []string{"c", "a", "b"}},
+	} {
+		got, err := coverage.Sort(cov, tt.by)
+		if err != nil {
+			t.Fatal(tt.by, err)
+		}
+		if diff := cmp.Diff(tt.want, got.Paths()); diff != "" {
+			t.Errorf("sort %d (-want +got):\n%s", tt.by, diff)
+		}
+		if _, ok := got.(coverage.ChangeDetailer); !ok {
+			t.Errorf("sort %d: lost ChangeDetailer", tt.by)
+		}
+	}
+
+	_, err := coverage.Sort(bypkg{pkgs{scov("a", 1, 2)}}, coverage.SortByDelta)
+	if err != coverage.ErrNoChange {
+		t.Errorf("sort delta: got %v, want %v", err, coverage.ErrNoChange)
+	}
+}
+
+func TestSummary(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		want string
+		cov  coverage.PathDetailer
+	}{
+		{"two", "coverage: 43.48%", bypkg{pkgs{scov("a", 7, 10), scov("b", 3, 13)}}},
+		{"delta", "coverage: 63.64% (-14.14%)", bydroot{dpkgs{sdcov("pkg", 7, 9, 7, 11)}}},
+		{"nobase", "coverage: 63.64% (+63.64%)", bydmod{dpkgs{sdcov("pkg", 0, 0, 7, 11)}}},
+		{"drop", "coverage: 5.00% (+2.00%)", bydpkg{dpkgs{sdcov("pkg/a", 5, 100, 5, 100), sdcov("pkg/b", 1, 100, 0, 0)}}},
+		{"empty", "coverage: 0.00%", bypkg{}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := coverage.Summary(tt.cov); got != tt.want {
+				t.Errorf("summary: got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRelative(t *testing.T) {
+	const mod = "example.com/mod"
+	got := coverage.Report(coverage.Relative(bypkg{pkgs{scov(mod, 1, 2), scov(mod+"/a", 7, 10), scov("other.com/b", 3, 13)}}, mod))
+	want := "" +
+		".:                50.00%   1 of 2\n" +
+		"a:                70.00%   7 of 10\n" +
+		"other.com/b:      23.08%   3 of 13\n" +
+		"<all>:            44.00%  11 of 25\n"
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("report (-want +got):\n%s", diff)
+	}
+
+	got = coverage.ReportMD(coverage.Relative(bydroot{dpkgs{sdcov(mod+"/pkg", 7, 9, 7, 11)}}, mod))
+	want = "| Root | Coverage | Statements | Change | (Covered) | (Statements) |\n|:--|--:|--:|--:|--:|--:|\n" +
+		"pkg/...|63.64%|7 of 11|-14.14%|(77.78%)|(7 of 9)\n"
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("reportmd (-want +got):\n%s", diff)
+	}
+}
+
+func TestNewUncovered(t *testing.T) {
+	got := coverage.NewUncovered(bydpkg{dpkgs{
+		sdcov("new", 0, 0, 0, 12),
+		sdcov("newcovered", 0, 0, 1, 12),
+		sdcov("old", 3, 10, 0, 10),
+		sdcov("gone", 3, 10, 0, 0),
+	}})
+	if diff := cmp.Diff([]string{"new"}, got); diff != "" {
+		t.Errorf("new uncovered (-want +got):\n%s", diff)
+	}
+}
+
+func TestTotalOnly(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		want   string
+		wantmd string
+		cov    coverage.PathDetailer
+	}{
+		{
+			"one", "<all>:  70.00%  7 of 10\n",
+			"| Module | Coverage | Statements |\n|:--|--:|--:|\n**Total**|70.00%|7 of 10\n",
+			bymod{pkgs{scov("pkg", 7, 10)}},
+		},
+		{
+			"two", "<all>:  43.48%  10 of 23\n",
+			"| Package | Coverage | Statements |\n|:--|--:|--:|\n**Total**|43.48%|10 of 23\n",
+			bypkg{pkgs{scov("a", 7, 10), scov("b", 3, 13)}},
+		},
+		{
+			"delta", "<all>:  63.64%  7 of 11  -14.14%  (was  77.78%  7 of 9)\n",
+			"| Root | Coverage | Statements | Change | (Covered) | (Statements) |\n|:--|--:|--:|--:|--:|--:|\n" +
+				"**Total**|63.64%|7 of 11|-14.14%|(77.78%)|(7 of 9)\n",
+			bydroot{dpkgs{sdcov("pkg", 7, 9, 7, 11)}},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := coverage.ReportOptions{TotalOnly: true}
+			sb := &strings.Builder{}
+			if err := coverage.WriteReport(sb, tt.cov, opts); err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tt.want, sb.String()); diff != "" {
+				t.Errorf("report (-want +got):\n%s", diff)
+			}
+			sb.Reset()
+			if err := coverage.WriteReportMD(sb, tt.cov, opts); err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tt.wantmd, sb.String()); diff != "" {
+				t.Errorf("reportmd (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestBelow(t *testing.T) {
+	cov := bypkg{pkgs{scov("a", 7, 10), scov("b", 3, 13), scov("c", 10, 10), scov("d", 0, 4), scov("e", 0, 0)}}
+	for _, tt := range []struct {
+		name  string
+		pct   float64
+		limit int
+		want  []string
+	}{
+		{"below", 75, 0, []string{"d", "b", "a"}},
+		{"limit", 75, 2, []string{"d", "b"}},
+		{"none", 0, 0, nil},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if diff := cmp.Diff(tt.want, coverage.Below(cov, tt.pct, tt.limit).Paths()); diff != "" {
+				t.Errorf("paths (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestWriteReport(t *testing.T) {
+	cov := bypkg{pkgs{scov("example.com/mod/a", 7, 10), scov("example.com/mod/b", 3, 13)}}
+
+	for _, tt := range []struct {
+		name   string
+		opts   coverage.ReportOptions
+		want   string
+		wantmd string
+	}{
+		{
+			"zero", coverage.ReportOptions{},
+			coverage.Report(cov), coverage.ReportMD(cov),
+		},
+		{
+			"sorted relative", coverage.ReportOptions{Sort: coverage.SortByCoverage, Module: "example.com/mod"},
+			"b:      23.08%   3 of 13\n" +
+				"a:      70.00%   7 of 10\n" +
+				"<all>:  43.48%  10 of 23\n",
+			"| Package | Coverage | Statements |\n|:--|--:|--:|\n" +
+				"b|23.08%|3 of 13\n" +
+				"a|70.00%|7 of 10\n" +
+				"**Total**|43.48%|10 of 23\n",
+		},
+		{
+			"total only", coverage.ReportOptions{TotalOnly: true},
+			"<all>:  43.48%  10 of 23\n",
+			"| Package | Coverage | Statements |\n|:--|--:|--:|\n**Total**|43.48%|10 of 23\n",
+		},
+		{
+			"no total", coverage.ReportOptions{NoTotal: true, Module: "example.com/mod"},
+			"a:      70.00%  7 of 10\n" +
+				"b:      23.08%  3 of 13\n",
+			"| Package | Coverage | Statements |\n|:--|--:|--:|\n" +
+				"a|70.00%|7 of 10\n" +
+				"b|23.08%|3 of 13\n",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var sb, sbmd strings.Builder
+			if err := coverage.WriteReport(&sb, cov, tt.opts); err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tt.want, sb.String()); diff != "" {
+				t.Errorf("report (-want +got):\n%s", diff)
+			}
+			if err := coverage.WriteReportMD(&sbmd, cov, tt.opts); err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tt.wantmd, sbmd.String()); diff != "" {
+				t.Errorf("reportmd (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	if err := coverage.WriteReport(&strings.Builder{}, cov, coverage.ReportOptions{Sort: coverage.SortByDelta}); err != coverage.ErrNoChange {
+		t.Errorf("sort by delta: got %v, want %v", err, coverage.ErrNoChange)
+	}
+}
+
+func TestCheckTargets(t *testing.T) {
+	cov := bypkg{pkgs{scov("core", 85, 100), scov("exp", 40, 100), scov("misc", 70, 100)}}
+	for _, tt := range []struct {
+		name    string
+		targets map[string]float64
+		want    []coverage.Violation
+	}{
+		{"none", nil, nil},
+		{"listed", map[string]float64{"core": 90, "exp": 50}, []coverage.Violation{
+			{Path: "core", Actual: 85, Target: 90},
+			{Path: "exp", Actual: 40, Target: 50},
+		}},
+		{"default", map[string]float64{"exp": 30, "default": 75}, []coverage.Violation{
+			{Path: "misc", Actual: 70, Target: 75},
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if diff := cmp.Diff(tt.want, coverage.CheckTargets(cov, tt.targets)); diff != "" {
+				t.Errorf("violations (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestParseMinimums(t *testing.T) {
+	mins, err := coverage.ParseMinimums([]string{"80", "a/b=90%"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []coverage.Minimum{{Path: "", Percent: 80}, {Path: "a/b", Percent: 90}}
+	if diff := cmp.Diff(want, mins); diff != "" {
+		t.Errorf("minimums (-want +got):\n%s", diff)
+	}
+	for _, bad := range []string{"x", "=80", "a=101", "a=-1"} {
+		if _, err := coverage.ParseMinimums([]string{bad}); err != coverage.MinError(bad) {
+			t.Errorf("%s: got %v, want %v", bad, err, coverage.MinError(bad))
+		}
+	}
+}
+
+func TestCheckMinimums(t *testing.T) {
+	ctx := testdiag.Context(t)
+	cov := coverage.ByPackage(ctx, coverage.FileData{
+		"m/a/a.go": {Count: 10, Covered: 5},
+		"m/b/b.go": {Count: 10, Covered: 9},
+	})
+	mins := []coverage.Minimum{{Path: "", Percent: 75}, {Path: "m/a", Percent: 50}, {Path: "m/b", Percent: 95}, {Path: "m/c", Percent: 1}}
+	want := []coverage.BelowMinError{
+		{Grouping: coverage.PackageGrouping, Actual: 70, Required: 75},
+		{Grouping: coverage.PackageGrouping, Path: "m/b", Actual: 90, Required: 95},
+		{Grouping: coverage.PackageGrouping, Path: "m/c", Actual: 0, Required: 1},
+	}
+	if diff := cmp.Diff(want, coverage.CheckMinimums(cov, mins)); diff != "" {
+		t.Errorf("below (-want +got):\n%s", diff)
+	}
+	if got, want := want[1].Error(), "package m/b coverage 90.00% is below minimum 95.00%"; got != want {
+		t.Errorf("error: got %q, want %q", got, want)
+	}
+}
+
+func TestCheckRootTargets(t *testing.T) {
+	ctx := testdiag.Context(t)
+	roots := coverage.ByRoot(ctx, coverage.FileData{
+		"example.com/mod/cmd/a/a.go":      {Count: 10, Covered: 5},
+		"example.com/mod/internal/b/b.go": {Count: 10, Covered: 8},
+		"example.com/mod/internal/c/c.go": {Count: 10, Covered: 8},
+		"example.com/mod/pkg/d.go":        {Count: 10, Covered: 1},
+	})
+	for _, tt := range []struct {
+		name    string
+		targets map[string]float64
+		want    []coverage.Violation
+	}{
+		{"none", nil, nil},
+		{"exact", map[string]float64{"example.com/mod/cmd/a": 60}, []coverage.Violation{
+			{Path: "example.com/mod/cmd/a", Actual: 50, Target: 60},
+		}},
+		{"longest", map[string]float64{"example.com/mod": 40, "example.com/mod/cmd": 50}, []coverage.Violation{
+			{Path: "example.com/mod/pkg", Actual: 10, Target: 40},
+		}},
+		{"prefix", map[string]float64{"example.com/mod/internal": 85}, []coverage.Violation{
+			{Path: "example.com/mod/internal/b", Actual: 80, Target: 85},
+			{Path: "example.com/mod/internal/c", Actual: 80, Target: 85},
+		}},
+		{"deeper", map[string]float64{"example.com/mod/internal/b/x": 85}, []coverage.Violation{
+			{Path: "example.com/mod/internal/b", Actual: 80, Target: 85},
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if diff := cmp.Diff(tt.want, coverage.CheckRootTargets(roots, tt.targets)); diff != "" {
+				t.Errorf("violations (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestReportColor(t *testing.T) {
+	got := coverage.ReportColor(bypkg{pkgs{scov("a", 9, 10), scov("b", 6, 10), scov("c", 1, 10)}})
+	want := "" +
+		"a:     \x1b[32m 90.00%\x1b[0m   9 of 10\n" +
+		"b:     \x1b[33m 60.00%\x1b[0m   6 of 10\n" +
+		"c:     \x1b[31m 10.00%\x1b[0m   1 of 10\n" +
+		"<all>: \x1b[33m 53.33%\x1b[0m  16 of 30\n"
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("report (-want +got):\n%s", diff)
+	}
+}
+
+func TestWriteBadge(t *testing.T) {
+	for _, tt := range []struct {
+		pct   float64
+		label string
+		want  []string
+	}{
+		{12.34, "coverage", []string{`aria-label="coverage: 12.3%"`, `fill="#e05d44"`}},
+		{65, "cov", []string{`aria-label="cov: 65.0%"`, `fill="#fe7d37"`}},
+		{75, "a&b", []string{`aria-label="a&amp;b: 75.0%"`, `fill="#dfb317"`}},
+		{100, "coverage", []string{`<text x="33" y="14">coverage</text>`, `fill="#44cc11"`}},
+	} {
+		sb := &strings.Builder{}
+		if err := coverage.WriteBadge(sb, tt.pct, tt.label, nil); err != nil {
+			t.Fatal(err)
+		}
+		for _, want := range tt.want {
+			if !strings.Contains(sb.String(), want) {
+				t.Errorf("badge %v: missing %q in %s", tt.pct, want, sb.String())
+			}
+		}
+	}
+}
+
+func TestBadgeBands(t *testing.T) {
+	var bands []coverage.BadgeBand
+	for _, s := range []string{"100:green", "90:#abc", "80%:Red"} {
+		band, err := coverage.ParseBadgeBand(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bands = append(bands, band)
+	}
+	for pct, want := range map[float64]string{79.9: "#e05d44", 80: "#abc", 95: "#44cc11", 100: "#44cc11"} {
+		sb := &strings.Builder{}
+		if err := coverage.WriteBadge(sb, pct, "coverage", bands); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(sb.String(), `fill="`+want+`"`) {
+			t.Errorf("badge %v: want fill %s in %s", pct, want, sb.String())
+		}
+	}
+
+	for _, bad := range []string{"red", "50", "101:red", "50:mauve", "50:#12345", "x:red"} {
+		if _, err := coverage.ParseBadgeBand(bad); err == nil {
+			t.Errorf("%s: got nil, want error", bad)
+		}
+	}
+}
+
+func TestChangedOnly(t *testing.T) {
+	cov := bydpkg{dpkgs{
+		sdcov("a", 5, 10, 9, 10),
+		sdcov("b", 8, 10, 8, 10),
+		sdcov("c", 1, 2, 1, 2),
+	}}
+	opts := coverage.ReportOptions{ChangedOnly: true}
+
+	sb := &strings.Builder{}
+	if err := coverage.WriteReport(sb, cov, opts); err != nil {
+		t.Fatal(err)
+	}
+	want := "" +
+		"a:      90.00%   9 of 10  +40.00%  (was  50.00%   5 of 10)\n" +
+		"<all>:  81.82%  18 of 22  +18.18%  (was  63.64%  14 of 22)\n" +
+		"2 unchanged packages not shown\n"
+	if diff := cmp.Diff(want, sb.String()); diff != "" {
+		t.Errorf("report (-want +got):\n%s", diff)
+	}
+
+	sb.Reset()
+	if err := coverage.WriteReportMD(sb, cov, opts); err != nil {
+		t.Fatal(err)
+	}
+	want = "| Package | Coverage | Statements | Change | (Covered) | (Statements) |\n|:--|--:|--:|--:|--:|--:|\n" +
+		"a|90.00%|9 of 10|+40.00%|(50.00%)|(5 of 10)\n" +
+		"**Total**|81.82%|18 of 22|+18.18%|(63.64%)|(14 of 22)\n" +
+		"\n2 unchanged packages not shown\n"
+	if diff := cmp.Diff(want, sb.String()); diff != "" {
+		t.Errorf("reportmd (-want +got):\n%s", diff)
+	}
+
+	sb.Reset()
+	opts.NoTotal = true
+	if err := coverage.WriteReport(sb, cov, opts); err != nil {
+		t.Fatal(err)
+	}
+	want = "" +
+		"a:      90.00%  9 of 10  +40.00%  (was  50.00%  5 of 10)\n" +
+		"2 unchanged packages not shown\n"
+	if diff := cmp.Diff(want, sb.String()); diff != "" {
+		t.Errorf("report no total (-want +got):\n%s", diff)
+	}
+}
+
+func TestReportMDFiles(t *testing.T) {
+	cov := byroot{pkgs{scov("m/a", 3, 4), scov("m/b", 0, 2)}}
+	files := coverage.FileData{
+		"m/a/a.go":   {Count: 3, Covered: 3},
+		"m/a/x/x.go": {Count: 1, Covered: 0},
+		"m/b/b.go":   {Count: 2, Covered: 0},
+	}
+	sb := &strings.Builder{}
+	if err := coverage.WriteReportMD(sb, cov, coverage.ReportOptions{Module: "m", Files: files}); err != nil {
+		t.Fatal(err)
+	}
+	want := "| Root | Coverage | Statements |\n|:--|--:|--:|\n" +
+		"a/...|75.00%|3 of 4\n" +
+		"b/...|0.00%|0 of 2\n" +
+		"**Total**|50.00%|3 of 6\n" +
+		"\n<details><summary>a</summary>\n\n" +
+		"| File | Coverage | Statements |\n|:--|--:|--:|\n" +
+		"a.go|100.00%|3 of 3\n" +
+		"x/x.go|0.00%|0 of 1\n" +
+		"**Total**|75.00%|3 of 4\n" +
+		"\n</details>\n" +
+		"\n<details><summary>b</summary>\n\n" +
+		"| File | Coverage | Statements |\n|:--|--:|--:|\n" +
+		"b.go|0.00%|0 of 2\n" +
+		"\n</details>\n"
+	if diff := cmp.Diff(want, sb.String()); diff != "" {
+		t.Errorf("reportmd (-want +got):\n%s", diff)
+	}
+}
+
+func TestReportEmpty(t *testing.T) {
+	cov := bypkg{pkgs{scov("pkg", 0, 0)}}
+	got := coverage.Report(cov)
+	want := "pkg:       0.00%  0 of 0\n"
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("report (-want +got):\n%s", diff)
+	}
+
+	got = coverage.ReportMD(cov)
+	want = "| Package | Coverage | Statements |\n|:--|--:|--:|\n" +
+		"pkg|0.00%|0 of 0\n"
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("reportmd (-want +got):\n%s", diff)
+	}
+}
+
+func TestWriteSARIF(t *testing.T) {
+	const prof = `mode: set
+example.com/mod/pkg/b.go:3.10,4.2 1 0
+example.com/mod/pkg/a.go:1.2,2.3 2 1
+example.com/mod/pkg/a.go:5.1,6.2 1 0
+`
+	ctx := testdiag.Context(t)
+	st, err := coverage.ReadProfile(ctx, strings.NewReader(prof), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type region struct{ StartLine, StartColumn, EndLine, EndColumn int }
+	var log struct {
+		Version string
+		Runs    []struct {
+			Results []struct {
+				RuleID    string
+				Locations []struct {
+					PhysicalLocation struct {
+						ArtifactLocation struct{ URI string }
+						Region           region
+					}
+				}
+			}
+		}
+	}
+	results := func(threshold float64) []string {
+		t.Helper()
+		sb := &strings.Builder{}
+		if err := coverage.WriteSARIF(sb, st.Relative("example.com/mod"), threshold); err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal([]byte(sb.String()), &log); err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, r := range log.Runs[0].Results {
+			loc := r.Locations[0].PhysicalLocation
+			got = append(got, fmt.Sprintf("%s %s:%v", r.RuleID, loc.ArtifactLocation.URI, loc.Region))
+		}
+		return got
+	}
+
+	want := []string{
+		"coverpkg/uncovered pkg/a.go:{5 1 6 2}",
+		"coverpkg/uncovered pkg/b.go:{3 10 4 2}",
+	}
+	if diff := cmp.Diff(want, results(100)); diff != "" {
+		t.Errorf("sarif (-want +got):\n%s", diff)
+	}
+	if log.Version != "2.1.0" {
+		t.Errorf("version: got %q, want 2.1.0", log.Version)
+	}
+	if diff := cmp.Diff(want[1:], results(50)); diff != "" {
+		t.Errorf("sarif 50%% (-want +got):\n%s", diff)
+	}
+}
+
+func TestDetectRenames(t *testing.T) {
+	cov := bydpkg{dpkgs{
+		sdcov("mod/fresh", 0, 0, 1, 88),
+		sdcov("mod/gone", 3, 4, 0, 0),
+		sdcov("mod/new/util", 0, 0, 6, 10),
+		sdcov("mod/old/util", 5, 10, 0, 0),
+		sdcov("mod/other", 0, 0, 5, 10),
+		sdcov("mod/was", 5, 10, 0, 0),
+	}}
+
+	want := []coverage.Rename{
+		{Old: "mod/old/util", New: "mod/new/util"},
+		{Old: "mod/was", New: "mod/other"},
+	}
+	if diff := cmp.Diff(want, coverage.DetectRenames(cov)); diff != "" {
+		t.Errorf("renames (-want +got):\n%s", diff)
+	}
+
+	sb := &strings.Builder{}
+	if err := coverage.WriteReport(sb, cov, coverage.ReportOptions{Renames: true}); err != nil {
+		t.Fatal(err)
+	}
+	if want := "\nRenamed:\n  mod/old/util → mod/new/util: 60.00% (was 50.00%)\n  mod/was → mod/other: 50.00% (was 50.00%)\n"; !strings.HasSuffix(sb.String(), want) {
+		t.Errorf("report: got %q, want suffix %q", sb.String(), want)
+	}
+
+	sb.Reset()
+	if err := coverage.WriteReportMD(sb, cov, coverage.ReportOptions{Renames: true, Module: "mod"}); err != nil {
+		t.Fatal(err)
+	}
+	if want := "\n**Renamed**\n\n- `old/util` → `new/util`: 60.00% (was 50.00%)\n- `was` → `other`: 50.00% (was 50.00%)\n"; !strings.HasSuffix(sb.String(), want) {
+		t.Errorf("markdown: got %q, want suffix %q", sb.String(), want)
+	}
+}
+
+func TestClassifyDelta(t *testing.T) {
+	cov := bydroot{dpkgs{
+		sdcov("new", 0, 0, 1, 88),
+		sdcov("match", 88, 99, 88, 99),
+		sdcov("improve", 60, 100, 80, 100),
+		sdcov("decrease", 20, 50, 20, 100),
+		sdcov("gone", 3, 4, 0, 0),
+		sdcov("unlikely", 1, 1, 1, 1),
+	}}
+
+	classes := coverage.ClassifyDelta(cov)
+	want := map[string][]string{
+		coverage.DeltaNew:       {"new"},
+		coverage.DeltaImproved:  {"improve"},
+		coverage.DeltaRegressed: {"decrease"},
+		coverage.DeltaRemoved:   {"gone"},
+		coverage.DeltaUnchanged: {"match", "unlikely"},
+	}
+	if diff := cmp.Diff(want, classes); diff != "" {
+		t.Errorf("classes (-want +got):\n%s", diff)
+	}
+	if got, want := coverage.Classification(classes), "1 new, 1 improved, 1 regressed, 1 removed"; got != want {
+		t.Errorf("classification: got %q, want %q", got, want)
+	}
+	if got := coverage.Classification(map[string][]string{coverage.DeltaUnchanged: {"match"}}); got != "" {
+		t.Errorf("unchanged classification: got %q, want none", got)
+	}
+}
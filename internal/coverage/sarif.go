@@ -0,0 +1,115 @@
+package coverage
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// SARIFRule identifies uncovered statements in SARIF results.
+const SARIFRule = "coverpkg/uncovered"
+
+type (
+	sarifLog struct {
+		Schema  string     `json:"$schema"`
+		Version string     `json:"version"`
+		Runs    []sarifRun `json:"runs"`
+	}
+	sarifRun struct {
+		Tool    sarifTool     `json:"tool"`
+		Results []sarifResult `json:"results"`
+	}
+	sarifTool struct {
+		Driver sarifDriver `json:"driver"`
+	}
+	sarifDriver struct {
+		Name           string      `json:"name"`
+		InformationURI string      `json:"informationUri"`
+		Rules          []sarifRule `json:"rules"`
+	}
+	sarifRule struct {
+		ID               string       `json:"id"`
+		ShortDescription sarifMessage `json:"shortDescription"`
+	}
+	sarifMessage struct {
+		Text string `json:"text"`
+	}
+	sarifResult struct {
+		RuleID    string          `json:"ruleId"`
+		Level     string          `json:"level"`
+		Message   sarifMessage    `json:"message"`
+		Locations []sarifLocation `json:"locations"`
+	}
+	sarifLocation struct {
+		PhysicalLocation sarifPhysicalLocation `json:"physicalLocation"`
+	}
+	sarifPhysicalLocation struct {
+		ArtifactLocation sarifArtifactLocation `json:"artifactLocation"`
+		Region           sarifRegion           `json:"region"`
+	}
+	sarifArtifactLocation struct {
+		URI string `json:"uri"`
+	}
+	sarifRegion struct {
+		StartLine   int `json:"startLine"`
+		StartColumn int `json:"startColumn"`
+		EndLine     int `json:"endLine"`
+		EndColumn   int `json:"endColumn"`
+	}
+)
+
+// WriteSARIF writes a SARIF 2.1.0 log with a SARIFRule result for each
+// uncovered statement in files whose coverage is below threshold percent, so
+// a threshold of 100 reports every uncovered statement. Results locate
+// statements by their file paths, which code scanning expects to be relative
+// to the repository; see StatementData.Relative.
+func WriteSARIF(w io.Writer, stmts StatementData, threshold float64) error {
+	files := ByFiles(nil, stmts)
+	results := []sarifResult{}
+	for _, sp := range stmts.Uncovered() {
+		pct := percent(files.Detail(sp.File))
+		if pct >= threshold {
+			continue
+		}
+		results = append(results, sarifResult{
+			RuleID:  SARIFRule,
+			Level:   "note",
+			Message: sarifMessage{fmt.Sprintf("Statement is not covered by tests; %s has %.2f%% coverage", sp.File, pct)},
+			Locations: []sarifLocation{{sarifPhysicalLocation{
+				ArtifactLocation: sarifArtifactLocation{sp.File},
+				Region:           sarifRegion{sp.StartLine, sp.StartCol, sp.EndLine, sp.EndCol},
+			}}},
+		})
+	}
+
+	log := sarifLog{
+		Schema:  "https://json.schemastore.org/sarif-2.1.0.json",
+		Version: "2.1.0",
+		Runs: []sarifRun{{
+			Tool: sarifTool{sarifDriver{
+				Name:           "coverpkg",
+				InformationURI: "https://github.com/mutility/coverpkg",
+				Rules:          []sarifRule{{SARIFRule, sarifMessage{"Statement is not covered by tests"}}},
+			}},
+			Results: results,
+		}},
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(log)
+}
+
+// Relative returns sd with the module prefix trimmed from its file paths.
+// Files outside the module, and all files if module is empty, are unchanged.
+func (sd StatementData) Relative(module string) StatementData {
+	if module == "" {
+		return sd
+	}
+	rel := make(StatementData, len(sd))
+	for k, hits := range sd {
+		k.filepos = strings.TrimPrefix(k.filepos, module+"/")
+		rel[k] += hits
+	}
+	return rel
+}
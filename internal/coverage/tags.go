@@ -0,0 +1,86 @@
+package coverage
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/mutility/diag"
+)
+
+// tagsFlag returns the go flags that select files built with tags.
+func tagsFlag(tags []string) []string {
+	if len(tags) == 0 {
+		return nil
+	}
+	return []string{"-tags", strings.Join(tags, ",")}
+}
+
+// skipUnbuilt removes statements in files that go list reports are excluded
+// when building with tags, so they count toward neither covered nor total.
+// Statements in packages go list can't find are kept.
+func skipUnbuilt(ctx diag.Context, stmts StatementData, tags []string) error {
+	pkgs := make(map[string]bool)
+	for k := range stmts {
+		pkgs[pathpkg(ctx, k.file())] = true
+	}
+	if len(pkgs) == 0 {
+		return nil
+	}
+
+	built, err := packageFiles(ctx, pkgs, tags)
+	if err != nil {
+		return err
+	}
+	for k := range stmts {
+		file := k.file()
+		files, ok := built[pathpkg(ctx, file)]
+		if ok && !files[path.Base(file)] {
+			diag.Debug(ctx, "skipping excluded by tags:", file)
+			delete(stmts, k)
+		}
+	}
+	return nil
+}
+
+// packageFiles maps import paths to the names of their Go and test files
+// that are built with tags. Packages without a directory are left out.
+func packageFiles(ctx diag.Context, pkgs map[string]bool, tags []string) (map[string]map[string]bool, error) {
+	const format = "{{.ImportPath}}\t{{.Dir}}" +
+		"{{range .GoFiles}}\t{{.}}{{end}}" +
+		"{{range .CgoFiles}}\t{{.}}{{end}}" +
+		"{{range .TestGoFiles}}\t{{.}}{{end}}" +
+		"{{range .XTestGoFiles}}\t{{.}}{{end}}"
+	args := append([]string{"list", "-e"}, tagsFlag(tags)...)
+	args = append(args, "-f", format)
+	n := len(args)
+	for pkg := range pkgs {
+		args = append(args, pkg)
+	}
+	sort.Strings(args[n:])
+
+	diag.Debug(ctx, "exec> go", strings.Join(args, " "))
+	out, err := exec.CommandContext(ctx, "go", args...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("go list: %w", err)
+	}
+
+	built := make(map[string]map[string]bool)
+	scan := bufio.NewScanner(bytes.NewReader(out))
+	for scan.Scan() {
+		f := strings.Split(scan.Text(), "\t")
+		if len(f) < 2 || f[1] == "" {
+			continue
+		}
+		files := make(map[string]bool, len(f)-2)
+		for _, name := range f[2:] {
+			files[name] = true
+		}
+		built[f[0]] = files
+	}
+	return built, scan.Err()
+}
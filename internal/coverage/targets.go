@@ -0,0 +1,139 @@
+package coverage
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// DefaultTarget is the key of targets applied to paths not otherwise listed.
+const DefaultTarget = "default"
+
+// Violation describes a path whose coverage is below its target.
+type Violation struct {
+	Path   string
+	Actual float64
+	Target float64
+}
+
+// CheckTargets returns the paths of c whose coverage percentage is below
+// their target, in the order of c.Paths(). A path without a target uses the
+// DefaultTarget entry, if any, and is otherwise not checked.
+func CheckTargets(c PathDetailer, targets map[string]float64) []Violation {
+	def, hasDef := targets[DefaultTarget]
+	var vs []Violation
+	for _, p := range c.Paths() {
+		target, ok := targets[p]
+		if !ok {
+			if !hasDef {
+				continue
+			}
+			target = def
+		}
+		if pct := percent(c.Detail(p)); pct < target {
+			vs = append(vs, Violation{Path: p, Actual: pct, Target: target})
+		}
+	}
+	return vs
+}
+
+// CheckRootTargets returns the roots whose coverage percentage is below the
+// target of their owner, in the order of roots.Paths(). Like a CODEOWNERS
+// file, each key of targets owns the roots it equals or prefixes, and the
+// longest key that owns a root sets its target; roots no key owns are not
+// checked. Keys deeper than a root are trimmed to their root, as by ByRoot.
+func CheckRootTargets(roots RootData, targets map[string]float64) []Violation {
+	owners := make(map[string]float64, len(targets))
+	for k, v := range targets {
+		k = pathroot(nil, strings.TrimSuffix(k, "/"))
+		if old, ok := owners[k]; !ok || v > old {
+			owners[k] = v
+		}
+	}
+
+	var vs []Violation
+	for _, p := range roots.Paths() {
+		owner, target := "", 0.0
+		for k, v := range owners {
+			if (p == k || strings.HasPrefix(p, k+"/")) && len(k) > len(owner) {
+				owner, target = k, v
+			}
+		}
+		if owner == "" {
+			continue
+		}
+		if pct := percent(roots.Detail(p)); pct < target {
+			vs = append(vs, Violation{Path: p, Actual: pct, Target: target})
+		}
+	}
+	return vs
+}
+
+// Minimum is a coverage floor for a path, or for the total if Path is empty.
+type Minimum struct {
+	Path    string
+	Percent float64
+}
+
+// MinError reports a minimum ParseMinimums can't parse.
+type MinError string
+
+func (e MinError) Error() string {
+	return fmt.Sprintf("min value '%s'; must be a percentage or path=percentage", string(e))
+}
+
+// ParseMinimums parses values such as "80" for the total, or "some/pkg=80%"
+// for a path, in order.
+func ParseMinimums(values []string) ([]Minimum, error) {
+	mins := make([]Minimum, 0, len(values))
+	for _, v := range values {
+		path, pct := "", v
+		if n := strings.LastIndexByte(v, '='); n >= 0 {
+			path, pct = v[:n], v[n+1:]
+		}
+		f, err := strconv.ParseFloat(strings.TrimSuffix(pct, "%"), 64)
+		if err != nil || f < 0 || f > 100 || (path == "" && pct != v) {
+			return nil, MinError(v)
+		}
+		mins = append(mins, Minimum{Path: path, Percent: f})
+	}
+	return mins, nil
+}
+
+// BelowMinError reports coverage below a Minimum.
+type BelowMinError struct {
+	Grouping Grouping
+	Path     string // Empty for the total
+	Actual   float64
+	Required float64
+}
+
+func (e BelowMinError) Error() string {
+	by := strings.ToLower(e.Grouping.String())
+	if e.Path == "" {
+		return fmt.Sprintf("%s coverage %.2f%% is below minimum %.2f%%", by, e.Actual, e.Required)
+	}
+	return fmt.Sprintf("%s %s coverage %.2f%% is below minimum %.2f%%", by, e.Path, e.Actual, e.Required)
+}
+
+// CheckMinimums returns the minimums c doesn't meet, in the order of mins. A
+// path c doesn't have counts as 0% covered.
+func CheckMinimums(c interface {
+	EachPather
+	PathDetailer
+}, mins []Minimum,
+) []BelowMinError {
+	var below []BelowMinError
+	for _, m := range mins {
+		actual := 0.0
+		if m.Path == "" {
+			actual = Percent(c)
+		} else {
+			actual = percent(c.Detail(m.Path))
+		}
+		if actual < m.Percent {
+			below = append(below, BelowMinError{Grouping: c.Grouping(), Path: m.Path, Actual: actual, Required: m.Percent})
+		}
+	}
+	return below
+}
@@ -0,0 +1,71 @@
+package coverage
+
+import (
+	"io"
+	"strings"
+	"text/template"
+)
+
+// TemplateView is the data a template passed to WriteTemplate is executed
+// against.
+type TemplateView struct {
+	Grouping string                 // Lower case grouping level, such as "package"
+	Paths    []string               // Paths in report order
+	Detail   map[string]TemplateRow // Row of each path
+	Total    TemplateRow            // Sum of all rows
+}
+
+// TemplateRow holds the counts of a path in a TemplateView. Its Percent
+// method returns the head coverage percentage.
+type TemplateRow struct {
+	Counts
+	Path  string  // Path of the row, or empty for the total
+	Base  *Counts // Base counts, if the view is of a ChangeDetailer
+	Delta float64 // Change in percentage from Base, or 0 without a base
+}
+
+func newTemplateRow(p string, hd Counts, bd *Counts) TemplateRow {
+	r := TemplateRow{Counts: hd, Path: p, Base: bd}
+	if bd != nil {
+		r.Delta = percent(hd) - percent(*bd)
+	}
+	return r
+}
+
+// NewTemplateView returns the TemplateView of c, with base counts and deltas
+// when c is a ChangeDetailer.
+func NewTemplateView(c PathDetailer) TemplateView {
+	d, _ := c.(ChangeDetailer)
+	v := TemplateView{
+		Grouping: strings.ToLower(c.Grouping().String()),
+		Paths:    c.Paths(),
+		Detail:   make(map[string]TemplateRow),
+	}
+	var btot, htot Counts
+	for _, p := range v.Paths {
+		hd := c.Detail(p)
+		htot.add(hd)
+		var bd *Counts
+		if d != nil {
+			b := d.BaseDetail(p)
+			btot.add(b)
+			bd = &b
+		}
+		v.Detail[p] = newTemplateRow(p, hd, bd)
+	}
+	if d != nil {
+		v.Total = newTemplateRow("", htot, &btot)
+	} else {
+		v.Total = newTemplateRow("", htot, nil)
+	}
+	return v
+}
+
+// WriteTemplate executes t against the TemplateView of c, writing the result
+// to a specified Writer. For example, this template writes one line per path:
+//
+//	{{ range .Paths }}{{ . }} {{ (index $.Detail .).Percent }}
+//	{{ end }}
+func WriteTemplate(w io.Writer, c PathDetailer, t *template.Template) error {
+	return t.Execute(w, NewTemplateView(c))
+}
@@ -0,0 +1,20 @@
+package funcs
+
+type T struct{ n int }
+
+func Add(a, b int) int {
+	return a + b
+}
+
+func (t T) Get() int {
+	return t.n
+}
+
+func (t *T) Set(n int) {
+	if n < 0 {
+		n = 0
+	}
+	t.n = n
+}
+
+func Empty() {}
@@ -0,0 +1,5 @@
+package a
+
+import "example.com/jobs/two/b"
+
+func A() int { return b.B() + 1 }
@@ -0,0 +1,9 @@
+package a
+
+import "testing"
+
+func TestA(t *testing.T) {
+	if A() != 2 {
+		t.Error("A")
+	}
+}
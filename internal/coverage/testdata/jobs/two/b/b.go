@@ -0,0 +1,7 @@
+package b
+
+func B() int { return 1 }
+
+func C() int { return 2 }
+
+func D() int { return 3 }
@@ -0,0 +1,9 @@
+package b
+
+import "testing"
+
+func TestC(t *testing.T) {
+	if C() != 2 {
+		t.Error("C")
+	}
+}
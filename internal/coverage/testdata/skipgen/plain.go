@@ -0,0 +1,4 @@
+// Package skipgen mixes generated and handwritten files.
+package skipgen
+
+func Plain() int { return 2 }
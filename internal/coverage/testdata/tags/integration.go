@@ -0,0 +1,5 @@
+//go:build integration
+
+package tags
+
+func Integration() int { return 1 }
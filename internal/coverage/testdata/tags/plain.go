@@ -0,0 +1,4 @@
+// Package tags mixes files with and without build constraints.
+package tags
+
+func Plain() int { return 2 }
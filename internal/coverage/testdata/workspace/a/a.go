@@ -0,0 +1,8 @@
+package a
+
+func A(ok bool) int {
+	if ok {
+		return 1
+	}
+	return 0
+}
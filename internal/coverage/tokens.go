@@ -0,0 +1,49 @@
+package coverage
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// ReadTokens reads one token per line, such as an exclude, ignoring blank
+// lines, surrounding whitespace, and comments that start with #.
+func ReadTokens(r io.Reader) ([]string, error) {
+	var tokens []string
+	scan := bufio.NewScanner(r)
+	for scan.Scan() {
+		line := scan.Text()
+		if n := strings.IndexByte(line, '#'); n >= 0 {
+			line = line[:n]
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			tokens = append(tokens, line)
+		}
+	}
+	return tokens, scan.Err()
+}
+
+// LoadTokens reads tokens from the named file as ReadTokens does.
+func LoadTokens(name string) ([]string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadTokens(f)
+}
+
+// AppendExcludeFile appends the tokens of the named exclude file, loaded as
+// LoadTokens does, to excludes. It returns excludes as is if name is empty.
+func AppendExcludeFile(excludes []string, name string) ([]string, error) {
+	if name == "" {
+		return excludes, nil
+	}
+	tokens, err := LoadTokens(name)
+	if err != nil {
+		return excludes, fmt.Errorf("exclude-file: %w", err)
+	}
+	return append(excludes, tokens...), nil
+}
@@ -0,0 +1,125 @@
+package coverage
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/mutility/diag"
+)
+
+// AddUntested adds uncovered entries to files for the Go files of packages
+// matched by options.CoverPkgs, or options.Packages, that have no entries in
+// files, such as packages without tests. Their statements are counted by
+// parsing them, so they count toward the total as go test -cover would.
+// Excludes, Includes, SkipGenerated, and BuildTags apply as to profiles.
+func AddUntested(ctx diag.Context, files FileData, options *TestOptions) error {
+	if options == nil {
+		options = DefaultTestOptions
+	}
+	includes, err := options.includer()
+	if err != nil {
+		return err
+	}
+	globExcludes, err := options.globExcluder()
+	if err != nil {
+		return err
+	}
+
+	pkgs := options.CoverPkgs
+	if len(pkgs) == 0 {
+		pkgs = options.Packages
+	}
+	const format = "{{.ImportPath}}\t{{.Dir}}" +
+		"{{range .GoFiles}}\t{{.}}{{end}}" +
+		"{{range .CgoFiles}}\t{{.}}{{end}}"
+	args := append([]string{"list", "-e"}, tagsFlag(options.BuildTags)...)
+	args = append(args, "-f", format)
+	args = append(args, packageArgs(pkgs, "")...)
+
+	diag.Debug(ctx, "exec> go", strings.Join(args, " "))
+	out, err := exec.CommandContext(ctx, "go", args...).Output()
+	if err != nil {
+		return fmt.Errorf("go list: %w", err)
+	}
+
+	tested := make(map[string]bool)
+	for file := range files {
+		tested[pathpkg(ctx, file)] = true
+	}
+
+	scan := bufio.NewScanner(bytes.NewReader(out))
+	for scan.Scan() {
+		f := strings.Split(scan.Text(), "\t")
+		if len(f) < 3 || f[1] == "" || tested[f[0]] {
+			continue
+		}
+		diag.Debug(ctx, "adding untested package:", f[0])
+		for _, name := range f[2:] {
+			file := f[0] + "/" + name
+			if options.excludes(file) || !includes(file) || globExcludes(file) {
+				continue
+			}
+			src := filepath.Join(f[1], name)
+			if options.SkipGenerated {
+				gen, err := isGenerated(src)
+				if err != nil {
+					return err
+				}
+				if gen {
+					continue
+				}
+			}
+			n, err := countStatements(src)
+			if err != nil {
+				return err
+			}
+			if n > 0 {
+				files[file] = StmtCount{Count: n}
+			}
+		}
+	}
+	return scan.Err()
+}
+
+// countStatements counts the statements in the function bodies of a Go
+// file, approximating how go test -cover counts them.
+func countStatements(name string) (int, error) {
+	file, err := parser.ParseFile(token.NewFileSet(), name, nil, parser.SkipObjectResolution)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	ast.Inspect(file, func(node ast.Node) bool {
+		switch node := node.(type) {
+		case *ast.BlockStmt:
+			n += countList(node.List)
+		case *ast.CaseClause:
+			n += len(node.Body)
+		case *ast.CommClause:
+			n += len(node.Body)
+		}
+		return true
+	})
+	return n, nil
+}
+
+// countList counts the statements of list, except the clauses of switch and
+// select bodies, which are not statements of their own.
+func countList(list []ast.Stmt) int {
+	n := 0
+	for _, s := range list {
+		switch s.(type) {
+		case *ast.CaseClause, *ast.CommClause:
+		default:
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,104 @@
+package coverage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/mutility/diag"
+)
+
+// workspaceModule is a module listed by go list -m -json.
+type workspaceModule struct {
+	Path string
+	Dir  string
+}
+
+// workspaceModules lists the main modules: each module of the go.work
+// workspace, or the current module outside a workspace.
+func workspaceModules(ctx diag.Context) ([]workspaceModule, error) {
+	diag.Debug(ctx, "exec> go list -m -json")
+	out, err := exec.CommandContext(ctx, "go", "list", "-m", "-json").Output()
+	if err != nil {
+		return nil, fmt.Errorf("go list: %w", err)
+	}
+
+	var mods []workspaceModule
+	d := json.NewDecoder(bytes.NewReader(out))
+	for d.More() {
+		var mod workspaceModule
+		if err := d.Decode(&mod); err != nil {
+			return nil, fmt.Errorf("go list: %w", err)
+		}
+		if mod.Dir != "" {
+			mods = append(mods, mod)
+		}
+	}
+	return mods, nil
+}
+
+// workspaceProfile runs go test in each workspace module and combines their
+// coverprofiles into profile.
+func workspaceProfile(ctx diag.Context, options *TestOptions, profile string) error {
+	mods, err := workspaceModules(ctx)
+	if err != nil {
+		return err
+	}
+
+	out, err := os.Create(profile)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	for i, mod := range mods {
+		diag.Debug(ctx, "testing module:", mod.Path, "in", mod.Dir)
+		if err := appendModuleProfile(ctx, options, mod.Dir, out, i == 0); err != nil {
+			return fmt.Errorf("%s: %w", mod.Path, err)
+		}
+	}
+	return out.Close()
+}
+
+// appendModuleProfile runs go test in dir and copies its coverprofile to w,
+// including its mode line only if first.
+func appendModuleProfile(ctx diag.Context, options *TestOptions, dir string, w io.Writer, first bool) error {
+	tmp, err := os.CreateTemp("", "covpkg*")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	if err := goTest(ctx, options, dir, tmp.Name()); err != nil {
+		return err
+	}
+	return appendProfile(w, tmp.Name(), first)
+}
+
+// appendProfile copies the coverprofile name to w, including its mode line
+// only if first.
+func appendProfile(w io.Writer, name string, first bool) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scan := bufio.NewScanner(f)
+	for scan.Scan() {
+		line := scan.Text()
+		if !first && strings.HasPrefix(line, "mode:") {
+			continue
+		}
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+	return scan.Err()
+}
@@ -1,8 +1,11 @@
 package git
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"os/exec"
+	"strings"
 
 	"github.com/mutility/diag"
 )
@@ -19,10 +22,20 @@ func Checkout(ctx diag.Context, ref string) (string, error) {
 	return run(ctx, "checkout", ref)
 }
 
+// CurrentBranch returns the short name of the checked out branch, or an
+// error if HEAD is detached.
+func CurrentBranch(ctx diag.Context) (string, error) {
+	return run(ctx, "symbolic-ref", "--short", "-q", "HEAD")
+}
+
 func Fetch(ctx diag.Context, remote string, args ...string) (string, error) {
 	return run(ctx, append([]string{"fetch", remote}, args...)...)
 }
 
+func Diff(ctx diag.Context, args ...string) (string, error) {
+	return run(ctx, append([]string{"diff"}, args...)...)
+}
+
 func IsDirty(ctx diag.Context) bool {
 	_, err := run(ctx, "diff", "--quiet", "--exit-code")
 	return err != nil
@@ -36,11 +49,42 @@ func RevParse(ctx diag.Context, ref string) (string, error) {
 	return run(ctx, "rev-parse", ref)
 }
 
+func MergeBase(ctx diag.Context, a, b string) (string, error) {
+	return run(ctx, "merge-base", a, b)
+}
+
+// Blame returns the output of git blame with args for file, which is passed
+// after -- so that it is never read as a revision.
+func Blame(ctx diag.Context, file string, args ...string) (string, error) {
+	return run(ctx, append(append([]string{"blame"}, args...), "--", file)...)
+}
+
+func CheckRefFormat(ctx diag.Context, ref string) error {
+	_, err := run(ctx, "check-ref-format", ref)
+	return err
+}
+
 func Notes(ctx diag.Context, args ...string) (string, error) {
 	return run(ctx, append([]string{"notes"}, args...)...)
 }
 
+// NotesRemove removes the notes of ref on commits, passing them on stdin so
+// that any number fit.
+func NotesRemove(ctx diag.Context, ref string, commits []string) (string, error) {
+	return runInput(ctx, strings.NewReader(strings.Join(commits, "\n")+"\n"), "notes", "--ref", ref, "remove", "--stdin")
+}
+
+// NotesList lists the notes of ref as lines of note object and annotated commit.
+func NotesList(ctx diag.Context, ref string) (string, error) {
+	return run(ctx, "notes", "--ref", ref, "list")
+}
+
 func run(ctx diag.Context, args ...string) (string, error) {
+	return runInput(ctx, nil, args...)
+}
+
+// runInput is like run, but passes stdin to git.
+func runInput(ctx diag.Context, stdin io.Reader, args ...string) (string, error) {
 	if ctx != nil {
 		iargs := make([]any, 1+len(args))
 		for i := range args {
@@ -50,11 +94,15 @@ func run(ctx diag.Context, args ...string) (string, error) {
 		diag.Debug(ctx, iargs...)
 	}
 	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Stdin = stdin
 	out, err := cmd.Output()
 	if err != nil {
 		if err, ok := err.(*exec.ExitError); ok {
 			diag.Debug(ctx, "<exit", err.ExitCode(), "stderr: ", string(err.Stderr))
 		}
+		if cerr := ctx.Err(); cerr != nil && !errors.Is(err, cerr) {
+			return string(out), fmt.Errorf("%s: %w (%v)", args, cerr, err)
+		}
 		return string(out), fmt.Errorf("%s: %w", args, err)
 	}
 	return string(out), err
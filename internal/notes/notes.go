@@ -1,23 +1,67 @@
 package notes
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/mutility/coverpkg/internal/git"
 	"github.com/mutility/diag"
 )
 
 type RemoteRef struct {
-	Remote string
-	Ref    string
+	Remote   string
+	Ref      string        // Notes ref under refs/notes/, such as coverpkg or coverpkg/v2
+	Compress bool          // Store gzip-compressed, base64-encoded notes
+	Timeout  time.Duration // Limit each fetch from or push to Remote, if positive
+}
+
+type errRefFormat string
+
+func (e errRefFormat) Error() string {
+	return fmt.Sprintf("notes ref '%s'; must be a valid git ref name", string(e))
+}
+
+// notesRef returns the full name of the notes ref of r, after verifying it
+// with git check-ref-format.
+func (r RemoteRef) notesRef(ctx diag.Context) (string, error) {
+	notes := `refs/notes/` + r.Ref
+	if err := git.CheckRefFormat(ctx, notes); err != nil {
+		diag.Debug(ctx, "check-ref-format:", err)
+		return "", errRefFormat(r.Ref)
+	}
+	return notes, nil
+}
+
+// remote limits ctx to r.Timeout for a git operation with r.Remote.
+func (r RemoteRef) remote(ctx diag.Context) (diag.Context, context.CancelFunc) {
+	if r.Timeout <= 0 {
+		return ctx, func() {}
+	}
+	tctx, cancel := context.WithTimeout(ctx, r.Timeout)
+	return diag.WithContext(tctx, ctx), cancel
 }
 
 // Fetch copies notes from r to the local repo
 func Fetch(ctx diag.Context, r RemoteRef) error {
-	notes := `refs/notes/` + r.Ref
+	notes, err := r.notesRef(ctx)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := r.remote(ctx)
+	defer cancel()
 	out, err := git.Fetch(ctx, r.Remote, notes+":"+notes)
 	diag.Debug(ctx, out)
 	return err
@@ -25,15 +69,87 @@ func Fetch(ctx diag.Context, r RemoteRef) error {
 
 // Push copies notes from the local repo to r
 func Push(ctx diag.Context, r RemoteRef) error {
-	notes := `refs/notes/` + r.Ref
+	notes, err := r.notesRef(ctx)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := r.remote(ctx)
+	defer cancel()
 	out, err := git.Push(ctx, r.Remote, notes+":"+notes)
 	diag.Debug(ctx, out)
 	return err
 }
 
-// Store saves data against the head commit, copying it or encoding as JSON.
+// PushWithRetry copies notes from the local repo to r. If the push is
+// rejected because the remote notes are ahead, typically because notes were
+// pushed concurrently, it fetches the remote notes, merges them with strategy
+// (see git notes merge), and retries up to retries times. Other errors are
+// returned without retrying.
+func PushWithRetry(ctx diag.Context, r RemoteRef, strategy string, retries int) error {
+	err := Push(ctx, r)
+	for i := 0; isRejected(err) && i < retries; i++ {
+		diag.Debug(ctx, "retrying notes push:", err)
+		if err := fetchMerge(ctx, r, strategy); err != nil {
+			return err
+		}
+		err = Push(ctx, r)
+	}
+	return err
+}
+
+// isRejected reports whether err is a git push rejected as non-fast-forward,
+// or because the remote has notes the local repo lacks.
+func isRejected(err error) bool {
+	var exit *exec.ExitError
+	if !errors.As(err, &exit) {
+		return false
+	}
+	stderr := string(exit.Stderr)
+	return strings.Contains(stderr, "(non-fast-forward)") || strings.Contains(stderr, "(fetch first)")
+}
+
+// fetchMerge merges notes from r into the local notes using strategy.
+func fetchMerge(ctx diag.Context, r RemoteRef, strategy string) error {
+	notes, err := r.notesRef(ctx)
+	if err != nil {
+		return err
+	}
+	remote := `refs/notes/remotes/` + r.Remote + `/` + r.Ref
+	fctx, cancel := r.remote(ctx)
+	out, err := git.Fetch(fctx, r.Remote, "+"+notes+":"+remote)
+	cancel()
+	diag.Debug(ctx, out)
+	if err != nil {
+		return err
+	}
+	out, err = git.Notes(ctx, "--ref", notes, "merge", "-s", strategy, remote)
+	diag.Debug(ctx, out)
+	return err
+}
+
+// ConfigureMergeDriver sets git config so that git notes merge merges the
+// notes of r with strategy when given no -s, and so that commands that rewrite
+// commits, such as git commit --amend and git rebase, copy their notes.
+func ConfigureMergeDriver(ctx diag.Context, r RemoteRef, strategy string) error {
+	notes, err := r.notesRef(ctx)
+	if err != nil {
+		return err
+	}
+	if _, err := git.Config(ctx, "notes."+r.Ref+".mergeStrategy", strategy); err != nil {
+		return err
+	}
+	_, err = git.Config(ctx, "--replace-all", "notes.rewriteRef", notes, "^"+regexp.QuoteMeta(notes)+"$")
+	return err
+}
+
+// Store saves data against the head commit, copying it or encoding as JSON,
+// and compressing it if r.Compress is set.
 // Note that copied data should be clear next, but this is not enforced here.
 func Store(ctx diag.Context, r RemoteRef, data any) error {
+	notes, err := r.notesRef(ctx)
+	if err != nil {
+		return err
+	}
 	if git.IsDirty(ctx) {
 		return errors.New("workspace is dirty")
 	}
@@ -46,14 +162,21 @@ func Store(ctx diag.Context, r RemoteRef, data any) error {
 			diag.Error(ctx, "removing temp:", err)
 		}
 	}()
+	var buf []byte
 	switch data := data.(type) {
 	case string:
-		_, err = f.WriteString(data)
+		buf = []byte(data)
 	case []byte:
-		_, err = f.Write(data)
+		buf = data
 	default:
-		e := json.NewEncoder(f)
-		err = e.Encode(data)
+		buf, err = json.Marshal(data)
+		buf = append(buf, '\n')
+	}
+	if err == nil && r.Compress {
+		buf, err = compress(buf)
+	}
+	if err == nil {
+		_, err = f.Write(buf)
 	}
 	if err != nil {
 		return err
@@ -61,16 +184,26 @@ func Store(ctx diag.Context, r RemoteRef, data any) error {
 	if err = f.Close(); err != nil {
 		return err
 	}
-	_, err = git.Notes(ctx, "--ref", r.Ref, "add", "-f", "-F", f.Name())
+	_, err = git.Notes(ctx, "--ref", notes, "add", "-f", "-F", f.Name())
 	return err
 }
 
 // Load attempts to retrieve notes from commit into data, copying or decoding as JSON.
+// Compressed notes are detected and decompressed whether or not r.Compress is set.
 func Load(ctx diag.Context, r RemoteRef, commit string, data any) error {
-	buf, err := git.Notes(ctx, "--ref", r.Ref, "show", commit)
+	notes, err := r.notesRef(ctx)
 	if err != nil {
 		return err
 	}
+	buf, err := git.Notes(ctx, "--ref", notes, "show", commit)
+	if err != nil {
+		return err
+	}
+	if isCompressed(buf) {
+		if buf, err = decompress(buf); err != nil {
+			return fmt.Errorf("decompressing note: %w", err)
+		}
+	}
 
 	switch data := data.(type) {
 	case *string:
@@ -84,6 +217,48 @@ func Load(ctx diag.Context, r RemoteRef, commit string, data any) error {
 	return nil
 }
 
+// compressedPrefix begins the base64 encoding of every gzip stream, and
+// never a JSON document.
+const compressedPrefix = "H4sI"
+
+// compress gzips buf and encodes it as base64 text, so that git does not
+// alter it as it would binary note content.
+func compress(buf []byte) ([]byte, error) {
+	var b bytes.Buffer
+	enc := base64.NewEncoder(base64.StdEncoding, &b)
+	zw := gzip.NewWriter(enc)
+	if _, err := zw.Write(buf); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	b.WriteByte('\n')
+	return b.Bytes(), nil
+}
+
+// isCompressed reports whether note was stored by compress.
+func isCompressed(note string) bool {
+	return strings.HasPrefix(note, compressedPrefix)
+}
+
+// decompress reverses compress.
+func decompress(note string) (string, error) {
+	dec := base64.NewDecoder(base64.StdEncoding, strings.NewReader(strings.TrimSpace(note)))
+	zr, err := gzip.NewReader(dec)
+	if err != nil {
+		return "", err
+	}
+	buf, err := io.ReadAll(zr)
+	if err != nil {
+		return "", err
+	}
+	return string(buf), zr.Close()
+}
+
 // EnsureUser copies the user name and email from the head commit, if necessary.
 // Calling Store in a GitHub action is likely to require this.
 func EnsureUser(ctx diag.Context) error {
@@ -107,3 +282,121 @@ func EnsureUser(ctx diag.Context) error {
 	}
 	return nil
 }
+
+// Record is a point in the coverage history of a ref.
+type Record struct {
+	Commit  string    `json:"commit"`
+	Time    time.Time `json:"time"`
+	Percent float64   `json:"percent"`
+}
+
+// History returns the ref that holds the coverage history of r, with the
+// same remote and timeout.
+func (r RemoteRef) History() RemoteRef {
+	return RemoteRef{Remote: r.Remote, Ref: r.Ref + "-history", Timeout: r.Timeout}
+}
+
+// Append adds rec to the history of r, as a line of JSON in the note of its
+// commit. An empty Commit is set to the head commit, and a zero Time to now.
+func Append(ctx diag.Context, r RemoteRef, rec Record) error {
+	if rec.Commit == "" {
+		head, err := git.RevParse(ctx, "HEAD")
+		if err != nil {
+			return err
+		}
+		rec.Commit = strings.TrimSpace(head)
+	}
+	if rec.Time.IsZero() {
+		rec.Time = time.Now().UTC()
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	ref, err := r.History().notesRef(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = git.Notes(ctx, "--ref", ref, "append", "-m", string(line), rec.Commit)
+	return err
+}
+
+// History returns up to the last n records of the history of r, oldest
+// first. If n is not positive, it returns all records.
+func History(ctx diag.Context, r RemoteRef, n int) ([]Record, error) {
+	ref, err := r.History().notesRef(ctx)
+	if err != nil {
+		return nil, err
+	}
+	list, err := git.NotesList(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+
+	var recs []Record
+	for _, line := range strings.Split(strings.TrimSpace(list), "\n") {
+		f := strings.Fields(line)
+		if len(f) != 2 {
+			continue
+		}
+		buf, err := git.Notes(ctx, "--ref", ref, "show", f[1])
+		if err != nil {
+			return nil, err
+		}
+		d := json.NewDecoder(strings.NewReader(buf))
+		for d.More() {
+			var rec Record
+			if err := d.Decode(&rec); err != nil {
+				return nil, fmt.Errorf("decoding history of %s: %w", f[1], err)
+			}
+			recs = append(recs, rec)
+		}
+	}
+
+	sort.SliceStable(recs, func(i, j int) bool { return recs[i].Time.Before(recs[j].Time) })
+	if n > 0 && len(recs) > n {
+		recs = recs[len(recs)-n:]
+	}
+	return recs, nil
+}
+
+// Prune removes the notes of r on commits made before cutoff, returning the
+// commits whose notes were removed. If dryRun is set, it only returns them.
+// Notes on commits that cannot be found are kept; see git notes prune.
+func Prune(ctx diag.Context, r RemoteRef, cutoff time.Time, dryRun bool) ([]string, error) {
+	ref, err := r.notesRef(ctx)
+	if err != nil {
+		return nil, err
+	}
+	list, err := git.NotesList(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+
+	var old []string
+	for _, line := range strings.Split(strings.TrimSpace(list), "\n") {
+		f := strings.Fields(line)
+		if len(f) != 2 {
+			continue
+		}
+		out, err := git.Show(ctx, "-s", "--format=%ct", f[1])
+		if err != nil {
+			diag.Debug(ctx, "skipping note of", f[1]+":", err)
+			continue
+		}
+		secs, err := strconv.ParseInt(strings.TrimSpace(out), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("commit date of %s: %w", f[1], err)
+		}
+		if time.Unix(secs, 0).Before(cutoff) {
+			old = append(old, f[1])
+		}
+	}
+
+	if len(old) > 0 && !dryRun {
+		if _, err := git.NotesRemove(ctx, ref, old); err != nil {
+			return nil, err
+		}
+	}
+	return old, nil
+}
@@ -0,0 +1,193 @@
+package notes
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mutility/coverpkg/internal/testgit"
+	"github.com/mutility/diag/testdiag"
+)
+
+func TestMultiSegmentRef(t *testing.T) {
+	testgit.New(t)
+	ctx := testdiag.Context(t)
+	r := RemoteRef{Remote: "origin", Ref: "coverpkg/v2"}
+
+	want := map[string]int{"covered": 3}
+	if err := Store(ctx, r, want); err != nil {
+		t.Fatal("store:", err)
+	}
+	if err := Push(ctx, r); err != nil {
+		t.Fatal("push:", err)
+	}
+	if out, err := exec.Command("git", "update-ref", "-d", "refs/notes/coverpkg/v2").CombinedOutput(); err != nil {
+		t.Fatalf("deleting notes: %v\n%s", err, out)
+	}
+	var got map[string]int
+	if err := Load(ctx, r, "HEAD", &got); err == nil {
+		t.Fatal("load: got nil, want error before fetch")
+	}
+	if err := Fetch(ctx, r); err != nil {
+		t.Fatal("fetch:", err)
+	}
+	if err := Load(ctx, r, "HEAD", &got); err != nil || got["covered"] != 3 {
+		t.Errorf("load: got %v, %v, want %v", got, err, want)
+	}
+
+	for _, ref := range []string{"", "coverpkg/", "bad..ref", "bad ref", "coverpkg/v2.lock"} {
+		r := RemoteRef{Remote: "origin", Ref: ref}
+		var efmt errRefFormat
+		if err := Store(ctx, r, want); !errors.As(err, &efmt) {
+			t.Errorf("store %q: got %v, want errRefFormat", ref, err)
+		}
+		if err := Fetch(ctx, r); !errors.As(err, &efmt) {
+			t.Errorf("fetch %q: got %v, want errRefFormat", ref, err)
+		}
+	}
+}
+
+func TestCompress(t *testing.T) {
+	testgit.New(t)
+	ctx := testdiag.Context(t)
+	plain := RemoteRef{Ref: "coverpkg"}
+	compressed := RemoteRef{Ref: "coverpkg", Compress: true}
+
+	want := map[string]int{"covered": 3}
+	if err := Store(ctx, compressed, want); err != nil {
+		t.Fatal("store:", err)
+	}
+	var raw string
+	if err := Load(ctx, plain, "HEAD", &raw); err != nil || isCompressed(raw) {
+		t.Errorf("load raw: got %q, %v, want decompressed note", raw, err)
+	}
+	out, err := exec.Command("git", "notes", "--ref", "coverpkg", "show", "HEAD").Output()
+	if err != nil || !isCompressed(string(out)) {
+		t.Errorf("git notes show: got %q, %v, want compressed note", out, err)
+	}
+	for _, r := range []RemoteRef{compressed, plain} {
+		var got map[string]int
+		if err := Load(ctx, r, "HEAD", &got); err != nil || got["covered"] != 3 {
+			t.Errorf("load compressed note, Compress=%v: got %v, %v, want %v", r.Compress, got, err, want)
+		}
+	}
+
+	// notes stored before compression still decode
+	if err := Store(ctx, plain, want); err != nil {
+		t.Fatal("store:", err)
+	}
+	var got map[string]int
+	if err := Load(ctx, compressed, "HEAD", &got); err != nil || got["covered"] != 3 {
+		t.Errorf("load plain note, Compress=true: got %v, %v, want %v", got, err, want)
+	}
+}
+
+func TestPushWithRetry(t *testing.T) {
+	testgit.New(t)
+	ctx := testdiag.Context(t)
+	r := RemoteRef{Remote: "origin", Ref: "coverpkg"}
+
+	if err := Store(ctx, r, map[string]int{"covered": 1}); err != nil {
+		t.Fatal("store:", err)
+	}
+	if err := Push(ctx, r); err != nil {
+		t.Fatal("push:", err)
+	}
+	// replace the local notes with unrelated ones, as a concurrent job would
+	if out, err := exec.Command("git", "update-ref", "-d", "refs/notes/coverpkg").CombinedOutput(); err != nil {
+		t.Fatalf("deleting notes: %v\n%s", err, out)
+	}
+	if err := Store(ctx, r, map[string]int{"covered": 2}); err != nil {
+		t.Fatal("store:", err)
+	}
+	if err := Push(ctx, r); !isRejected(err) {
+		t.Fatalf("push: got %v, want rejection", err)
+	}
+	if err := PushWithRetry(ctx, r, "ours", 1); err != nil {
+		t.Fatal("push with retry:", err)
+	}
+	var got map[string]int
+	if err := Load(ctx, r, "HEAD", &got); err != nil || got["covered"] != 2 {
+		t.Errorf("load: got %v, %v, want our note", got, err)
+	}
+
+	// other errors are returned from the push, without fetching to merge
+	bad := RemoteRef{Remote: "nosuchremote", Ref: "coverpkg"}
+	if err := PushWithRetry(ctx, bad, "ours", 1); err == nil || isRejected(err) || !strings.Contains(err.Error(), "push") {
+		t.Errorf("push to missing remote: got %v, want push error", err)
+	}
+}
+
+func TestConfigureMergeDriver(t *testing.T) {
+	testgit.New(t)
+	ctx := testdiag.Context(t)
+
+	config := func(args ...string) string {
+		t.Helper()
+		out, err := exec.Command("git", append([]string{"config"}, args...)...).Output()
+		if err != nil {
+			t.Fatalf("git config %v: %v", args, err)
+		}
+		return strings.TrimSpace(string(out))
+	}
+
+	// configuring twice must not repeat rewriteRef, nor drop other refs
+	for _, ref := range []string{"coverpkg/v2", "coverpkg/v2", "other"} {
+		if err := ConfigureMergeDriver(ctx, RemoteRef{Ref: ref}, "union"); err != nil {
+			t.Fatal("configure:", err)
+		}
+	}
+	if got := config("notes.coverpkg/v2.mergeStrategy"); got != "union" {
+		t.Errorf("mergeStrategy: got %q, want union", got)
+	}
+	want := "refs/notes/coverpkg/v2\nrefs/notes/other"
+	if got := config("--get-all", "notes.rewriteRef"); got != want {
+		t.Errorf("rewriteRef: got %q, want %q", got, want)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	testgit.New(t)
+	ctx := testdiag.Context(t)
+	r := RemoteRef{Ref: "coverpkg"}
+
+	commit := func(date string) string {
+		t.Helper()
+		cmd := exec.Command("git", "commit", "-q", "--allow-empty", "-m", date)
+		cmd.Env = append(os.Environ(), "GIT_COMMITTER_DATE="+date)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("commit: %v\n%s", err, out)
+		}
+		if err := Store(ctx, r, map[string]int{"covered": 1}); err != nil {
+			t.Fatal("store:", err)
+		}
+		head, err := exec.Command("git", "rev-parse", "HEAD").Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.TrimSpace(string(head))
+	}
+	old := commit("2000-01-01T00:00:00Z")
+	recent := commit(time.Now().Format(time.RFC3339))
+	cutoff := time.Now().AddDate(0, 0, -90)
+
+	for _, dryRun := range []bool{true, false} {
+		pruned, err := Prune(ctx, r, cutoff, dryRun)
+		if err != nil || len(pruned) != 1 || pruned[0] != old {
+			t.Fatalf("prune dryRun=%v: got %v, %v, want [%s]", dryRun, pruned, err, old)
+		}
+		var got map[string]int
+		if err := Load(ctx, r, old, &got); (err == nil) != dryRun {
+			t.Errorf("load old after prune dryRun=%v: got %v", dryRun, err)
+		}
+		if err := Load(ctx, r, recent, &got); err != nil {
+			t.Errorf("load recent after prune dryRun=%v: %v", dryRun, err)
+		}
+	}
+	if pruned, err := Prune(ctx, r, cutoff, false); err != nil || len(pruned) != 0 {
+		t.Errorf("prune again: got %v, %v, want none", pruned, err)
+	}
+}
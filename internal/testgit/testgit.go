@@ -0,0 +1,88 @@
+// Package testgit creates git repositories for tests.
+package testgit
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Repo is a git repository created by New.
+type Repo struct {
+	t      *testing.T
+	Dir    string // Work tree of the repository
+	Origin string // Bare repository added as remote origin
+}
+
+// New creates a repository on branch main, whose first commit adds a.txt
+// holding 1, with a bare repository as its origin remote. It sets the git
+// author and committer, ignores the global git config, and changes to the
+// repository for the rest of the test.
+func New(t *testing.T) *Repo {
+	t.Helper()
+	for _, v := range []string{"GIT_AUTHOR_NAME", "GIT_COMMITTER_NAME"} {
+		t.Setenv(v, "coverpkg")
+	}
+	for _, v := range []string{"GIT_AUTHOR_EMAIL", "GIT_COMMITTER_EMAIL"} {
+		t.Setenv(v, "coverpkg@example.com")
+	}
+	t.Setenv("GIT_CONFIG_GLOBAL", os.DevNull)
+
+	dir := t.TempDir()
+	r := &Repo{t: t, Dir: filepath.Join(dir, "work"), Origin: filepath.Join(dir, "origin.git")}
+	r.run(dir, "init", "-q", "--bare", r.Origin)
+	r.run(dir, "init", "-q", "-b", "main", r.Dir)
+	r.Git("remote", "add", "origin", r.Origin)
+	r.Commit("1\n")
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(r.Dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	return r
+}
+
+// Git runs git with args in the repository, failing the test if it fails,
+// and returns its output without surrounding space.
+func (r *Repo) Git(args ...string) string {
+	r.t.Helper()
+	return r.run(r.Dir, args...)
+}
+
+func (r *Repo) run(dir string, args ...string) string {
+	r.t.Helper()
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		var stderr []byte
+		if exit, ok := err.(*exec.ExitError); ok {
+			stderr = exit.Stderr
+		}
+		r.t.Fatalf("git %v: %v\n%s", args, err, stderr)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// Write replaces the content of a.txt.
+func (r *Repo) Write(content string) {
+	r.t.Helper()
+	if err := os.WriteFile(filepath.Join(r.Dir, "a.txt"), []byte(content), 0o600); err != nil {
+		r.t.Fatal(err)
+	}
+}
+
+// Commit replaces the content of a.txt, and commits it with the content as
+// its message.
+func (r *Repo) Commit(content string) {
+	r.t.Helper()
+	r.Write(content)
+	r.Git("add", "a.txt")
+	r.Git("commit", "-q", "-m", strings.TrimSpace(content))
+}